@@ -1,8 +1,9 @@
 package altimeter
 
 import (
-	"net/http"
 	"time"
+
+	"github.com/TitechMeister/Neon/sensor"
 )
 
 // altimeter model
@@ -35,17 +36,16 @@ type AltimeterRawData struct {
 
 // Altimeterのクラス
 type Altimeter struct {
-	// データの履歴配列
-	DataHistory []AltimeterRawData `json:"data_history"`
-	// httpクライアント
-	Client *http.Client `json:"client"` // Uncomment if you need an HTTP client for requests
-	// ログ更新周波数
-	LogFrequency int `json:"log_frequency"` // Frequency of logging data in a second
+	*sensor.Sensor[AltimeterRawData, AltimeterUIData]
 }
 
-type AltimeterDLlink struct {
-	// Download link for the altimeter data
-	DownloadLink string `json:"download_link"`
-	// Timestamp of the download link creation
-	Timestamp time.Time `json:"timestamp"`
+type AltimeterDLlink = sensor.DLlink
+
+// シリアルで送られる高度計のパケット(ビッグエンディアン、16バイト)
+type altimeterPacket struct {
+	DeviceID    uint8
+	_           [3]byte
+	Altitude    float32
+	Temperature float32
+	Timestamp   int32
 }
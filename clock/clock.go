@@ -0,0 +1,219 @@
+package clock
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// 推定に使う組の数
+	window = 600
+	// 推定からこれ以上ずれたら時計が飛んだとみなす
+	jumpThreshold = 2 * time.Second
+)
+
+func NewTracker(spec Spec) *Tracker {
+	if spec.Unit <= 0 {
+		spec.Unit = time.Millisecond
+	}
+	return &Tracker{spec: spec, devices: map[uint8]*device{}}
+}
+
+// データの時刻を推定に加え、3つの時刻を返す
+// 壁時計にはserialサーバが受け取った時刻を、なければNeonが受け取った時刻を使う
+func (t *Tracker) Observe(r Reading, ingest time.Time) Timestamps {
+	ts := stamps(r, ingest)
+	if !r.HasDevice {
+		return ts
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.devices[r.DeviceID]
+	if !ok {
+		d = &device{last: r.Device, origin: r.Device, wallOrigin: wall(r, ingest)}
+		t.devices[r.DeviceID] = d
+	}
+	ticks := t.unwrap(d, r.Device)
+	d.samples++
+
+	x, y := t.seconds(d, ticks), wall(r, ingest).Sub(d.wallOrigin).Seconds()
+	if d.ready && math.Abs(d.a+d.b*x-y) > jumpThreshold.Seconds()+t.spec.Unit.Seconds() {
+		// 時計が飛んだので、このデータから推定をやり直す
+		d.jumps++
+		d.pairs = d.pairs[:0]
+		d.origin, d.wallOrigin = ticks, wall(r, ingest)
+		x, y = 0, 0
+	}
+	d.pairs = append(d.pairs, pair{device: x, wall: y})
+	if len(d.pairs) > window {
+		d.pairs = append(d.pairs[:0], d.pairs[len(d.pairs)-window:]...)
+	}
+	d.fit()
+
+	deviceTime := d.wallOrigin.Add(time.Duration((d.a + d.b*x) * float64(time.Second))).UnixMilli()
+	ts.DeviceTime = &deviceTime
+	return ts
+}
+
+// 推定を変えずに、過去のデータの3つの時刻を返す
+// カウンタが何周目かはNeonが受け取った時刻に一番近くなるように選ぶ
+func (t *Tracker) Stamp(r Reading, ingest time.Time) Timestamps {
+	ts := stamps(r, ingest)
+	if !r.HasDevice {
+		return ts
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.devices[r.DeviceID]
+	if !ok || !d.ready {
+		return ts
+	}
+	ticks := r.Device
+	if t.spec.Period > 0 {
+		// 受け取った時刻にデバイスの時計が指していたはずの値
+		y := wall(r, ingest).Sub(d.wallOrigin).Seconds()
+		expected := float64(d.origin) + (y-d.a)/d.b/t.spec.Unit.Seconds()
+		k := math.Round((expected - float64(r.Device)) / float64(t.spec.Period))
+		ticks = uint64(max(k, 0))*t.spec.Period + r.Device
+	}
+	x := t.seconds(d, ticks)
+	deviceTime := d.wallOrigin.Add(time.Duration((d.a + d.b*x) * float64(time.Second))).UnixMilli()
+	ts.DeviceTime = &deviceTime
+	return ts
+}
+
+// デバイスごとの推定結果をIDの順に返す
+func (t *Tracker) Status() []DeviceStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statuses := []DeviceStatus{}
+	for id, d := range t.devices {
+		status := DeviceStatus{
+			DeviceID: id,
+			Samples:  d.samples,
+			Window:   len(d.pairs),
+			Wraps:    int(d.wraps),
+			Jumps:    d.jumps,
+			Last:     d.last,
+			JitterMS: d.rms * 1000,
+		}
+		if d.ready {
+			status.DriftPPM = (1/d.b - 1) * 1e6
+			if n := len(d.pairs); n > 0 {
+				x := d.pairs[n-1].device
+				wallMS := float64(d.wallOrigin.UnixMilli()) + (d.a+d.b*x)*1000
+				ticks := d.wraps*t.spec.Period + d.last
+				status.OffsetMS = wallMS - float64(ticks)*float64(t.spec.Unit)/float64(time.Millisecond)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].DeviceID < statuses[j].DeviceID })
+	return statuses
+}
+
+// カウンタの値を一周した回数を含めた値にする
+// 一周する直前のデータが遅れて届いたら、前の周のものとみなす
+func (t *Tracker) unwrap(d *device, raw uint64) uint64 {
+	period := t.spec.Period
+	if period == 0 {
+		d.last = raw
+		return raw
+	}
+	switch {
+	case raw < d.last && d.last-raw > period/2:
+		d.wraps++
+	case raw > d.last && raw-d.last > period/2 && d.wraps > 0:
+		return (d.wraps-1)*period + raw
+	}
+	d.last = raw
+	return d.wraps*period + raw
+}
+
+// 原点からのデバイスの時計の秒
+func (t *Tracker) seconds(d *device, ticks uint64) float64 {
+	return (float64(ticks) - float64(d.origin)) * t.spec.Unit.Seconds()
+}
+
+// 最小二乗法で壁時計 = a + b * デバイスの時計 を当てはめる
+// デバイスの時計が1秒以上進むまでは傾きを1とみなす
+func (d *device) fit() {
+	n := float64(len(d.pairs))
+	var sx, sy, sxx, sxy float64
+	minX, maxX := math.Inf(1), math.Inf(-1)
+	for _, p := range d.pairs {
+		sx += p.device
+		sy += p.wall
+		sxx += p.device * p.device
+		sxy += p.device * p.wall
+		minX, maxX = min(minX, p.device), max(maxX, p.device)
+	}
+	d.b = 1
+	if maxX-minX >= 1 {
+		if denom := n*sxx - sx*sx; denom > 0 {
+			d.b = (n*sxy - sx*sy) / denom
+		}
+	}
+	if d.b <= 0 {
+		d.b = 1
+	}
+	d.a = (sy - d.b*sx) / n
+	var sum float64
+	for _, p := range d.pairs {
+		r := p.wall - (d.a + d.b*p.device)
+		sum += r * r
+	}
+	d.rms = math.Sqrt(sum / n)
+	d.ready = true
+}
+
+// 推定に使う壁時計
+func wall(r Reading, ingest time.Time) time.Time {
+	if !r.Upstream.IsZero() {
+		return r.Upstream
+	}
+	return ingest
+}
+
+// デバイスの時計からの推定を除いた時刻
+func stamps(r Reading, ingest time.Time) Timestamps {
+	ts := Timestamps{DeviceID: r.DeviceID, Ingest: ingest.UnixMilli()}
+	if r.HasDevice {
+		device := r.Device
+		ts.Device = &device
+	}
+	if !r.Upstream.IsZero() {
+		upstream := r.Upstream.UnixMilli()
+		ts.Upstream = &upstream
+	}
+	return ts
+}
+
+func NewHandler(targets []Target) *Handler {
+	return &Handler{targets: targets}
+}
+
+func (h *Handler) RegisterRoutes(e *echo.Echo) {
+	e.GET("/clock", h.GetClock)
+}
+
+// センサーごと、デバイスごとの時計の推定結果を返す
+func (h *Handler) GetClock(c echo.Context) error {
+	res := map[string][]DeviceStatus{}
+	for _, target := range h.targets {
+		res[target.GetSencorName()] = target.ClockStatus()
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// Unixミリ秒の時刻を返す(0なら時刻なしとしてゼロ値を返す)
+func UnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
@@ -0,0 +1,104 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// デバイスの時計の仕様
+type Spec struct {
+	// 1カウントの長さ
+	Unit time.Duration
+	// 一周するカウント数(0なら一周しない)
+	// e.g. uint32のカウンタなら1<<32
+	Period uint64
+}
+
+// 1件のデータに含まれる時刻
+type Reading struct {
+	// データを送ったデバイスのID(デバイスごとに時計を推定する)
+	DeviceID uint8
+	// デバイスの時計の値(Specの単位のまま)
+	Device uint64
+	// デバイスの時計の値を含むか
+	HasDevice bool
+	// serialサーバがデータを受け取った時刻(なければゼロ値)
+	Upstream time.Time
+}
+
+// データに付ける3つの時刻
+type Timestamps struct {
+	DeviceID uint8 `json:"device_id"`
+	// デバイスの時計の値(デバイスの単位のまま)
+	Device *uint64 `json:"device,omitempty"`
+	// デバイスの時計から推定した時刻(Unixミリ秒)
+	DeviceTime *int64 `json:"device_time,omitempty"`
+	// serialサーバが受け取った時刻(Unixミリ秒)
+	Upstream *int64 `json:"upstream,omitempty"`
+	// Neonが受け取った時刻(Unixミリ秒)
+	Ingest int64 `json:"ingest"`
+}
+
+// 1デバイス分の時計の推定結果
+type DeviceStatus struct {
+	DeviceID uint8 `json:"device_id"`
+	// これまでに見たデータの数と、推定に使っているデータの数
+	Samples int `json:"samples"`
+	Window  int `json:"window"`
+	// カウンタが一周した回数
+	Wraps int `json:"wraps"`
+	// 時計が飛んで推定をやり直した回数
+	Jumps int `json:"jumps"`
+	// 最後に見たデバイスの時計の値
+	Last uint64 `json:"last"`
+	// 最後のデータでの、壁時計とデバイスの時計の差(ミリ秒)
+	// Unix時刻の時計なら通信の遅れと時計のずれの和
+	OffsetMS float64 `json:"offset_ms"`
+	// デバイスの時計の進み(ppm、正ならデバイスの時計が速い)
+	DriftPPM float64 `json:"drift_ppm"`
+	// 推定からのばらつき(二乗平均平方根、ミリ秒)
+	JitterMS float64 `json:"jitter_ms"`
+}
+
+// 1センサー分のデバイスの時計を推定する
+type Tracker struct {
+	spec    Spec
+	mu      sync.Mutex
+	devices map[uint8]*device
+}
+
+// 1デバイス分の推定の状態
+type device struct {
+	// 最後に見たカウンタの値と、それまでに一周した回数
+	last    uint64
+	wraps   uint64
+	samples int
+	jumps   int
+	// 推定に使う組(推定をやり直すと空になる)
+	pairs []pair
+	// 組の原点(デバイスの時計の値とその時の壁時計)
+	origin     uint64
+	wallOrigin time.Time
+	// 壁時計[秒] = a + b * デバイスの時計[秒] (どちらも原点から)
+	a, b  float64
+	rms   float64
+	ready bool
+}
+
+// デバイスの時計と壁時計の組(どちらも原点からの秒)
+type pair struct {
+	device, wall float64
+}
+
+// センサーごとの時計の推定結果を返す
+type Handler struct {
+	targets []Target
+}
+
+// 時計の推定結果を持つセンサー
+type Target interface {
+	// センサーの名前を取得する
+	GetSencorName() string
+	// デバイスごとの時計の推定結果を返す
+	ClockStatus() []DeviceStatus
+}
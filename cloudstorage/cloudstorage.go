@@ -9,10 +9,35 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/metrics"
 )
 
-// uploadFile uploads an object.
+var logger = logging.For("cloudstorage")
+
+// Upload metrics.
+var (
+	uploadDuration = metrics.NewHistogramVec("neon_upload_duration_seconds",
+		"Time to upload a log file and sign its URL, by result.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50}, "result")
+	uploadFailures = metrics.NewCounterVec("neon_upload_failures_total",
+		"Failed log uploads.")
+)
+
+// UploadFile uploads an object and returns a signed URL for it.
+// w is not written to; progress goes to the cloudstorage logger.
 func UploadFile(w io.Writer, bucket, objectName string) (*string, error) {
+	start := time.Now()
+	url, err := uploadFile(w, bucket, objectName)
+	if err != nil {
+		uploadFailures.With().Inc()
+		uploadDuration.With("error").Observe(time.Since(start).Seconds())
+		return nil, err
+	}
+	uploadDuration.With("ok").Observe(time.Since(start).Seconds())
+	return url, nil
+}
+
+func uploadFile(w io.Writer, bucket, objectName string) (*string, error) {
 	// bucket := "bucket-name"
 	// object := "object-name"
 	ctx := context.Background()
@@ -48,7 +73,7 @@ func UploadFile(w io.Writer, bucket, objectName string) (*string, error) {
 	if err := wc.Close(); err != nil {
 		return nil, fmt.Errorf("Writer.Close: %w", err)
 	}
-	fmt.Println(w, "Blob %v uploaded.\n", objectName)
+	logger.Info("blob uploaded", "bucket", bucket, "object", objectName)
 	url, err := GenerateSignedURL(bucket, objectName, time.Hour*24) // Generate a signed URL for the uploaded object
 	if err != nil {
 		return nil, fmt.Errorf("OnGenerateSignedURL: %w", err)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/replay"
+	"github.com/TitechMeister/Neon/serialserver"
+)
+
+// serialサーバ(localhost:7878)の代わりに、シミュレータか記録したログのデータを返す
+func main() {
+	addr := flag.String("addr", ":7878", "address to listen on")
+	replayPath := flag.String("replay", "", "session directory, bundle zip or log directory to replay (default: simulator)")
+	speed := flag.Float64("speed", 1, fmt.Sprintf("replay speed (%v-%v)", replay.MinSpeed, replay.MaxSpeed))
+	loop := flag.Bool("loop", false, "restart the replay from the beginning when it ends")
+	push := flag.String("push", "", "also push data as NDJSON to this Neon ingest TCP address (e.g. localhost:7879)")
+	pushInterval := flag.Duration("push-interval", 100*time.Millisecond, "interval between pushes")
+	pty := flag.Bool("pty", false, "also write binary frames of simulated data to a pseudo-terminal (Linux only)")
+	ptyInterval := flag.Duration("pty-interval", 100*time.Millisecond, "interval between frames written to the pseudo-terminal")
+	flag.Parse()
+	if *speed < replay.MinSpeed || *speed > replay.MaxSpeed {
+		log.Fatalf("serial server: -speed must be between %v and %v, got %v", replay.MinSpeed, replay.MaxSpeed, *speed)
+	}
+
+	// Ctrl-CやSIGTERMを受け取ったらctxがキャンセルされる
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server, err := serialserver.New(ctx, serialserver.Options{Replay: *replayPath, Speed: *speed, Loop: *loop})
+	if err != nil {
+		log.Fatalf("serial server: %v", err)
+	}
+	listening, err := server.Start(ctx, *addr)
+	if err != nil {
+		log.Fatalf("serial server: %v", err)
+	}
+	logger := logging.For("serialserver")
+	logger.Info("serial server listening", "address", listening)
+	if *push != "" {
+		go server.Push(ctx, *push, *pushInterval)
+	}
+	if *pty {
+		device, err := server.ServePTY(ctx, *ptyInterval)
+		if err != nil {
+			log.Fatalf("serial server: %v", err)
+		}
+		logger.Info("writing frames to pty", "device", device)
+	}
+	<-ctx.Done()
+	logger.Info("serial server stopped")
+}
@@ -0,0 +1,393 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/replay"
+	"github.com/TitechMeister/Neon/source"
+)
+
+// 設定ファイルのパスを指定する環境変数
+const PathEnv = "NEON_CONFIG"
+
+// 既定の設定ファイルのパス
+const DefaultPath = "neon.json"
+
+// 既定の設定を返す
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Address:         ":8080",
+			ShutdownTimeout: Duration(10 * time.Second),
+		},
+		Upstream: UpstreamConfig{
+			URL:          "http://localhost:7878",
+			Retries:      2,
+			RetryBackoff: Duration(20 * time.Millisecond),
+			Breaker: BreakerConfig{
+				Threshold:   5,
+				Cooldown:    Duration(time.Second),
+				MaxCooldown: Duration(30 * time.Second),
+			},
+			BatchPath: "/data/batch",
+		},
+		Storage: StorageConfig{
+			Bucket:   "25_logs",
+			LogDir:   "logs",
+			UILogDir: "logs_ui",
+			TempDir:  ".",
+			Writer: WriterConfig{
+				BufferSize:    1024,
+				FlushInterval: Duration(time.Second),
+				Sync:          "flush",
+			},
+		},
+		Store: StoreConfig{
+			Dir:              "data",
+			SegmentDuration:  Duration(time.Hour),
+			Retention:        Duration(30 * 24 * time.Hour),
+			CompactSize:      64 << 20,
+			MaintainInterval: Duration(10 * time.Minute),
+		},
+		History: HistoryConfig{Limit: 20, Keep: 10},
+		Replay:  ReplayConfig{Path: "logs", Speed: 1},
+		Serial:  SerialConfig{Baud: 115200},
+		Log: LogConfig{
+			Level:      "info",
+			Format:     "text",
+			File:       "neon.log",
+			MaxSize:    10 << 20,
+			MaxBackups: 5,
+		},
+		Sensors: map[string]SensorConfig{
+			"altimeter":  {LogFrequency: 2},
+			"gps":        {LogFrequency: 1},
+			"pitot":      {LogFrequency: 2},
+			"tachometer": {LogFrequency: 1},
+			"servo":      {LogFrequency: 2},
+		},
+	}
+}
+
+// 設定ファイルを読み込み、環境変数で上書きして検証する
+// pathが空なら既定のパスを使い、既定のパスにファイルがなければ既定の設定を使う
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	explicit := path != ""
+	if !explicit {
+		path = DefaultPath
+	}
+
+	raw, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := cfg.decode(raw); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+		// 設定ファイルがなければ既定値のまま
+	default:
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// JSONを既定値の上に重ねてデコードする
+func (cfg *Config) decode(raw []byte) error {
+	known := cfg.Sensors
+	cfg.Sensors = map[string]SensorConfig{}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields() // 設定項目の打ち間違いを検出する
+	if err := dec.Decode(cfg); err != nil {
+		return err
+	}
+
+	// ファイルに書かれていないセンサーは既定値を使う
+	// 書かれているセンサーも0の項目は既定値で埋める
+	for name, sc := range cfg.Sensors {
+		def, ok := known[name]
+		if !ok {
+			return fmt.Errorf("unknown sensor %q", name)
+		}
+		if sc.LogFrequency == 0 {
+			sc.LogFrequency = def.LogFrequency
+		}
+		known[name] = sc
+	}
+	cfg.Sensors = known
+	return nil
+}
+
+// NEON_で始まる環境変数で設定を上書きする
+// e.g. NEON_SERVER_ADDRESS=:9090, NEON_GPS_LOG_FREQUENCY=5
+func (cfg *Config) applyEnv() error {
+	setString := func(key string, dst *string) {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = v
+		}
+	}
+	setInt := func(key string, dst *int) error {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*dst = n
+		return nil
+	}
+	setDuration := func(key string, dst *Duration) error {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*dst = Duration(d)
+		return nil
+	}
+	setFloat := func(key string, dst *float64) error {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*dst = f
+		return nil
+	}
+	setBool := func(key string, dst *bool) error {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*dst = b
+		return nil
+	}
+
+	setString("NEON_SERVER_ADDRESS", &cfg.Server.Address)
+	if err := setDuration("NEON_SERVER_SHUTDOWN_TIMEOUT", &cfg.Server.ShutdownTimeout); err != nil {
+		return err
+	}
+	if err := setBool("NEON_SERVER_FINALIZE_ON_SHUTDOWN", &cfg.Server.FinalizeOnShutdown); err != nil {
+		return err
+	}
+	setString("NEON_UPSTREAM_URL", &cfg.Upstream.URL)
+	if err := setDuration("NEON_UPSTREAM_TIMEOUT", &cfg.Upstream.Timeout); err != nil {
+		return err
+	}
+	if err := setInt("NEON_UPSTREAM_RETRIES", &cfg.Upstream.Retries); err != nil {
+		return err
+	}
+	if err := setDuration("NEON_UPSTREAM_RETRY_BACKOFF", &cfg.Upstream.RetryBackoff); err != nil {
+		return err
+	}
+	if err := setInt("NEON_UPSTREAM_BREAKER_THRESHOLD", &cfg.Upstream.Breaker.Threshold); err != nil {
+		return err
+	}
+	if err := setDuration("NEON_UPSTREAM_BREAKER_COOLDOWN", &cfg.Upstream.Breaker.Cooldown); err != nil {
+		return err
+	}
+	if err := setDuration("NEON_UPSTREAM_BREAKER_MAX_COOLDOWN", &cfg.Upstream.Breaker.MaxCooldown); err != nil {
+		return err
+	}
+	if err := setBool("NEON_UPSTREAM_BATCH", &cfg.Upstream.Batch); err != nil {
+		return err
+	}
+	setString("NEON_UPSTREAM_BATCH_PATH", &cfg.Upstream.BatchPath)
+	setString("NEON_STORAGE_BUCKET", &cfg.Storage.Bucket)
+	setString("NEON_STORAGE_LOG_DIR", &cfg.Storage.LogDir)
+	setString("NEON_STORAGE_UI_LOG_DIR", &cfg.Storage.UILogDir)
+	setString("NEON_STORAGE_TEMP_DIR", &cfg.Storage.TempDir)
+	if err := setInt("NEON_STORAGE_WRITER_BUFFER_SIZE", &cfg.Storage.Writer.BufferSize); err != nil {
+		return err
+	}
+	if err := setDuration("NEON_STORAGE_WRITER_FLUSH_INTERVAL", &cfg.Storage.Writer.FlushInterval); err != nil {
+		return err
+	}
+	setString("NEON_STORAGE_WRITER_SYNC", &cfg.Storage.Writer.Sync)
+	setString("NEON_STORE_DIR", &cfg.Store.Dir)
+	if err := setDuration("NEON_STORE_SEGMENT_DURATION", &cfg.Store.SegmentDuration); err != nil {
+		return err
+	}
+	if err := setDuration("NEON_STORE_RETENTION", &cfg.Store.Retention); err != nil {
+		return err
+	}
+	if err := setInt("NEON_STORE_COMPACT_SIZE", &cfg.Store.CompactSize); err != nil {
+		return err
+	}
+	if err := setDuration("NEON_STORE_MAINTAIN_INTERVAL", &cfg.Store.MaintainInterval); err != nil {
+		return err
+	}
+	if err := setInt("NEON_HISTORY_LIMIT", &cfg.History.Limit); err != nil {
+		return err
+	}
+	if err := setInt("NEON_HISTORY_KEEP", &cfg.History.Keep); err != nil {
+		return err
+	}
+	setString("NEON_LOG_LEVEL", &cfg.Log.Level)
+	setString("NEON_LOG_FORMAT", &cfg.Log.Format)
+	setString("NEON_LOG_FILE", &cfg.Log.File)
+	if err := setInt("NEON_LOG_MAX_SIZE", &cfg.Log.MaxSize); err != nil {
+		return err
+	}
+	if err := setInt("NEON_LOG_MAX_BACKUPS", &cfg.Log.MaxBackups); err != nil {
+		return err
+	}
+	setString("NEON_REPLAY_PATH", &cfg.Replay.Path)
+	if err := setFloat("NEON_REPLAY_SPEED", &cfg.Replay.Speed); err != nil {
+		return err
+	}
+	if err := setBool("NEON_REPLAY_LOOP", &cfg.Replay.Loop); err != nil {
+		return err
+	}
+	setString("NEON_INGEST_TCP_ADDRESS", &cfg.Ingest.TCPAddress)
+	setString("NEON_SERIAL_DEVICE", &cfg.Serial.Device)
+	if err := setInt("NEON_SERIAL_BAUD", &cfg.Serial.Baud); err != nil {
+		return err
+	}
+	for name, sc := range cfg.Sensors {
+		prefix := "NEON_" + strings.ToUpper(name) + "_"
+		if err := setInt(prefix+"LOG_FREQUENCY", &sc.LogFrequency); err != nil {
+			return err
+		}
+		setString(prefix+"UPSTREAM_PATH", &sc.UpstreamPath)
+		setString(prefix+"SOURCE", &sc.Source)
+		// これまで通りMODE=mockなら、指定のないセンサーはすべてモックにする
+		if sc.Source == "" {
+			sc.Source = source.KindHTTP
+			if os.Getenv("MODE") == "mock" {
+				sc.Source = source.KindMock
+			}
+		}
+		cfg.Sensors[name] = sc
+	}
+	return nil
+}
+
+// 設定値を検証し、問題をまとめて返す
+func (cfg *Config) Validate() error {
+	var errs []error
+	if cfg.Server.Address == "" {
+		errs = append(errs, errors.New("server.address must not be empty"))
+	}
+	if cfg.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("server.shutdown_timeout must be positive"))
+	}
+	if u, err := url.Parse(cfg.Upstream.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("upstream.url %q is not an absolute URL", cfg.Upstream.URL))
+	}
+	if cfg.Upstream.Timeout < 0 || cfg.Upstream.Retries < 0 || cfg.Upstream.RetryBackoff < 0 {
+		errs = append(errs, errors.New("upstream.timeout, upstream.retries and upstream.retry_backoff must not be negative"))
+	}
+	if b := cfg.Upstream.Breaker; b.Threshold <= 0 || b.Cooldown <= 0 || b.MaxCooldown < b.Cooldown {
+		errs = append(errs, errors.New("upstream.breaker.threshold and upstream.breaker.cooldown must be positive and max_cooldown must not be shorter than cooldown"))
+	}
+	if cfg.Upstream.Batch && !strings.HasPrefix(cfg.Upstream.BatchPath, "/") {
+		errs = append(errs, errors.New("upstream.batch_path must start with /"))
+	}
+	if cfg.Storage.Bucket == "" {
+		errs = append(errs, errors.New("storage.bucket must not be empty"))
+	}
+	if cfg.Storage.LogDir == "" || cfg.Storage.UILogDir == "" || cfg.Storage.TempDir == "" {
+		errs = append(errs, errors.New("storage directories must not be empty"))
+	}
+	if cfg.Storage.Writer.BufferSize <= 0 || cfg.Storage.Writer.FlushInterval <= 0 {
+		errs = append(errs, errors.New("storage.writer.buffer_size and storage.writer.flush_interval must be positive"))
+	}
+	switch cfg.Storage.Writer.Sync {
+	case "never", "flush", "always":
+	default:
+		errs = append(errs, fmt.Errorf("storage.writer.sync must be one of never, flush, always, got %q", cfg.Storage.Writer.Sync))
+	}
+	if cfg.Store.Dir == "" {
+		errs = append(errs, errors.New("store.dir must not be empty"))
+	}
+	if cfg.Store.SegmentDuration <= 0 || cfg.Store.MaintainInterval <= 0 {
+		errs = append(errs, errors.New("store.segment_duration and store.maintain_interval must be positive"))
+	}
+	if cfg.Store.Retention < 0 || cfg.Store.CompactSize < 0 {
+		errs = append(errs, errors.New("store.retention and store.compact_size must not be negative"))
+	}
+	if cfg.History.Keep <= 0 || cfg.History.Limit <= cfg.History.Keep {
+		errs = append(errs, fmt.Errorf("history.keep (%d) must be positive and smaller than history.limit (%d)", cfg.History.Keep, cfg.History.Limit))
+	}
+
+	if _, err := logging.ParseLevel(cfg.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	for name, level := range cfg.Log.Levels {
+		if _, err := logging.ParseLevel(level); err != nil {
+			errs = append(errs, fmt.Errorf("log.levels.%s: %w", name, err))
+		}
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format must be text or json, got %q", cfg.Log.Format))
+	}
+	if cfg.Log.MaxSize <= 0 || cfg.Log.MaxBackups < 0 {
+		errs = append(errs, errors.New("log.max_size must be positive and log.max_backups must not be negative"))
+	}
+
+	if cfg.Replay.Speed < replay.MinSpeed || cfg.Replay.Speed > replay.MaxSpeed {
+		errs = append(errs, fmt.Errorf("replay.speed must be between %v and %v, got %v", replay.MinSpeed, replay.MaxSpeed, cfg.Replay.Speed))
+	}
+
+	names := make([]string, 0, len(cfg.Sensors))
+	for name := range cfg.Sensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sc := cfg.Sensors[name]
+		if sc.LogFrequency <= 0 {
+			errs = append(errs, fmt.Errorf("sensors.%s.log_frequency must be positive, got %d", name, sc.LogFrequency))
+		}
+		if sc.UpstreamPath != "" && !strings.HasPrefix(sc.UpstreamPath, "/") {
+			errs = append(errs, fmt.Errorf("sensors.%s.upstream_path must start with /", name))
+		}
+		if !slices.Contains(source.Kinds, sc.Source) {
+			errs = append(errs, fmt.Errorf("sensors.%s.source must be one of %s, got %q", name, strings.Join(source.Kinds, ", "), sc.Source))
+		}
+		if sc.Faults != nil {
+			if err := sc.Faults.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("sensors.%s.faults: %w", name, err))
+			}
+		}
+		if sc.Source == source.KindReplay && cfg.Replay.Path == "" {
+			errs = append(errs, fmt.Errorf("sensors.%s.source is replay but replay.path is empty", name))
+		}
+		if sc.Source == source.KindSerial && (cfg.Serial.Device == "" || cfg.Serial.Baud <= 0) {
+			errs = append(errs, fmt.Errorf("sensors.%s.source is serial but serial.device is empty or serial.baud is not positive", name))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,151 @@
+package config
+
+import "github.com/TitechMeister/Neon/fault"
+
+// Neon全体の設定
+type Config struct {
+	// Echoサーバの設定
+	Server ServerConfig `json:"server"`
+	// serialサーバの設定
+	Upstream UpstreamConfig `json:"upstream"`
+	// ログファイルとアップロード先の設定
+	Storage StorageConfig `json:"storage"`
+	// 時系列ストアの設定
+	Store StoreConfig `json:"store"`
+	// メモリ上の履歴の設定
+	History HistoryConfig `json:"history"`
+	// ログ再生の設定(sourceが"replay"のセンサーで使う)
+	Replay ReplayConfig `json:"replay"`
+	// 押し込まれるデータの受け付けの設定(sourceが"push"のセンサーで使う)
+	Ingest IngestConfig `json:"ingest"`
+	// シリアルデバイスの設定(sourceが"serial"のセンサーで使う)
+	Serial SerialConfig `json:"serial"`
+	// センサーごとの設定(キーはセンサー名)
+	Sensors map[string]SensorConfig `json:"sensors"`
+	// Neon自身のログの設定
+	Log LogConfig `json:"log"`
+}
+
+type ServerConfig struct {
+	// 待ち受けアドレス e.g. ":8080"
+	Address string `json:"address"`
+	// 終了時にリクエストの処理を待つ時間
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// 終了時に各センサーのログを確定させるかどうか
+	FinalizeOnShutdown bool `json:"finalize_on_shutdown"`
+}
+
+type UpstreamConfig struct {
+	// serialサーバのベースURL e.g. "http://localhost:7878"
+	URL string `json:"url"`
+	// 1回の取得の時間制限(0ならセンサーの取得間隔)
+	Timeout Duration `json:"timeout"`
+	// 接続の失敗や5xxのときにやり直す回数と、やり直すまでの待ち時間
+	Retries      int      `json:"retries"`
+	RetryBackoff Duration `json:"retry_backoff"`
+	// serialサーバが落ちているときにリクエストを控える遮断器
+	Breaker BreakerConfig `json:"breaker"`
+	// trueなら取得する時刻が来たセンサーのデータをbatch_pathから1回のリクエストでまとめて取得する
+	Batch     bool   `json:"batch"`
+	BatchPath string `json:"batch_path"`
+}
+
+type BreakerConfig struct {
+	// 続けてこの回数失敗したら遮断する
+	Threshold int `json:"threshold"`
+	// 遮断してから様子見するまでの時間(様子見に失敗するたびに倍にする)
+	Cooldown Duration `json:"cooldown"`
+	// 様子見するまでの時間の上限
+	MaxCooldown Duration `json:"max_cooldown"`
+}
+
+type StorageConfig struct {
+	// Cloud Storageのバケット名
+	Bucket string `json:"bucket"`
+	// 確定したログの保存先
+	LogDir string `json:"log_dir"`
+	// 確定したUI用ログの保存先
+	UILogDir string `json:"ui_log_dir"`
+	// 一時ログファイルの保存先
+	TempDir string `json:"temp_dir"`
+	// 一時ログファイルの書き込み方針
+	Writer WriterConfig `json:"writer"`
+}
+
+type WriterConfig struct {
+	// 書き込み待ちにできるレコード数
+	BufferSize int `json:"buffer_size"`
+	// バッファをファイルに書き出す間隔
+	FlushInterval Duration `json:"flush_interval"`
+	// fsyncのタイミング "never", "flush", "always"
+	Sync string `json:"sync"`
+}
+
+type StoreConfig struct {
+	// 時系列ストアの保存先
+	Dir string `json:"dir"`
+	// 1つのセグメントに書く期間
+	SegmentDuration Duration `json:"segment_duration"`
+	// これより古いデータは削除する("0s"なら削除しない)
+	Retention Duration `json:"retention"`
+	// 書き込みが終わったセグメントをこのバイト数までまとめる(0ならまとめない)
+	CompactSize int `json:"compact_size"`
+	// 古いデータの削除とまとめを行う間隔
+	MaintainInterval Duration `json:"maintain_interval"`
+}
+
+type HistoryConfig struct {
+	// 履歴がこの件数を超えたら一時ログファイルに書き出す
+	Limit int `json:"limit"`
+	// 書き出した後にメモリ上に残す件数
+	Keep int `json:"keep"`
+}
+
+type ReplayConfig struct {
+	// 再生するログの場所
+	// セッションのディレクトリ(logs/<セッションID>)、バンドルのzip、確定したログのディレクトリ(logs)
+	Path string `json:"path"`
+	// 再生速度(replay.MinSpeedからreplay.MaxSpeed)
+	Speed float64 `json:"speed"`
+	// 最後まで再生したら先頭に戻るかどうか
+	Loop bool `json:"loop"`
+}
+
+type IngestConfig struct {
+	// NDJSONを受け付けるTCPの待ち受けアドレス e.g. ":7879"(空ならHTTPのPOSTだけで受け付ける)
+	TCPAddress string `json:"tcp_address"`
+}
+
+type SerialConfig struct {
+	// デバイスのパス e.g. "/dev/ttyUSB0"
+	Device string `json:"device"`
+	// ボーレート
+	Baud int `json:"baud"`
+}
+
+type LogConfig struct {
+	// 既定のログレベル "debug", "info", "warn", "error"
+	Level string `json:"level"`
+	// サブシステムごとのログレベル(キーはサブシステム名 e.g. "sensor")
+	Levels map[string]string `json:"levels,omitempty"`
+	// 標準エラー出力の形式 "text", "json"
+	Format string `json:"format"`
+	// ログファイルのパス(空ならファイルに書かない)
+	File string `json:"file"`
+	// ログファイルがこのバイト数を超えたら切り替える
+	MaxSize int `json:"max_size"`
+	// 切り替えた古いログファイルを残す数
+	MaxBackups int `json:"max_backups"`
+}
+
+type SensorConfig struct {
+	// serialサーバを叩く頻度(周波数)
+	LogFrequency int `json:"log_frequency"`
+	// serialサーバ上のパス(空ならセンサーの既定値)
+	UpstreamPath string `json:"upstream_path,omitempty"`
+	// データ源の種類 "http", "mock", "replay"
+	// 空ならMODE=mockのときは"mock"、それ以外は"http"
+	Source string `json:"source,omitempty"`
+	// 起動時から起こす故障(試験用)
+	Faults *fault.Profile `json:"faults,omitempty"`
+}
@@ -0,0 +1,276 @@
+package fault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/TitechMeister/Neon/source"
+	"github.com/TitechMeister/Neon/upstream"
+)
+
+// 故障で起こすserialサーバのエラー
+// 本物の500と同じ型なので、やり直しや遮断器、失敗の種類も同じように扱われる
+var ErrInjected = &upstream.StatusError{Code: http.StatusInternalServerError, Body: "injected fault"}
+
+// よく使う故障の組み合わせ
+var Presets = map[string]Profile{
+	// 無線が時々途切れる
+	"flaky_link": {Dropout: 0.1, Burst: 0.02, BurstLength: 5, Slow: 0.05, SlowMS: 800},
+	// 無線がだんだん届かなくなる
+	"dying_link": {Dropout: 0.4, Burst: 0.1, BurstLength: 20, HTTPError: 0.1, Slow: 0.2, SlowMS: 2000},
+	// センサーが壊れかけている
+	"failing_sensor": {Stuck: 0.05, StuckLength: 20, Spike: 0.05, SpikeScale: 10, NaN: 0.05},
+	// デバイスの時計が飛ぶ
+	"clock_jump": {ClockJump: 0.02, ClockJumpMS: 60000},
+}
+
+// 確率や長さが範囲内か確かめる
+func (p Profile) Validate() error {
+	var errs []error
+	for name, v := range map[string]float64{
+		"dropout": p.Dropout, "burst": p.Burst, "stuck": p.Stuck, "spike": p.Spike,
+		"nan": p.NaN, "clock_jump": p.ClockJump, "http_error": p.HTTPError, "slow": p.Slow,
+	} {
+		if v < 0 || v > 1 {
+			errs = append(errs, fmt.Errorf("%s must be between 0 and 1, got %v", name, v))
+		}
+	}
+	if p.BurstLength < 0 || p.StuckLength < 0 || p.SpikeScale < 0 || p.SlowMS < 0 {
+		errs = append(errs, errors.New("burst_length, stuck_length, spike_scale and slow_ms must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// 故障を何も起こさないかどうか
+func (p Profile) IsZero() bool {
+	return p == Profile{}
+}
+
+// 長さや大きさが指定されていなければ既定値にする
+func (p Profile) withDefaults() Profile {
+	if p.BurstLength == 0 {
+		p.BurstLength = 10
+	}
+	if p.StuckLength == 0 {
+		p.StuckLength = 20
+	}
+	if p.SpikeScale == 0 {
+		p.SpikeScale = 10
+	}
+	if p.ClockJumpMS == 0 {
+		p.ClockJumpMS = 60000
+	}
+	if p.SlowMS == 0 {
+		p.SlowMS = 2000
+	}
+	return p
+}
+
+// 故障を起こさないInjectorを返す
+func NewInjector() *Injector {
+	return &Injector{}
+}
+
+func (in *Injector) Profile() Profile {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.profile
+}
+
+// 故障の起こし方を変える
+// 途中の連続した欠落や固まった値、飛んだ時計も元に戻す
+func (in *Injector) SetProfile(p Profile) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.profile = p
+	in.burstLeft, in.stuckLeft, in.stuck, in.clockOffset = 0, 0, nil, 0
+	return nil
+}
+
+// データを取りに行く前に起こす故障(遅延とserialサーバのエラー)を決める
+func (in *Injector) before() (time.Duration, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.profile.IsZero() {
+		return 0, nil
+	}
+	p := in.profile.withDefaults()
+	var delay time.Duration
+	if rand.Float64() < p.Slow {
+		delay = time.Duration(p.SlowMS) * time.Millisecond
+	}
+	if rand.Float64() < p.HTTPError {
+		return delay, ErrInjected
+	}
+	return delay, nil
+}
+
+// 遅れてからserialサーバのエラーを起こす
+// ctxが終われば待つのをやめてctxのエラーを返す
+func (in *Injector) inject(ctx context.Context) error {
+	delay, err := in.before()
+	if err := sleep(ctx, delay); err != nil {
+		return err
+	}
+	return err
+}
+
+// serialサーバを通さないデータ源で起こしたエラーを、serialサーバへのリクエストの失敗にする
+func injected(err error) error {
+	var status *upstream.StatusError
+	if !errors.As(err, &status) {
+		return err
+	}
+	return &upstream.Error{Kind: upstream.KindStatus, Method: http.MethodGet, Path: "(injected)", Attempts: 1, Err: err}
+}
+
+// 受け取ったデータに故障を起こす
+// データを落とすならfalseを返す
+// unitはデバイスの時計の1カウントの長さ
+func apply[T any](in *Injector, data *T, unit time.Duration) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.profile.IsZero() {
+		return true
+	}
+	p := in.profile.withDefaults()
+
+	// 欠落
+	if in.burstLeft > 0 {
+		in.burstLeft--
+		return false
+	}
+	if rand.Float64() < p.Burst {
+		in.burstLeft = p.BurstLength - 1
+		return false
+	}
+	if rand.Float64() < p.Dropout {
+		return false
+	}
+
+	// 固まった値
+	if in.stuckLeft > 0 {
+		if stuck, ok := in.stuck.(T); ok {
+			in.stuckLeft--
+			*data = stuck
+			return true
+		}
+	}
+	if rand.Float64() < p.Stuck {
+		in.stuck = *data
+		in.stuckLeft = p.StuckLength - 1
+		return true
+	}
+
+	// 値の異常と時計の飛び
+	if rand.Float64() < p.ClockJump {
+		in.clockOffset += p.ClockJumpMS
+	}
+	if in.clockOffset != 0 {
+		shiftClock(data, time.Duration(in.clockOffset)*time.Millisecond, unit)
+	}
+	if rand.Float64() < p.Spike {
+		spike(data, p.SpikeScale)
+	}
+	if rand.Float64() < p.NaN {
+		setNaN(data)
+	}
+	return true
+}
+
+// srcに故障を起こすデータ源を返す
+// 周期的に取得するデータ源なら取得ごとに、それ以外は受け取ったデータごとに故障を起こす
+// 時計が飛ぶ量はspecの単位に直してデバイスの時計のフィールドに足す
+func Wrap[T any](src source.Source[T], in *Injector, spec clock.Spec) source.Source[T] {
+	if fetcher, interval, ok := source.PollerOf(src); ok {
+		return source.Poll[T](&faultyFetcher[T]{fetcher: fetcher, injector: in, unit: spec.Unit}, interval)
+	}
+	return &faultySource[T]{source: src, injector: in, unit: spec.Unit}
+}
+
+type faultyFetcher[T any] struct {
+	fetcher  source.Fetcher[T]
+	injector *Injector
+	// デバイスの時計の1カウントの長さ
+	unit time.Duration
+}
+
+// serialサーバから取得するなら、遅延とエラーはリクエストの時間制限の中で起こす
+// 時間切れや500は本物と同じようにやり直され、遮断器に記録される
+func (f *faultyFetcher[T]) Fetch(ctx context.Context) (T, error) {
+	var zero T
+	requested := false
+	data, err := f.fetcher.Fetch(upstream.WithFault(ctx, func(ctx context.Context) error {
+		requested = true
+		return f.injector.inject(ctx)
+	}))
+	if err == nil && !requested {
+		// serialサーバにリクエストしないFetcherなら取得の後に起こす
+		err = injected(f.injector.inject(ctx))
+	}
+	if err != nil {
+		return zero, err
+	}
+	if !apply(f.injector, &data, f.unit) {
+		return zero, source.ErrSkip
+	}
+	return data, nil
+}
+
+type faultySource[T any] struct {
+	source   source.Source[T]
+	injector *Injector
+	unit     time.Duration
+}
+
+func (s *faultySource[T]) Run(ctx context.Context, sink source.Sink[T]) error {
+	return s.source.Run(ctx, &faultySink[T]{ctx: ctx, sink: sink, injector: s.injector, unit: s.unit})
+}
+
+type faultySink[T any] struct {
+	ctx      context.Context
+	sink     source.Sink[T]
+	injector *Injector
+	unit     time.Duration
+}
+
+func (s *faultySink[T]) Emit(data T) {
+	delay, err := s.injector.before()
+	if sleep(s.ctx, delay) != nil {
+		return
+	}
+	if err != nil {
+		s.sink.Fail(injected(err))
+		return
+	}
+	if apply(s.injector, &data, s.unit) {
+		s.sink.Emit(data)
+	}
+}
+
+func (s *faultySink[T]) Fail(err error) {
+	s.sink.Fail(err)
+}
+
+// ctxがキャンセルされなければdだけ待つ
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,126 @@
+package fault
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/TitechMeister/Neon/source"
+	"github.com/TitechMeister/Neon/upstream"
+)
+
+// 高度計のようなミリ秒カウンタのデータ
+type msData struct {
+	Timestamp    int32 `json:"timestamp"`
+	ReceivedTime int64 `json:"received_time"`
+}
+
+// GPSのようなUnix秒のデータ
+type secondsData struct {
+	Unixtime     uint32 `json:"unixtime"`
+	ReceivedTime uint64 `json:"received_time"`
+}
+
+// 時計を必ず飛ばすデータ源から1件取得する
+func fetchJumped[T any](t *testing.T, data T, spec clock.Spec) T {
+	t.Helper()
+	in := NewInjector()
+	if err := in.SetProfile(Profile{ClockJump: 1, ClockJumpMS: 60000}); err != nil {
+		t.Fatal(err)
+	}
+	src := Wrap(source.Poll(source.Mock(func() T { return data }), time.Second), in, spec)
+	fetcher, _, ok := source.PollerOf(src)
+	if !ok {
+		t.Fatal("wrapped source does not poll")
+	}
+	got, err := fetcher.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// 時計が飛ぶ量はセンサーの時計の単位に直し、serialサーバの受信時刻は変えない
+func TestClockJumpUsesDeviceClockUnit(t *testing.T) {
+	ms := fetchJumped(t, msData{Timestamp: 1000, ReceivedTime: 5000}, clock.Spec{Unit: time.Millisecond, Period: 1 << 32})
+	if ms.Timestamp != 61000 || ms.ReceivedTime != 5000 {
+		t.Errorf("millisecond sensor = %+v, want timestamp 61000 and received_time 5000", ms)
+	}
+	sec := fetchJumped(t, secondsData{Unixtime: 1000, ReceivedTime: 5000}, clock.Spec{Unit: time.Second, Period: 1 << 32})
+	if sec.Unixtime != 1060 || sec.ReceivedTime != 5000 {
+		t.Errorf("seconds sensor = %+v, want unixtime 1060 and received_time 5000", sec)
+	}
+}
+
+// serialサーバから取得するFetcherに、必ず起こす故障を付けて返す
+// 1回失敗すると遮断する
+func upstreamFetcher(t *testing.T, p Profile) (source.Fetcher[msData], *upstream.Client, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"timestamp":1,"received_time":2}`))
+	}))
+	t.Cleanup(server.Close)
+	client := upstream.New(server.URL, upstream.Options{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	in := NewInjector()
+	if err := in.SetProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	src := Wrap(source.Poll[msData](&source.HTTP[msData]{Client: client, Path: "/data/test", Timeout: 50 * time.Millisecond}, time.Second), in, clock.Spec{})
+	fetcher, _, ok := source.PollerOf(src)
+	if !ok {
+		t.Fatal("wrapped source does not poll")
+	}
+	return fetcher, client, &requests
+}
+
+// 遅延はリクエストの時間制限の中で起こるので、時間切れになって遮断器に記録される
+func TestSlowTimesOut(t *testing.T) {
+	fetcher, client, _ := upstreamFetcher(t, Profile{Slow: 1, SlowMS: 10000})
+	start := time.Now()
+	_, err := fetcher.Fetch(context.Background())
+	if kind, _ := upstream.KindOf(err); kind != upstream.KindTimeout {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fetch took %v, want it cut off by the 50ms timeout", elapsed)
+	}
+	if state := client.Status().State; state != upstream.StateOpen {
+		t.Errorf("breaker is %s, want open", state)
+	}
+}
+
+// 起こしたエラーは本物の500と同じく失敗の種類が"status"になり、遮断器に記録される
+func TestHTTPErrorIsStatus(t *testing.T) {
+	fetcher, client, requests := upstreamFetcher(t, Profile{HTTPError: 1})
+	_, err := fetcher.Fetch(context.Background())
+	if kind, _ := upstream.KindOf(err); kind != upstream.KindStatus || !errors.Is(err, ErrInjected) {
+		t.Fatalf("err = %v, want the injected status error", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("serial server got %d requests, want none", n)
+	}
+	if state := client.Status().State; state != upstream.StateOpen {
+		t.Errorf("breaker is %s, want open", state)
+	}
+}
+
+// serialサーバを通さないデータ源で起こしたエラーも失敗の種類が"status"になる
+func TestHTTPErrorWithoutUpstream(t *testing.T) {
+	in := NewInjector()
+	if err := in.SetProfile(Profile{HTTPError: 1}); err != nil {
+		t.Fatal(err)
+	}
+	src := Wrap(source.Poll(source.Mock(func() msData { return msData{} }), time.Second), in, clock.Spec{})
+	fetcher, _, _ := source.PollerOf(src)
+	_, err := fetcher.Fetch(context.Background())
+	if kind, _ := upstream.KindOf(err); kind != upstream.KindStatus {
+		t.Fatalf("err = %v, want a status error", err)
+	}
+}
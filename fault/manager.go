@@ -0,0 +1,93 @@
+package fault
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo"
+)
+
+// 新しい管理の構造体を返す
+func NewManager() *Manager {
+	return &Manager{injectors: map[string]*Injector{}}
+}
+
+// センサーのInjectorを返す(なければ作る)
+func (m *Manager) Injector(sensor string) *Injector {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	in, ok := m.injectors[sensor]
+	if !ok {
+		in = NewInjector()
+		m.injectors[sensor] = in
+	}
+	return in
+}
+
+func (m *Manager) lookup(sensor string) (*Injector, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	in, ok := m.injectors[sensor]
+	return in, ok
+}
+
+// 故障のルーティングを設定する
+func (m *Manager) RegisterRoutes(e *echo.Echo) {
+	e.GET("/faults", m.GetFaults)
+	e.GET("/faults/presets", m.GetPresets)
+	e.PUT("/faults/:sensor", m.PutFault)
+	e.DELETE("/faults/:sensor", m.DeleteFault)
+}
+
+// センサーごとの故障の起こし方を返す
+func (m *Manager) GetFaults(c echo.Context) error {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.injectors))
+	for name := range m.injectors {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+	res := map[string]Profile{}
+	for _, name := range names {
+		in, _ := m.lookup(name)
+		res[name] = in.Profile()
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (m *Manager) GetPresets(c echo.Context) error {
+	return c.JSON(http.StatusOK, Presets)
+}
+
+// センサーの故障の起こし方を変える
+// ?preset=<名前> ならよく使う組み合わせを、なければボディのJSONを使う
+func (m *Manager) PutFault(c echo.Context) error {
+	in, ok := m.lookup(c.Param("sensor"))
+	if !ok {
+		return c.String(http.StatusNotFound, fmt.Sprintf("Unknown sensor %s", c.Param("sensor")))
+	}
+	var p Profile
+	if name := c.QueryParam("preset"); name != "" {
+		if p, ok = Presets[name]; !ok {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Unknown preset %s", name))
+		}
+	} else if err := c.Bind(&p); err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Error binding fault profile: %v", err))
+	}
+	if err := in.SetProfile(p); err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid fault profile: %v", err))
+	}
+	return c.JSON(http.StatusOK, in.Profile())
+}
+
+// センサーの故障を止める
+func (m *Manager) DeleteFault(c echo.Context) error {
+	in, ok := m.lookup(c.Param("sensor"))
+	if !ok {
+		return c.String(http.StatusNotFound, fmt.Sprintf("Unknown sensor %s", c.Param("sensor")))
+	}
+	in.SetProfile(Profile{})
+	return c.JSON(http.StatusOK, in.Profile())
+}
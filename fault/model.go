@@ -0,0 +1,52 @@
+package fault
+
+import (
+	"sync"
+)
+
+// 1センサー分の故障の起こし方
+// 確率はどれもデータ1件(serialサーバへの1リクエスト)ごと
+type Profile struct {
+	// データを落とす確率
+	Dropout float64 `json:"dropout,omitempty"`
+	// 連続してデータを落とし始める確率と、落とす件数
+	Burst       float64 `json:"burst,omitempty"`
+	BurstLength int     `json:"burst_length,omitempty"`
+	// 値が固まり始める確率と、同じデータを返し続ける件数
+	Stuck       float64 `json:"stuck,omitempty"`
+	StuckLength int     `json:"stuck_length,omitempty"`
+	// 数値の1つが跳ねる確率と、跳ねる大きさ(元の値に対する倍率)
+	Spike      float64 `json:"spike,omitempty"`
+	SpikeScale float64 `json:"spike_scale,omitempty"`
+	// 小数の値の1つがNaNになる確率
+	NaN float64 `json:"nan,omitempty"`
+	// デバイスの時計が飛ぶ確率と、飛ぶ量(ミリ秒、負なら戻る)
+	// 飛んだ時計は元に戻らない
+	ClockJump   float64 `json:"clock_jump,omitempty"`
+	ClockJumpMS int64   `json:"clock_jump_ms,omitempty"`
+	// serialサーバが500を返す確率
+	HTTPError float64 `json:"http_error,omitempty"`
+	// 応答が遅れる確率と、遅れる時間(ミリ秒)
+	Slow   float64 `json:"slow,omitempty"`
+	SlowMS int64   `json:"slow_ms,omitempty"`
+}
+
+// 1センサー分の故障を起こす
+// 連続して落とす残りの件数や固まった値などの状態を持つ
+type Injector struct {
+	mu      sync.Mutex
+	profile Profile
+	// 連続して落とす残りの件数
+	burstLeft int
+	// 固まった値と、それを返す残りの件数
+	stuck     any
+	stuckLeft int
+	// これまでに飛んだ時計の量(ミリ秒)
+	clockOffset int64
+}
+
+// センサーごとの故障をまとめて管理する
+type Manager struct {
+	mu        sync.Mutex
+	injectors map[string]*Injector
+}
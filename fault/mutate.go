@@ -0,0 +1,107 @@
+package fault
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// 時刻を表すフィールドのJSONの名前(跳ねさせない)
+var timeFields = map[string]bool{
+	"timestamp":     true,
+	"unixtime":      true,
+	"received_time": true, // serialサーバの受信時刻
+	"iTow":          true,
+}
+
+// デバイスの時計のフィールドのJSONの名前
+// 値の単位はセンサーごとの時計の仕様(clock.Spec)に従う
+var deviceClockFields = map[string]bool{
+	"timestamp": true,
+	"unixtime":  true,
+}
+
+// デバイスの時計のフィールドをoffsetだけずらす
+// unitはデバイスの時計の1カウントの長さ
+func shiftClock(data any, offset, unit time.Duration) {
+	if unit <= 0 {
+		unit = time.Millisecond
+	}
+	delta := int64(offset / unit)
+	forEachField(data, func(name string, v reflect.Value) {
+		if !deviceClockFields[name] {
+			return
+		}
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetInt(v.Int() + delta)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v.SetUint(v.Uint() + uint64(delta))
+		}
+	})
+}
+
+// 時刻とID以外の数値を1つ選んで跳ねさせる
+func spike(data any, scale float64) {
+	fields := []reflect.Value{}
+	forEachField(data, func(name string, v reflect.Value) {
+		if timeFields[name] || name == "id" {
+			return
+		}
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fields = append(fields, v)
+		}
+	})
+	if len(fields) == 0 {
+		return
+	}
+	v := fields[rand.Intn(len(fields))]
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(v.Float() + math.Copysign(scale*math.Max(math.Abs(v.Float()), 1), rand.Float64()-0.5))
+	// 整数は緯度経度のような大きな値なので、既定の倍率で1割だけずらす
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(v.Int() + int64(float64(v.Int())*scale/100))
+	default:
+		v.SetUint(v.Uint() + uint64(float64(v.Uint())*scale/100))
+	}
+}
+
+// 小数の値を1つ選んでNaNにする
+func setNaN(data any) {
+	fields := []reflect.Value{}
+	forEachField(data, func(_ string, v reflect.Value) {
+		if v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 {
+			fields = append(fields, v)
+		}
+	})
+	if len(fields) == 0 {
+		return
+	}
+	fields[rand.Intn(len(fields))].SetFloat(math.NaN())
+}
+
+// 構造体へのポインタのフィールドを、JSONの名前と一緒にfnに渡す
+func forEachField(data any, fn func(name string, v reflect.Value)) {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	v = v.Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		fn(name, v.Field(i))
+	}
+}
@@ -0,0 +1,164 @@
+package flight
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TitechMeister/Neon/cloudstorage"
+	"github.com/TitechMeister/Neon/session"
+	"github.com/labstack/echo"
+)
+
+func New(sessions *session.Manager, bucket string) *Flight {
+	return &Flight{sessions: sessions, bucket: bucket}
+}
+
+// フライトのルーティングを設定する
+func (f *Flight) RegisterRoutes(e *echo.Echo) {
+	e.POST("/flight/end", f.PostEnd)
+	e.POST("/flight/:id/upload", f.PostUpload)
+}
+
+// 全センサーのログをまとめて確定し、1つのzipにしてアップロードする
+// ボディにセッションのメタデータを渡すと、記録中のセッションがないときに使う
+func (f *Flight) PostEnd(c echo.Context) error {
+	var meta session.Metadata
+	if c.Request().ContentLength > 0 {
+		if err := c.Bind(&meta); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error binding session metadata: %v", err))
+		}
+	}
+	s, err := f.sessions.End(meta)
+	if errors.Is(err, session.ErrEmpty) {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error finalizing flight logs: %v", err))
+	}
+	bundle := s.Dir + ".zip"
+	if err := WriteBundle(bundle, s); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating flight bundle: %v (retry with POST /flight/%s/upload)", err, s.ID))
+	}
+	return f.upload(c, s, bundle)
+}
+
+// 保存済みのセッションのバンドルをアップロードし直す
+// /flight/end でアップロードに失敗したときに使う。バンドルがなければ作り直す
+func (f *Flight) PostUpload(c echo.Context) error {
+	s, err := f.sessions.Get(c.Param("id"))
+	if errors.Is(err, session.ErrNotFound) {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error reading session: %v", err))
+	}
+	bundle := s.Dir + ".zip"
+	if _, err := os.Stat(bundle); errors.Is(err, os.ErrNotExist) {
+		if err := WriteBundle(bundle, s); err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating flight bundle: %v", err))
+		}
+	}
+	return f.upload(c, s, bundle)
+}
+
+// バンドルをアップロードしてDLリンクを返す
+// 失敗してもバンドルは残すので、PostUploadでアップロードし直せる
+func (f *Flight) upload(c echo.Context, s *session.Session, bundle string) error {
+	url, err := cloudstorage.UploadFile(c.Response().Writer, f.bucket, bundle)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error uploading flight bundle %s: %v (retry with POST /flight/%s/upload)", bundle, err, s.ID))
+	}
+	// データのDLリンクを返す
+	return c.JSON(http.StatusOK, &DLlink{
+		DownloadLink: *url,
+		Timestamp:    time.Now(),
+		Session:      s,
+		Bundle:       bundle,
+	})
+}
+
+// セッションのログとマニフェストを1つのzipに書き出す
+// 一時ファイルに書いてから名前を変えるので、途中で失敗しても壊れたzipは残らない
+func WriteBundle(path string, s *session.Session) error {
+	tmp := path + ".tmp"
+	if err := writeBundle(tmp, s); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move bundle into %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeBundle(path string, s *session.Session) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	manifest := Manifest{Session: *s, CreatedAt: time.Now(), Files: []ManifestFile{}}
+	// セッションのメタデータも一緒に入れる
+	files := append([]string{filepath.Join(s.Dir, "session.json")}, s.Files...)
+	for _, name := range files {
+		mf, err := addFile(zw, s.ID, name)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, mf)
+	}
+
+	json_, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: s.ID + "/manifest.json", Method: zip.Deflate, Modified: manifest.CreatedAt})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(json_); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return out.Close()
+}
+
+// zipにファイルを追加し、マニフェスト用の情報を返す
+func addFile(zw *zip.Writer, prefix, name string) (ManifestFile, error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	mf := ManifestFile{Name: prefix + "/" + filepath.Base(name)}
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: mf.Name, Method: zip.Deflate, Modified: fi.ModTime()})
+	if err != nil {
+		return mf, err
+	}
+	h := sha256.New()
+	mf.Size, err = io.Copy(io.MultiWriter(w, h), in)
+	if err != nil {
+		return mf, fmt.Errorf("failed to add %s: %w", name, err)
+	}
+	mf.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return mf, nil
+}
@@ -0,0 +1,44 @@
+package flight
+
+import (
+	"time"
+
+	"github.com/TitechMeister/Neon/session"
+)
+
+// バンドルに同梱するマニフェスト
+type Manifest struct {
+	// フライトのセッション
+	Session session.Session `json:"session"`
+	// バンドルを作った時刻
+	CreatedAt time.Time `json:"created_at"`
+	// 同梱したファイル
+	Files []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	// バンドル内のパス
+	Name string `json:"name"`
+	// ファイルサイズ
+	Size int64 `json:"size"`
+	// SHA-256(16進数)
+	SHA256 string `json:"sha256"`
+}
+
+// フライト終了時のレスポンス
+type DLlink struct {
+	// Download link for the flight bundle
+	DownloadLink string `json:"download_link"`
+	// Timestamp of the download link creation
+	Timestamp time.Time `json:"timestamp"`
+	// 確定したセッション
+	Session *session.Session `json:"session"`
+	// ローカルに保存したバンドルのパス
+	Bundle string `json:"bundle"`
+}
+
+// フライトの終了とログのアップロードを行う
+type Flight struct {
+	sessions *session.Manager
+	bucket   string
+}
@@ -0,0 +1,182 @@
+package frame
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// 既定の格子の範囲と間隔
+	defaultSpan = time.Minute
+	defaultStep = 100 * time.Millisecond
+	// 既定の使うデータの古さの上限
+	defaultMaxAge = 5 * time.Second
+	// 1回に返すフレームの最大数
+	maxFrames = 10000
+)
+
+func New(targets []Target) *Handler {
+	return &Handler{targets: targets}
+}
+
+func (h *Handler) RegisterRoutes(e *echo.Echo) {
+	e.GET("/data", h.GetLatest)
+	e.GET("/data/frames", h.GetFrames)
+}
+
+// 全センサーの最新のデータを同じ時刻から見た古さと一緒に返す
+func (h *Handler) GetLatest(c echo.Context) error {
+	now := time.Now()
+	res := Latest{ServerTime: now.UnixMilli(), Sensors: map[string]*LatestSample{}}
+	for _, target := range h.targets {
+		point, ok := target.LatestPoint()
+		if !ok {
+			res.Sensors[target.GetSencorName()] = nil
+			continue
+		}
+		res.Sensors[target.GetSencorName()] = &LatestSample{
+			Time:       point.Time.UnixMilli(),
+			AgeMS:      now.Sub(point.Time).Milliseconds(),
+			Data:       point.Data,
+			Timestamps: point.Clock,
+		}
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// 全センサーのデータを共通の時刻の格子に並べ直して返す
+// 各格子点ではその時刻までに受け取った最新のデータ(max_ageより古ければnull)を使う
+//   - from, to: Unixミリ秒かRFC3339 (省略時は直近1分)
+//   - step: 格子の間隔 (ミリ秒か "500ms" のような時間、既定100ms)
+//   - max_age: 使うデータの古さの上限 (既定5s)
+//   - sensors: カンマ区切りのセンサー名 (省略時はすべて)
+func (h *Handler) GetFrames(c echo.Context) error {
+	to := time.Now()
+	from := to.Add(-defaultSpan)
+	step, maxAge := defaultStep, defaultMaxAge
+	var err error
+	if v := c.QueryParam("to"); v != "" {
+		if to, err = parseTime(v); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid to: %v", err))
+		}
+		from = to.Add(-defaultSpan)
+	}
+	if v := c.QueryParam("from"); v != "" {
+		if from, err = parseTime(v); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid from: %v", err))
+		}
+	}
+	if to.Before(from) {
+		return c.String(http.StatusBadRequest, "to must not be before from")
+	}
+	if v := c.QueryParam("step"); v != "" {
+		if step, err = parseDuration(v); err != nil || step <= 0 {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid step: %q", v))
+		}
+	}
+	if v := c.QueryParam("max_age"); v != "" {
+		if maxAge, err = parseDuration(v); err != nil || maxAge < 0 {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid max_age: %q", v))
+		}
+	}
+	if n := to.Sub(from) / step; n >= maxFrames {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Too many frames (%d), use a larger step or a shorter range (max %d)", n+1, maxFrames))
+	}
+	targets, err := h.selectTargets(c.QueryParam("sensors"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	res := Frames{
+		From:    from.UnixMilli(),
+		To:      to.UnixMilli(),
+		Step:    step.Milliseconds(),
+		MaxAge:  maxAge.Milliseconds(),
+		Sensors: []string{},
+		Frames:  []Frame{},
+	}
+	for t := from; !t.After(to); t = t.Add(step) {
+		res.Frames = append(res.Frames, Frame{Time: t.UnixMilli(), Data: map[string]any{}, AgeMS: map[string]*int64{}})
+	}
+	for _, target := range targets {
+		name := target.GetSencorName()
+		res.Sensors = append(res.Sensors, name)
+		// 範囲の最初の格子点より前のデータも使えるように、max_age分前から読む
+		points, err := target.Points(from.Add(-maxAge), to)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error reading %s data: %v", name, err))
+		}
+		resample(res.Frames, name, points, maxAge)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// 古い順に並んだpointsを各フレームの時刻に合わせて入れる
+func resample(frames []Frame, name string, points []Point, maxAge time.Duration) {
+	i := -1
+	for f := range frames {
+		t := time.UnixMilli(frames[f].Time)
+		// t以前の最新のデータまで進める
+		for i+1 < len(points) && !points[i+1].Time.After(t) {
+			i++
+		}
+		if i < 0 || t.Sub(points[i].Time) > maxAge {
+			frames[f].Data[name] = nil
+			frames[f].AgeMS[name] = nil
+			continue
+		}
+		age := t.Sub(points[i].Time).Milliseconds()
+		frames[f].Data[name] = points[i].Data
+		frames[f].AgeMS[name] = &age
+	}
+}
+
+// カンマ区切りのセンサー名から対象のセンサーを選ぶ
+func (h *Handler) selectTargets(v string) ([]Target, error) {
+	if v == "" {
+		return h.targets, nil
+	}
+	byName := map[string]Target{}
+	known := []string{}
+	for _, target := range h.targets {
+		byName[target.GetSencorName()] = target
+		known = append(known, target.GetSencorName())
+	}
+	sort.Strings(known)
+	targets := []Target{}
+	for _, name := range strings.Split(v, ",") {
+		target, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown sensor %q (one of %s)", name, strings.Join(known, ", "))
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// Unixミリ秒かRFC3339の時刻を読む
+func parseTime(v string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// ミリ秒か "500ms" のような時間を読む
+func parseDuration(v string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.New("must be milliseconds or a duration like 500ms")
+	}
+	return d, nil
+}
@@ -0,0 +1,71 @@
+package frame
+
+import (
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+)
+
+// 受信時刻付きのUI用データ
+type Point struct {
+	// Neonがデータを受け取った時刻
+	Time time.Time
+	// UI用に整形したデータ
+	Data any
+	// デバイス・serialサーバ・Neonの時刻
+	Clock clock.Timestamps
+}
+
+// 1フレームにまとめるセンサー
+type Target interface {
+	// センサーの名前を取得する
+	GetSencorName() string
+	// 最新のデータを返す(まだなければfalse)
+	LatestPoint() (Point, bool)
+	// 受信時刻がfrom以上to以下のデータを古い順に返す
+	Points(from, to time.Time) ([]Point, error)
+}
+
+// GET /data のレスポンス
+type Latest struct {
+	// レスポンスを作った時刻(Unixミリ秒)
+	ServerTime int64 `json:"server_time"`
+	// センサーごとの最新のデータ(まだなければnull)
+	Sensors map[string]*LatestSample `json:"sensors"`
+}
+
+type LatestSample struct {
+	// 受信時刻(Unixミリ秒)
+	Time int64 `json:"t"`
+	// server_timeから見た古さ(ミリ秒)
+	AgeMS      int64            `json:"age_ms"`
+	Data       any              `json:"data"`
+	Timestamps clock.Timestamps `json:"timestamps"`
+}
+
+// GET /data/frames のレスポンス
+type Frames struct {
+	// 格子の範囲と間隔(Unixミリ秒、ミリ秒)
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+	Step int64 `json:"step"`
+	// これより古いデータは使わない(ミリ秒)
+	MaxAge  int64    `json:"max_age"`
+	Sensors []string `json:"sensors"`
+	Frames  []Frame  `json:"frames"`
+}
+
+// 格子の1点での全センサーの値
+type Frame struct {
+	// 格子の時刻(Unixミリ秒)
+	Time int64 `json:"t"`
+	// センサーごとの、その時刻までに受け取った最新のデータ(なければnull)
+	Data map[string]any `json:"data"`
+	// そのデータの格子の時刻から見た古さ(ミリ秒)
+	AgeMS map[string]*int64 `json:"age_ms"`
+}
+
+// 全センサーの最新のデータをまとめて返す
+type Handler struct {
+	targets []Target
+}
@@ -5,6 +5,7 @@ go 1.24.3
 require (
 	cloud.google.com/go/storage v1.55.0
 	github.com/labstack/echo v3.3.10+incompatible
+	golang.org/x/sys v0.33.0
 )
 
 require (
@@ -52,7 +53,6 @@ require (
 	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/oauth2 v0.30.0 // indirect
 	golang.org/x/sync v0.15.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.26.0 // indirect
 	golang.org/x/time v0.11.0 // indirect
 	google.golang.org/api v0.235.0 // indirect
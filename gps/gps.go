@@ -1,97 +1,49 @@
 package gps
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"math"
 	"math/rand"
 	"net/http"
-	"os"
 	"time"
 
-	"github.com/TitechMeister/Neon/cloudstorage"
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/sensor"
+	"github.com/TitechMeister/Neon/serial"
+	"github.com/TitechMeister/Neon/simulator"
+	"github.com/TitechMeister/Neon/upstream"
 	"github.com/labstack/echo"
 )
 
-// 新しいGPSの構造体を返す
-func New(logFrequency int) *GPS {
-	return &GPS{
-		DataHistory:  []GPSData{},
-		Client:       &http.Client{}, // HTTPクライアントを初期化
-		LogFrequency: logFrequency,   // ログ更新周波数を設定
-	}
-}
-
-func (g *GPS) GetSencorName() string {
-	// センサーの名前を返す
-	return "gps"
-}
-
-// GPSエンドポイント→現在はモックデータとしてGPSData構造体のJSONを返す
-func (handler *GPS) GetData(c echo.Context) error {
-	// DataHistoryの最新一件
-	if len(handler.DataHistory) == 0 {
-		return c.String(404, "No GPS data available")
-	}
-	data := handler.DataHistory[len(handler.DataHistory)-1]
-
-	// UI用JSONファイルに保存
-	err := handler.makeUILogJson(data)
-	if err != nil {
-		// ログ保存エラーがあってもレスポンスは継続
-		fmt.Printf("Warning: Failed to save UI log for GPS: %v\n", err)
-	}
-
-	// JSON形式でデータを返す
-	formattedData := handler.formatGPSData(data)
-	return c.JSON(200, formattedData)
-}
-
-func (handler *GPS) PostData(c echo.Context) error {
-	// 現在までのデータをログに追記
-	res := &GPSDLlink{}
-	err := handler.makeLogJson(handler.DataHistory)
-	if err != nil {
-		return c.String(500, fmt.Sprintf("Error writing GPS data log: %v", err))
-	}
-	// ログファイルのリネーム
-	newName := fmt.Sprintf("logs/gps_log_%s.json", time.Now().Format("20060102_150405"))
-	err = os.Rename("temp_gps_log.json", newName)
-	if err != nil {
-		return c.String(500, fmt.Sprintf("Error renaming GPS log file: %v", err))
-	}
+var logger = logging.For("gps")
 
-	// UI用ログファイルの処理
-	uiNewName := fmt.Sprintf("logs_ui/gps_ui_log_%s.json", time.Now().Format("20060102_150405"))
-	// logs_uiディレクトリを作成（存在しない場合）
-	err = os.MkdirAll("logs_ui", 0755)
-	if err != nil {
-		fmt.Printf("Warning: Failed to create logs_ui directory: %v\n", err)
-	} else {
-		// UI用ログファイルをリネーム
-		err = os.Rename("temp_gps_ui_log.json", uiNewName)
-		if err != nil {
-			fmt.Printf("Warning: Failed to rename UI log file: %v\n", err)
-		}
-	}
+// ターゲットをserialサーバに送る時間制限
+const targetTimeout = 5 * time.Second
 
-	// ログファイルのリネームが成功したら履歴をクリア
-	handler.DataHistory = []GPSData{}
-	url, err := cloudstorage.UploadFile(c.Response().Writer, "25_logs", newName)
-	if err != nil {
-		return c.String(500, fmt.Sprintf("Error uploading GPS log file: %v", err))
+// 新しいGPSの構造体を返す
+func New(options sensor.Options) *GPS {
+	return &GPS{
+		Sensor: sensor.New(sensor.Config[GPSData, GPSUIData]{
+			Name:         "gps",
+			Label:        "GPS",
+			UpstreamPath: "/data/gps",
+			Format:       formatGPSData,
+			Mock:         Simulate,
+			Clock:        readClock,
+			DeviceClock:  clock.Spec{Unit: time.Second, Period: 1 << 32},
+			Packet:       serial.TypeGPS,
+			Decode:       Decode,
+		}, options),
 	}
-	// データのDLリンクを返す
-	res.DownloadLink = *url
-	res.Timestamp = time.Now()
-	return c.JSON(200, res)
 }
 
-// 現在のデータ履歴を取得する
-func (handler *GPS) GetHistory(c echo.Context) error {
-	// 履歴データを返す
-	return c.JSON(200, handler.DataHistory)
+// 共通のルーティングに加えてターゲット送信用のルートを設定する
+func (handler *GPS) RegisterRoutes(e *echo.Echo) {
+	handler.Sensor.RegisterRoutes(e)
+	e.POST("/data/gps/target", handler.PostTarget)
 }
 
 func (handler *GPS) PostTarget(c echo.Context) error {
@@ -102,7 +54,7 @@ func (handler *GPS) PostTarget(c echo.Context) error {
 	}
 
 	// 受け取ったデータをログ表示
-	fmt.Printf("Received target data: %+v\n", targetData)
+	logger.Info("received target data", "target", targetData)
 
 	// 受け取ったデータ全体を48個の整数に変換
 	dataBytes := make([]byte, 48)
@@ -133,181 +85,71 @@ func (handler *GPS) PostTarget(c echo.Context) error {
 	}
 	// データバイトのログ表示
 	// 48個の整数に変換したデータをログに出力
-	fmt.Printf("Target data bytes: %x\n", dataBytes)
+	logger.Debug("target data bytes", "payload", fmt.Sprintf("%x", dataBytes))
 
 	// データを履歴に追加
 	var payloadArr [48]byte
 	copy(payloadArr[:], dataBytes)
 	targetPayload := TargetPayload{Payload: payloadArr}
-	// データをjsonとしてread
-	req, err := http.NewRequest("POST", "http://localhost:7878/serial/write", nil)
-	if err != nil {
-		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating request: %v", err))
-	}
-	// リクエストヘッダーにContent-Typeを設定
-	req.Header.Set("Content-Type", "application/json")
 	// リクエストボディにtargetPayloadのjsonを設定
 	jsonPayload, err := json.Marshal(targetPayload)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error marshalling target payload: %v", err))
 	}
-	req.ContentLength = int64(len(jsonPayload))
-	req.Body = io.NopCloser(bytes.NewBuffer(jsonPayload))
 	// リクエストを送信
-	res, err := handler.Client.Do(req)
-	if err != nil {
-		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error sending request: %v", err))
-	}
-	defer res.Body.Close()
-
-	// レスポンスボディを読み取る
-	responseBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error reading response body: %v", err))
+	responseBody, err := handler.Client.Post(c.Request().Context(), "/serial/write", "application/json", jsonPayload, targetTimeout)
+	var status *upstream.StatusError
+	switch {
+	case errors.As(err, &status):
+		// serialサーバのステータスコードをそのまま返す
+		return c.String(status.Code, fmt.Sprintf("Error sending target data: %v", err))
+	case err != nil:
+		return c.String(http.StatusServiceUnavailable, fmt.Sprintf("Error sending request: %v", err))
 	}
 	// レスポンスの内容をログに出力
-	fmt.Printf("Response from server: %s\n", responseBody)
-
-	// レスポンスのステータスコードをチェック
-	if res.StatusCode != http.StatusOK {
-		return c.String(res.StatusCode, fmt.Sprintf("Error sending target data: %s", res.Status))
-	}
+	logger.Debug("response from serial server", "body", string(responseBody))
 
 	// 成功レスポンスを返す
 	return c.JSON(http.StatusOK, map[string]string{"message": "Target data added successfully"})
 }
 
-// localhost:7878を叩いてデータを取得して、履歴に追加する
-// ゴルーチンで一定時間間隔で取得させることを想定
-// UIからの操作とは独立にサーバ内で行う
-// モックモードならモックデータを返す
-func (handler *GPS) LogData() error {
-	data := GPSData{}
-	if os.Getenv("MODE") == "mock" {
-		now := time.Now()
-		// 琵琶湖上の竹生島付近の座標（緯度: 35.2786, 経度: 136.0952）
-		data = GPSData{
-			ID:           1,
-			FixMode:      3,                            // 3D fix
-			PDOP:         uint16(100 + rand.Intn(200)), // Random PDOP between 100-300
-			Year:         uint16(now.Year()),
-			ITow:         uint32(now.Unix()),
-			Unixtime:     uint32(now.Unix()),
-			Lon:          uint32(1360952000 + rand.Intn(1000000)), // 136.0952 (竹生島付近) + ランダム
-			Lat:          uint32(352786000 + rand.Intn(1000000)),  // 35.2786 (竹生島付近) + ランダム
-			Height:       uint32(50000 + rand.Intn(100000)),       // Random height 50-150m (in mm)
-			HAcc:         uint32(1000 + rand.Intn(5000)),          // Horizontal accuracy 1-6m (in mm)
-			VAcc:         uint32(2000 + rand.Intn(8000)),          // Vertical accuracy 2-10m (in mm)
-			GSpeed:       uint32(rand.Intn(50000)),                // Random ground speed 0-50 m/s (in mm/s)
-			HeadMot:      uint32(rand.Intn(360000000)),            // Random heading 0-360 degrees (in 1e-5 degrees)
-			ReceivedTime: uint64(now.UnixMilli()),
-		}
-	} else {
-		// 実際のデータを取得する
-		fmt.Println("Fetching GPS data from the server...")
-		req, err := http.NewRequest("GET", "http://localhost:7878/data/gps", nil)
-		if err != nil {
-			return err
-		}
-		res, err := handler.Client.Do(req)
-		if err != nil {
-			return err
-		}
-		defer res.Body.Close()
-		if res.StatusCode != 200 {
-			return fmt.Errorf("server returned status %d", res.StatusCode)
-		}
-		// レスポンスボディをデコード
-		if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
-			return err
-		}
+// シミュレータの機体の状態からserialサーバが返すのと同じ形のデータを作る
+func Simulate(st simulator.State) GPSData {
+	now := st.Time
+	// 水平方向に1m程度の誤差を乗せる
+	const metersPerDegree = 111320
+	lat := st.Lat + rand.NormFloat64()/metersPerDegree
+	lon := st.Lon + rand.NormFloat64()/(metersPerDegree*math.Cos(st.Lat*math.Pi/180))
+	return GPSData{
+		ID:           1,
+		FixMode:      3,                           // 3D fix
+		PDOP:         uint16(120 + rand.Intn(30)), // 1.2-1.5
+		Year:         uint16(now.Year()),
+		ITow:         uint32(now.Unix()),
+		Unixtime:     uint32(now.Unix()),
+		Lon:          uint32(lon * 1e7),                                     // 1e-7度
+		Lat:          uint32(lat * 1e7),                                     // 1e-7度
+		Height:       uint32((st.Height() + rand.NormFloat64()*2.0) * 1000), // mm
+		HAcc:         uint32(1000 + rand.Intn(500)),                         // Horizontal accuracy 1-1.5m (in mm)
+		VAcc:         uint32(2000 + rand.Intn(1000)),                        // Vertical accuracy 2-3m (in mm)
+		GSpeed:       uint32(st.GroundSpeed * 1000),                         // 対地速度(mm/s)
+		HeadMot:      uint32(st.Track * 1e5),                                // 進行方向(1e-5度)
+		ReceivedTime: uint64(now.UnixMilli()),
 	}
-	// データを履歴に追加
-	handler.addData(data)
-	return nil
 }
 
-func (handler *GPS) GetLogFrequency() int {
-	// ログ更新周波数を返す
-	return handler.LogFrequency
-}
-
-func (handler *GPS) addData(data GPSData) {
-	// データを履歴に追加
-	handler.DataHistory = append(handler.DataHistory, data)
-	// 履歴が20件を超えたらjsonに書き込んで古い10件のデータを削除
-	if len(handler.DataHistory) > 20 {
-		handler.makeLogJson(handler.DataHistory[:10])
-		handler.DataHistory = handler.DataHistory[len(handler.DataHistory)-10:]
+// データに含まれる時刻
+func readClock(data GPSData) clock.Reading {
+	return clock.Reading{
+		DeviceID:  data.ID,
+		Device:    uint64(data.Unixtime),
+		HasDevice: true,
+		Upstream:  clock.UnixMilli(int64(data.ReceivedTime)),
 	}
 }
 
-func (handler *GPS) makeLogJson(data []GPSData) error {
-	// JSONファイルに書き込む
-	file, err := os.OpenFile("temp_gps_log.json", os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return fmt.Errorf("failed to open temp_gps_log.json: %w", err)
-	}
-	defer file.Close()
-	fi, _ := file.Stat()
-	leng := fi.Size()
-
-	json_, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal GPS data: %w", err)
-	}
-
-	if leng == 0 {
-		_, err = file.Write(fmt.Appendf(nil, `%s`, json_))
-		if err != nil {
-			return fmt.Errorf("failed to write to temp_gps_log.json: %w", err)
-		}
-	} else {
-		// 頭の1文字[は削る
-		json_ = json_[1:]
-		_, err = file.WriteAt(fmt.Appendf(nil, `,%s`, json_), leng-1)
-		if err != nil {
-			return fmt.Errorf("failed to write to temp_gps_log.json: %w", err)
-		}
-	}
-	return nil
-}
-
-func (handler *GPS) makeUILogJson(data GPSData) error {
-	// UI用JSONファイルに書き込む
-	file, err := os.OpenFile("temp_gps_ui_log.json", os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return fmt.Errorf("failed to open temp_gps_ui_log.json: %w", err)
-	}
-	defer file.Close()
-	fi, _ := file.Stat()
-	leng := fi.Size()
-
-	// フォーマットされたデータを使用
-	formattedData := handler.formatGPSData(data)
-	json_, err := json.Marshal([]GPSUIData{formattedData})
-	if err != nil {
-		return fmt.Errorf("failed to marshal GPS UI data: %w", err)
-	}
-
-	if leng == 0 {
-		_, err = file.Write(fmt.Appendf(nil, `%s`, json_))
-		if err != nil {
-			return fmt.Errorf("failed to write to temp_gps_ui_log.json: %w", err)
-		}
-	} else {
-		// 頭の1文字[は削る
-		json_ = json_[1:]
-		_, err = file.WriteAt(fmt.Appendf(nil, `,%s`, json_), leng-1)
-		if err != nil {
-			return fmt.Errorf("failed to write to temp_gps_ui_log.json: %w", err)
-		}
-	}
-	return nil
-}
-
-func (handler *GPS) formatGPSData(data GPSData) GPSUIData {
-	// データ履歴を返す
+func formatGPSData(data GPSData) GPSUIData {
+	// UI用のデータに変換する
 	return GPSUIData{
 		Unixtime:     data.Unixtime,
 		Lon:          data.Lon,
@@ -315,3 +157,47 @@ func (handler *GPS) formatGPSData(data GPSData) GPSUIData {
 		ReceivedTime: data.ReceivedTime,
 	}
 }
+
+// シリアルで受け取ったパケットのペイロードを生データにする
+// receivedはserialサーバの受信時刻の代わりになる
+func Decode(payload []byte, received time.Time) (GPSData, error) {
+	var p gpsPacket
+	if err := serial.Unpack(payload, &p); err != nil {
+		return GPSData{}, err
+	}
+	return GPSData{
+		ID:           p.ID,
+		FixMode:      p.FixMode,
+		PDOP:         p.PDOP,
+		Year:         p.Year,
+		ITow:         p.ITow,
+		Unixtime:     p.Unixtime,
+		Lon:          p.Lon,
+		Lat:          p.Lat,
+		Height:       p.Height,
+		HAcc:         p.HAcc,
+		VAcc:         p.VAcc,
+		GSpeed:       p.GSpeed,
+		HeadMot:      p.HeadMot,
+		ReceivedTime: uint64(received.UnixMilli()),
+	}, nil
+}
+
+// 生データをシリアルで送るパケットのペイロードにする
+func Encode(data GPSData) []byte {
+	return serial.Pack(&gpsPacket{
+		ID:       data.ID,
+		FixMode:  data.FixMode,
+		PDOP:     data.PDOP,
+		Year:     data.Year,
+		ITow:     data.ITow,
+		Unixtime: data.Unixtime,
+		Lon:      data.Lon,
+		Lat:      data.Lat,
+		Height:   data.Height,
+		HAcc:     data.HAcc,
+		VAcc:     data.VAcc,
+		GSpeed:   data.GSpeed,
+		HeadMot:  data.HeadMot,
+	})
+}
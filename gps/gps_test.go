@@ -0,0 +1,109 @@
+package gps_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/TitechMeister/Neon/gps"
+	"github.com/TitechMeister/Neon/logfile"
+	"github.com/TitechMeister/Neon/sensor"
+	"github.com/TitechMeister/Neon/serialserver"
+	"github.com/TitechMeister/Neon/source"
+	"github.com/TitechMeister/Neon/upstream"
+	"github.com/labstack/echo"
+)
+
+// 同じプロセスでserialサーバを起動し、そこから取得するGPSを返す
+func newGPS(t *testing.T) (*serialserver.Server, *gps.GPS) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	server, err := serialserver.New(ctx, serialserver.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := server.Start(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	s := gps.New(sensor.Options{
+		LogFrequency: 10,
+		UpstreamURL:  "http://" + addr,
+		TempDir:      dir,
+		LogDir:       dir,
+		UILogDir:     dir,
+		HistoryLimit: 100,
+		HistoryKeep:  10,
+		Writer:       logfile.DefaultPolicy(),
+		Source:       source.KindHTTP,
+	})
+	t.Cleanup(func() { s.Close() })
+	return server, s
+}
+
+// 目標地点は48バイトのペイロードにしてserialサーバに書き込む
+func TestPostTarget(t *testing.T) {
+	server, s := newGPS(t)
+	body := `{"id":2,"timestamp":16909060,"target_lon":-1,"target_lat":5}`
+	req := httptest.NewRequest(http.MethodPost, "/data/gps/target", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if err := s.PostTarget(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	writes := server.Writes()
+	if len(writes) != 1 {
+		t.Fatalf("serial server got %d writes, want 1", len(writes))
+	}
+	want := "02000000" + "01020304" + "ffffffff" + "00000005" + strings.Repeat("00", 32)
+	if writes[0].Hex != want {
+		t.Errorf("payload = %s, want %s", writes[0].Hex, want)
+	}
+}
+
+// 書き込みは機体に届いているかもしれないので、serialサーバが5xxを返してもやり直さない
+func TestPostTargetNotRetried(t *testing.T) {
+	var writes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/serial/write" {
+			writes.Add(1)
+		}
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	dir := t.TempDir()
+	s := gps.New(sensor.Options{
+		LogFrequency: 10,
+		Upstream:     upstream.New(server.URL, upstream.Options{Retries: 2}),
+		TempDir:      dir,
+		LogDir:       dir,
+		UILogDir:     dir,
+		HistoryLimit: 100,
+		HistoryKeep:  10,
+		Writer:       logfile.DefaultPolicy(),
+		Source:       source.KindHTTP,
+	})
+	t.Cleanup(func() { s.Close() })
+
+	req := httptest.NewRequest(http.MethodPost, "/data/gps/target", strings.NewReader(`{"id":2,"timestamp":1,"target_lon":1,"target_lat":1}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if err := s.PostTarget(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if n := writes.Load(); n != 1 {
+		t.Errorf("serial server got %d writes, want 1", n)
+	}
+}
@@ -1,8 +1,7 @@
 package gps
 
 import (
-	"net/http"
-	"time"
+	"github.com/TitechMeister/Neon/sensor"
 )
 
 type GPSData struct {
@@ -23,15 +22,10 @@ type GPSData struct {
 }
 
 type GPS struct {
-	DataHistory  []GPSData    `json:"data_history"`
-	Client       *http.Client `json:"client"`        // HTTP client for requests
-	LogFrequency int          `json:"log_frequency"` // Frequency of logging data in a second
+	*sensor.Sensor[GPSData, GPSUIData]
 }
 
-type GPSDLlink struct {
-	DownloadLink string    `json:"download_link"`
-	Timestamp    time.Time `json:"timestamp"`
-}
+type GPSDLlink = sensor.DLlink
 
 type GPSUIData struct {
 	Unixtime     uint32 `json:"unixtime"`
@@ -51,3 +45,21 @@ type TargetData struct {
 type TargetPayload struct {
 	Payload [48]byte `json:"payload"`
 }
+
+// シリアルで送られるGPSのパケット(ビッグエンディアン、44バイト)
+type gpsPacket struct {
+	ID       uint8
+	FixMode  uint8
+	PDOP     uint16
+	Year     uint16
+	_        [2]byte
+	ITow     uint32
+	Unixtime uint32
+	Lon      uint32
+	Lat      uint32
+	Height   uint32
+	HAcc     uint32
+	VAcc     uint32
+	GSpeed   uint32
+	HeadMot  uint32
+}
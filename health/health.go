@@ -0,0 +1,148 @@
+package health
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// 実際の頻度を数える期間
+	rateWindow = 10 * time.Second
+	// 設定した間隔の何倍データが来なければstaleとするか
+	staleIntervals = 3
+	// staleとするまでの最短の時間
+	minStaleAfter = 2 * time.Second
+	// 実際の頻度が設定の何割を下回ればdegradedとするか
+	degradedRatio = 0.5
+)
+
+// frequencyは設定したデータの頻度、sourceはデータ源の種類
+func NewMonitor(frequency int, source string) *Monitor {
+	return &Monitor{frequency: max(frequency, 1), source: source}
+}
+
+// データを受け取ったことを記録する
+// 続けて失敗している回数は0に戻す
+func (m *Monitor) Success(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples++
+	m.last = t
+	m.consecutive = 0
+	m.recent = append(m.recent, t)
+	m.trim(t)
+}
+
+// 失敗を記録する
+// kindが"decode"ならデータを読めなかった失敗として数える
+func (m *Monitor) Failure(err error, kind string, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consecutive++
+	m.total++
+	if kind == KindDecode {
+		m.decode++
+	}
+	m.lastError = err.Error()
+	m.lastErrorKind = kind
+	m.lastErrorAt = t
+}
+
+// 最後にデータを受け取った時刻からの古さと、staleかどうかを返す
+// まだデータを受け取っていなければokはfalse
+func (m *Monitor) Age(now time.Time) (age time.Duration, stale bool, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last.IsZero() {
+		return 0, true, false
+	}
+	age = now.Sub(m.last)
+	return age, age > m.staleAfter(), true
+}
+
+// nowの時点での状態を返す
+func (m *Monitor) Status(name string, now time.Time) Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trim(now)
+	st := Status{
+		Sensor:            name,
+		Source:            m.source,
+		Stale:             true,
+		ConfiguredHz:      m.frequency,
+		Samples:           m.samples,
+		ConsecutiveErrors: m.consecutive,
+		TotalErrors:       m.total,
+		DecodeFailures:    m.decode,
+		LastError:         m.lastError,
+		LastErrorKind:     m.lastErrorKind,
+	}
+	if !m.lastErrorAt.IsZero() {
+		at := m.lastErrorAt.UnixMilli()
+		st.LastErrorAt = &at
+	}
+	if !m.last.IsZero() {
+		last, age := m.last.UnixMilli(), now.Sub(m.last).Milliseconds()
+		st.LastSample, st.AgeMS = &last, &age
+		st.Stale = now.Sub(m.last) > m.staleAfter()
+	}
+	// 最初のデータから期間が経っていなければ、それまでの期間で割る
+	if len(m.recent) > 0 {
+		span := min(rateWindow, now.Sub(m.recent[0])+time.Second/time.Duration(m.frequency))
+		st.AchievedHz = float64(len(m.recent)) / span.Seconds()
+	}
+	switch {
+	case st.Stale:
+		st.State = StateStale
+	case m.consecutive > 0 || st.AchievedHz < float64(m.frequency)*degradedRatio:
+		st.State = StateDegraded
+	default:
+		st.State = StateOK
+	}
+	return st
+}
+
+// 頻度を数える期間より古い受信時刻を捨てる
+func (m *Monitor) trim(now time.Time) {
+	i := 0
+	for i < len(m.recent) && now.Sub(m.recent[i]) > rateWindow {
+		i++
+	}
+	if i > 0 {
+		m.recent = append(m.recent[:0], m.recent[i:]...)
+	}
+}
+
+func (m *Monitor) staleAfter() time.Duration {
+	return max(staleIntervals*time.Second/time.Duration(m.frequency), minStaleAfter)
+}
+
+func NewHandler(targets []Target) *Handler {
+	return &Handler{targets: targets}
+}
+
+func (h *Handler) RegisterRoutes(e *echo.Echo) {
+	e.GET("/status", h.GetStatus)
+}
+
+// 全センサーの状態を返す
+func (h *Handler) GetStatus(c echo.Context) error {
+	report := Report{ServerTime: time.Now().UnixMilli(), Sensors: map[string]Status{}}
+	counts := map[string]int{}
+	for _, target := range h.targets {
+		st := target.Status()
+		report.Sensors[target.GetSencorName()] = st
+		counts[st.State]++
+	}
+	switch len(h.targets) {
+	case counts[StateOK]:
+		report.State = StateOK
+	case counts[StateStale]:
+		report.State = StateStale
+	default:
+		report.State = StateDegraded
+	}
+	return c.JSON(http.StatusOK, report)
+}
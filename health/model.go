@@ -0,0 +1,85 @@
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// センサーの状態
+const (
+	// 設定した頻度でデータを受け取れている
+	StateOK = "ok"
+	// データを受け取れているが、失敗しているか頻度が足りない
+	StateDegraded = "degraded"
+	// しばらくデータを受け取れていない
+	StateStale = "stale"
+)
+
+// データを読めなかった失敗の種類
+const KindDecode = "decode"
+
+// 1センサー分の状態
+type Status struct {
+	Sensor string `json:"sensor"`
+	State  string `json:"state"`
+	// データ源の種類
+	Source string `json:"source"`
+	// 最後にデータを受け取った時刻(Unixミリ秒)とその古さ(ミリ秒)
+	LastSample *int64 `json:"last_sample"`
+	AgeMS      *int64 `json:"age_ms"`
+	Stale      bool   `json:"stale"`
+	// 設定した頻度と、直近に実際に受け取れた頻度
+	ConfiguredHz int     `json:"configured_hz"`
+	AchievedHz   float64 `json:"achieved_hz"`
+	// これまでに受け取ったデータの数
+	Samples int `json:"samples"`
+	// 続けて失敗している回数と、これまでに失敗した回数
+	ConsecutiveErrors int `json:"consecutive_errors"`
+	TotalErrors       int `json:"total_errors"`
+	// 失敗のうち、データを読めなかったもの
+	DecodeFailures int `json:"decode_failures"`
+	// 最後の失敗と、その種類 e.g. "timeout", "unreachable", "status", "circuit_open", "decode"
+	LastError     string `json:"last_error,omitempty"`
+	LastErrorKind string `json:"last_error_kind,omitempty"`
+	LastErrorAt   *int64 `json:"last_error_at,omitempty"`
+}
+
+// GET /status のレスポンス
+type Report struct {
+	// レスポンスを作った時刻(Unixミリ秒)
+	ServerTime int64 `json:"server_time"`
+	// 全センサーをまとめた状態(すべてokならok、すべてstaleならstale、それ以外はdegraded)
+	State   string            `json:"state"`
+	Sensors map[string]Status `json:"sensors"`
+}
+
+// 1センサー分のデータの受け取りと失敗を数える
+type Monitor struct {
+	// 設定した頻度
+	frequency int
+	source    string
+
+	mu            sync.Mutex
+	samples       int
+	last          time.Time
+	recent        []time.Time
+	consecutive   int
+	total         int
+	decode        int
+	lastError     string
+	lastErrorKind string
+	lastErrorAt   time.Time
+}
+
+// 状態を持つセンサー
+type Target interface {
+	// センサーの名前を取得する
+	GetSencorName() string
+	// 今の状態を返す
+	Status() Status
+}
+
+// 全センサーの状態を返す
+type Handler struct {
+	targets []Target
+}
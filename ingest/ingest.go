@@ -0,0 +1,209 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/labstack/echo"
+)
+
+var logger = logging.For("ingest")
+
+const (
+	// レスポンスに含める受け取れなかったデータの数
+	maxErrors = 20
+	// TCPで受け付ける1行の長さの上限
+	maxLine = 1 << 20
+)
+
+// 知らないセンサーのデータを押し込まれたときに返すエラー
+var ErrUnknownSensor = errors.New("unknown sensor")
+
+func New(targets []Target) *Server {
+	s := &Server{targets: map[string]Target{}, conns: map[net.Conn]struct{}{}}
+	for _, target := range targets {
+		s.targets[target.GetSencorName()] = target
+	}
+	return s
+}
+
+func (s *Server) RegisterRoutes(e *echo.Echo) {
+	e.POST("/ingest", s.PostIngest)
+}
+
+// 1件のデータをセンサーに渡し、すでに受け取っていたかを返す
+func (s *Server) Ingest(f Frame) (duplicate bool, err error) {
+	target, ok := s.targets[f.Sensor]
+	if !ok {
+		framesTotal.With("unknown", "rejected").Inc()
+		return false, fmt.Errorf("%w %q", ErrUnknownSensor, f.Sensor)
+	}
+	if len(f.Data) == 0 {
+		framesTotal.With(f.Sensor, "rejected").Inc()
+		return false, errors.New("frame has no data")
+	}
+	duplicate, err = target.Push(f.Data)
+	switch {
+	case err != nil:
+		framesTotal.With(f.Sensor, "rejected").Inc()
+	case duplicate:
+		framesTotal.With(f.Sensor, "duplicate").Inc()
+	default:
+		framesTotal.With(f.Sensor, "accepted").Inc()
+	}
+	return duplicate, err
+}
+
+// データをまとめて受け取る
+// ボディはFrameのJSON配列か、1行1件のNDJSON
+// NDJSONならボディを送り続けている間も届いた順に受け取る
+func (s *Server) PostIngest(c echo.Context) error {
+	body := bufio.NewReader(c.Request().Body)
+	var result Result
+	first, err := peekNonSpace(body)
+	if errors.Is(err, io.EOF) {
+		return c.JSON(http.StatusOK, result)
+	}
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Error reading body: %v", err))
+	}
+	dec := json.NewDecoder(body)
+	if first == '[' {
+		// 配列の開き括弧を読み飛ばす
+		if _, err := dec.Token(); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error reading body: %v", err))
+		}
+	}
+	for index := 0; dec.More(); index++ {
+		var f Frame
+		if err := dec.Decode(&f); err != nil {
+			// それまでに受け取った分は履歴に入っているので、結果と一緒に返す
+			result.Errors = append(result.Errors, FrameError{Index: index, Error: err.Error()})
+			return c.JSON(http.StatusBadRequest, result)
+		}
+		duplicate, err := s.Ingest(f)
+		switch {
+		case err != nil:
+			result.Rejected++
+			if len(result.Errors) < maxErrors {
+				result.Errors = append(result.Errors, FrameError{Index: index, Sensor: f.Sensor, Error: err.Error()})
+			}
+		case duplicate:
+			result.Duplicates++
+		default:
+			result.Accepted++
+		}
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// 空白を読み飛ばし、次の1文字を読まずに返す
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			return b[0], nil
+		}
+		r.Discard(1)
+	}
+}
+
+// addrで待ち受け、1行1件のNDJSONでデータを受け取る
+// 実際に待ち受けているアドレスを返す(":0" なら空いているポートを使う)
+func (s *Server) ListenTCP(addr string) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				logger.Warn("failed to accept ingest connection", "err", err)
+				continue
+			}
+			go s.serveConn(conn)
+		}
+	}()
+	logger.Info("listening for pushed data", "addr", ln.Addr().String())
+	return ln.Addr().String(), nil
+}
+
+// 接続が切れるまで1行ずつデータを受け取る
+func (s *Server) serveConn(conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	connections.With().Add(1)
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		connections.With().Add(-1)
+		conn.Close()
+	}()
+	remote := conn.RemoteAddr().String()
+	logger.Info("ingest connection opened", "remote", remote)
+	var result Result
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var f Frame
+		err := json.Unmarshal(line, &f)
+		duplicate := false
+		if err == nil {
+			duplicate, err = s.Ingest(f)
+		}
+		switch {
+		case err != nil:
+			result.Rejected++
+			logger.Debug("rejected pushed data", "remote", remote, "sensor", f.Sensor, "err", err)
+		case duplicate:
+			result.Duplicates++
+		default:
+			result.Accepted++
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Warn("ingest connection failed", "remote", remote, "err", err)
+	}
+	logger.Info("ingest connection closed", "remote", remote,
+		"accepted", result.Accepted, "duplicates", result.Duplicates, "rejected", result.Rejected)
+}
+
+// 待ち受けをやめ、つながっている接続を切る
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, ln := range s.listeners {
+		if err := ln.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.listeners = nil
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,13 @@
+package ingest
+
+import (
+	"github.com/TitechMeister/Neon/metrics"
+)
+
+// 押し込まれたデータの指標
+var (
+	framesTotal = metrics.NewCounterVec("neon_ingest_frames_total",
+		"Pushed frames, by sensor and result (accepted, duplicate or rejected).", "sensor", "result")
+	connections = metrics.NewGaugeVec("neon_ingest_connections",
+		"Open TCP connections pushing frames.")
+)
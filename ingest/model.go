@@ -0,0 +1,54 @@
+package ingest
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+)
+
+// 押し込まれる1件のデータ
+type Frame struct {
+	// センサーの名前 e.g. "gps"
+	Sensor string `json:"sensor"`
+	// serialサーバが返すのと同じ形のデータ
+	Data json.RawMessage `json:"data"`
+}
+
+// POST /ingest のレスポンス
+type Result struct {
+	// 履歴に追加した数
+	Accepted int `json:"accepted"`
+	// すでに受け取っていたので捨てた数
+	Duplicates int `json:"duplicates"`
+	// 受け取れなかった数
+	Rejected int `json:"rejected"`
+	// 受け取れなかったデータ(多ければ先頭のいくつかだけ)
+	Errors []FrameError `json:"errors,omitempty"`
+}
+
+// 受け取れなかった1件
+type FrameError struct {
+	// リクエストの中で何件目か(0から)
+	Index  int    `json:"index"`
+	Sensor string `json:"sensor"`
+	Error  string `json:"error"`
+}
+
+// データを押し込まれるセンサー
+type Target interface {
+	// センサーの名前を取得する
+	GetSencorName() string
+	// データを1件受け取り、すでに受け取っていたかを返す
+	Push(data json.RawMessage) (duplicate bool, err error)
+}
+
+// 押し込まれたデータをセンサーに振り分ける
+// HTTPのPOSTとTCPの接続で受け付ける
+type Server struct {
+	targets map[string]Target
+
+	mu sync.Mutex
+	// 待ち受けているTCPと、つながっている接続(閉じるときに使う)
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+}
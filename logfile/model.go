@@ -0,0 +1,67 @@
+package logfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// fsyncのタイミング
+const (
+	// fsyncしない(OSに任せる)
+	SyncNever = "never"
+	// バッファを書き出すたびにfsyncする
+	SyncFlush = "flush"
+	// 1レコードごとにfsyncする
+	SyncAlways = "always"
+)
+
+// 書き込みの方針
+type Policy struct {
+	// チャンネルに溜められるレコード数
+	BufferSize int
+	// バッファをファイルに書き出す間隔
+	FlushInterval time.Duration
+	// fsyncのタイミング(SyncNever, SyncFlush, SyncAlways)
+	Sync string
+}
+
+// NDJSONの1行
+type Record struct {
+	// Neonがデータを受け取った時刻(Unixミリ秒)
+	Time int64 `json:"t"`
+	// 記録中のフライトセッションのID
+	Session string `json:"session_id,omitempty"`
+	// センサーのデータ
+	Data json.RawMessage `json:"data"`
+}
+
+// 1つのNDJSONファイルに追記し続けるライター
+// 書き込みは専用のgoroutineで行い、呼び出し側はチャンネルに渡すだけ
+type Writer struct {
+	path   string
+	policy Policy
+
+	lines    chan []byte
+	requests chan request
+	done     chan struct{}
+
+	// 以下は書き込み用goroutineだけが触る
+	file    *os.File
+	buf     *bufio.Writer
+	dirty   bool
+	lastErr error
+}
+
+// 書き込み用goroutineへの操作の依頼
+type request struct {
+	kind  int
+	dst   string
+	reply chan reply
+}
+
+type reply struct {
+	moved bool
+	err   error
+}
@@ -0,0 +1,81 @@
+package logfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// NDJSONファイルを読み、完全なレコードだけを返す
+// クラッシュで途中まで書かれた行や壊れた行は読み飛ばし、そのバイト数をdroppedとして返す
+func ReadRecords(path string) (records []Record, dropped int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	return DecodeRecords(file)
+}
+
+// rからNDJSONのレコードを読む(ReadRecordsと同じく壊れた行は読み飛ばす)
+func DecodeRecords(r io.Reader) ([]Record, int64, error) {
+	records := []Record{}
+	var dropped int64
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var rec Record
+			// 改行で終わっていない最後の行は書き込み途中の可能性がある
+			if jerr := json.Unmarshal(line, &rec); jerr != nil || rec.Data == nil {
+				dropped += int64(len(line))
+			} else {
+				records = append(records, rec)
+			}
+		}
+		if err == io.EOF {
+			return records, dropped, nil
+		}
+		if err != nil {
+			return records, dropped, err
+		}
+	}
+}
+
+// NDJSONファイルをこれまでと同じ形式のJSON配列のファイルに書き出す
+// 書き出したレコード数を返す
+func Export(src, dst string) (int, error) {
+	records, _, err := ReadRecords(src)
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	if err := WriteArray(out, records); err != nil {
+		out.Close()
+		return 0, fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close %s: %w", dst, err)
+	}
+	return len(records), nil
+}
+
+// レコードのデータ部分をJSON配列として書き出す
+func WriteArray(w io.Writer, records []Record) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('[')
+	for i, rec := range records {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		bw.Write(rec.Data)
+	}
+	bw.WriteByte(']')
+	return bw.Flush()
+}
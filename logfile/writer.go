@@ -0,0 +1,244 @@
+package logfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TitechMeister/Neon/metrics"
+)
+
+// 一時ログファイルに書き込んだバイト数
+var bytesWritten = metrics.NewCounterVec("neon_log_bytes_written_total",
+	"Bytes appended to temp log files.", "file")
+
+// 閉じたライターに書き込もうとしたときのエラー
+var ErrClosed = errors.New("log writer is closed")
+
+const (
+	requestFlush = iota
+	requestRotate
+	requestClose
+)
+
+// 確定処理中の一時ログファイルにつける接尾辞
+const FinalizingSuffix = ".finalizing"
+
+// センサーの一時ログファイルのパスを返す
+func TempName(dir, sensor string, ui bool) string {
+	if ui {
+		return filepath.Join(dir, fmt.Sprintf("temp_%s_ui_log.ndjson", sensor))
+	}
+	return filepath.Join(dir, fmt.Sprintf("temp_%s_log.ndjson", sensor))
+}
+
+// 既定の書き込み方針
+func DefaultPolicy() Policy {
+	return Policy{
+		BufferSize:    1024,
+		FlushInterval: time.Second,
+		Sync:          SyncFlush,
+	}
+}
+
+// pathに追記するライターを作り、書き込み用goroutineを起動する
+// ファイルは最初のレコードが来たときに開く
+func NewWriter(path string, policy Policy) *Writer {
+	if policy.BufferSize <= 0 {
+		policy.BufferSize = DefaultPolicy().BufferSize
+	}
+	if policy.FlushInterval <= 0 {
+		policy.FlushInterval = DefaultPolicy().FlushInterval
+	}
+	w := &Writer{
+		path:     path,
+		policy:   policy,
+		lines:    make(chan []byte, policy.BufferSize),
+		requests: make(chan request),
+		done:     make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+// ファイルのパスを返す
+func (w *Writer) Path() string {
+	return w.path
+}
+
+// 受信時刻・セッションID・データを1行のレコードとして追記する
+// チャンネルが一杯なら空くまで待つ
+func (w *Writer) Write(received time.Time, session string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	line, err := json.Marshal(Record{Time: received.UnixMilli(), Session: session, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	select {
+	case w.lines <- append(line, '\n'):
+		return nil
+	case <-w.done:
+		return ErrClosed
+	}
+}
+
+// ここまでに渡したレコードをすべてファイルに書き出す
+func (w *Writer) Flush() error {
+	_, err := w.do(request{kind: requestFlush})
+	return err
+}
+
+// ここまでに渡したレコードを書き出してからファイルをdstに移動し、次のレコードから新しいファイルに書く
+// 移動するファイルがなければfalseを返す
+func (w *Writer) Rotate(dst string) (bool, error) {
+	return w.do(request{kind: requestRotate, dst: dst})
+}
+
+// 残りのレコードを書き出してファイルを閉じる
+func (w *Writer) Close() error {
+	_, err := w.do(request{kind: requestClose})
+	if errors.Is(err, ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (w *Writer) do(req request) (bool, error) {
+	req.reply = make(chan reply, 1)
+	select {
+	case w.requests <- req:
+	case <-w.done:
+		return false, ErrClosed
+	}
+	r := <-req.reply
+	return r.moved, r.err
+}
+
+func (w *Writer) loop() {
+	ticker := time.NewTicker(w.policy.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line := <-w.lines:
+			w.append(line)
+		case <-ticker.C:
+			w.flush()
+		case req := <-w.requests:
+			// 依頼より前に渡されたレコードを先に書く
+			w.drain()
+			switch req.kind {
+			case requestFlush:
+				w.flush()
+				req.reply <- reply{err: w.takeErr()}
+			case requestRotate:
+				moved, err := w.rotate(req.dst)
+				req.reply <- reply{moved: moved, err: err}
+			case requestClose:
+				err := w.closeFile()
+				close(w.done)
+				req.reply <- reply{err: err}
+				return
+			}
+		}
+	}
+}
+
+func (w *Writer) drain() {
+	for {
+		select {
+		case line := <-w.lines:
+			w.append(line)
+		default:
+			return
+		}
+	}
+}
+
+func (w *Writer) append(line []byte) {
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			w.lastErr = err
+			return
+		}
+	}
+	if _, err := w.buf.Write(line); err != nil {
+		w.lastErr = fmt.Errorf("failed to write to %s: %w", w.path, err)
+		return
+	}
+	w.dirty = true
+	bytesWritten.With(filepath.Base(w.path)).Add(float64(len(line)))
+	if w.policy.Sync == SyncAlways {
+		w.flush()
+	}
+}
+
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", w.path, err)
+	}
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", w.path, err)
+	}
+	w.file = file
+	w.buf = bufio.NewWriter(file)
+	return nil
+}
+
+// バッファを書き出し、方針に従ってfsyncする
+func (w *Writer) flush() {
+	if w.file == nil || !w.dirty {
+		return
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.lastErr = fmt.Errorf("failed to flush %s: %w", w.path, err)
+	} else if w.policy.Sync != SyncNever {
+		if err := w.file.Sync(); err != nil {
+			w.lastErr = fmt.Errorf("failed to sync %s: %w", w.path, err)
+		}
+	}
+	w.dirty = false
+}
+
+// 前回の依頼から後に起きた書き込みエラーを取り出す
+func (w *Writer) takeErr() error {
+	err := w.lastErr
+	w.lastErr = nil
+	return err
+}
+
+func (w *Writer) closeFile() error {
+	w.flush()
+	err := w.takeErr()
+	if w.file != nil {
+		if cerr := w.file.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close %s: %w", w.path, cerr)
+		}
+		w.file = nil
+		w.buf = nil
+	}
+	return err
+}
+
+func (w *Writer) rotate(dst string) (bool, error) {
+	if err := w.closeFile(); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(w.path); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, fmt.Errorf("failed to create directory for %s: %w", dst, err)
+	}
+	if err := os.Rename(w.path, dst); err != nil {
+		return false, fmt.Errorf("failed to move %s: %w", w.path, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,291 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var global = &registry{
+	sink:       slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	level:      slog.LevelInfo,
+	overrides:  map[string]slog.Level{},
+	subsystems: map[string]bool{},
+	options:    Options{Format: "text"},
+}
+
+// サブシステムのロガーを返す
+// Setupの前に作ったロガーもSetup後の出力先とレベルに従う
+func For(subsystem string) *slog.Logger {
+	global.mu.Lock()
+	global.subsystems[subsystem] = true
+	global.mu.Unlock()
+	return slog.New(&handler{subsystem: subsystem}).With("subsystem", subsystem)
+}
+
+// 出力先とレベルを設定する
+// 標準のlogパッケージとslogの既定のロガーも同じ出力先に流す
+func Setup(options Options) error {
+	if options.Format == "" {
+		options.Format = "text"
+	}
+	level, err := ParseLevel(options.Level)
+	if err != nil {
+		return err
+	}
+	overrides := map[string]slog.Level{}
+	for name, v := range options.Levels {
+		l, err := ParseLevel(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		overrides[name] = l
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var console slog.Handler
+	switch options.Format {
+	case "text":
+		console = slog.NewTextHandler(os.Stderr, handlerOptions)
+	case "json":
+		console = slog.NewJSONHandler(os.Stderr, handlerOptions)
+	default:
+		return fmt.Errorf("unknown log format %q", options.Format)
+	}
+	sink := console
+	var file *rotatingFile
+	if options.File != "" {
+		file, err = openRotating(options.File, options.MaxSize, options.MaxBackups)
+		if err != nil {
+			return err
+		}
+		sink = fanout{console, slog.NewJSONHandler(file, handlerOptions)}
+	}
+
+	global.mu.Lock()
+	old := global.file
+	global.sink, global.level, global.overrides, global.options, global.file = sink, level, overrides, options, file
+	global.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	slog.SetDefault(For("neon"))
+	return nil
+}
+
+// ログファイルを閉じる
+func Close() error {
+	global.mu.Lock()
+	defer global.mu.Unlock()
+	if global.file == nil {
+		return nil
+	}
+	err := global.file.Close()
+	global.file = nil
+	global.sink = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return err
+}
+
+// "debug", "info", "warn", "error" (空ならinfo)を読む
+func ParseLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	if v == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", v)
+	}
+	return level, nil
+}
+
+// サブシステムのレベルを変える
+// subsystemが空なら既定のレベルを変える
+func SetLevel(subsystem string, level slog.Level) {
+	global.mu.Lock()
+	defer global.mu.Unlock()
+	if subsystem == "" {
+		global.level = level
+		return
+	}
+	global.overrides[subsystem] = level
+}
+
+// サブシステムのレベルの上書きをやめて既定のレベルに戻す
+func ResetLevel(subsystem string) {
+	global.mu.Lock()
+	defer global.mu.Unlock()
+	delete(global.overrides, subsystem)
+}
+
+// 今のレベルと出力先を返す
+func Current() State {
+	global.mu.RLock()
+	defer global.mu.RUnlock()
+	st := State{
+		Level:      global.level.String(),
+		Subsystems: map[string]string{},
+		Overrides:  map[string]string{},
+		Format:     global.options.Format,
+		File:       global.options.File,
+	}
+	for name := range global.subsystems {
+		st.Subsystems[name] = global.levelFor(name).String()
+	}
+	for name, level := range global.overrides {
+		st.Overrides[name] = level.String()
+	}
+	return st
+}
+
+// RLockを取った状態で呼ぶ
+func (r *registry) levelFor(subsystem string) slog.Level {
+	if level, ok := r.overrides[subsystem]; ok {
+		return level
+	}
+	return r.level
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	global.mu.RLock()
+	defer global.mu.RUnlock()
+	return level >= global.levelFor(h.subsystem)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	global.mu.RLock()
+	sink := global.sink
+	global.mu.RUnlock()
+	for _, op := range h.ops {
+		sink = op(sink)
+	}
+	return sink.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(s slog.Handler) slog.Handler { return s.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(s slog.Handler) slog.Handler { return s.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := append(append([]func(slog.Handler) slog.Handler{}, h.ops...), op)
+	return &handler{subsystem: h.subsystem, ops: ops}
+}
+
+func (f fanout) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanout) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (f fanout) WithGroup(name string) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+func RegisterRoutes(e *echo.Echo) {
+	e.GET("/logging", GetLogging)
+	e.PUT("/logging/level", PutLevel)
+	e.DELETE("/logging/level", DeleteLevel)
+}
+
+// 今のレベルと出力先を返す
+func GetLogging(c echo.Context) error {
+	return c.JSON(http.StatusOK, Current())
+}
+
+// ?level=debug で既定のレベルを、?level=debug&subsystem=sensor でサブシステムのレベルを変える
+func PutLevel(c echo.Context) error {
+	v := c.QueryParam("level")
+	if v == "" {
+		return c.String(http.StatusBadRequest, "level is required")
+	}
+	level, err := ParseLevel(v)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	subsystem := strings.TrimSpace(c.QueryParam("subsystem"))
+	SetLevel(subsystem, level)
+	For("logging").Info("log level changed", "target", subsystem, "level", level.String())
+	return c.JSON(http.StatusOK, Current())
+}
+
+// ?subsystem=sensor のレベルを既定に戻す
+func DeleteLevel(c echo.Context) error {
+	subsystem := c.QueryParam("subsystem")
+	if subsystem == "" {
+		return c.String(http.StatusBadRequest, "subsystem is required")
+	}
+	ResetLevel(subsystem)
+	return c.JSON(http.StatusOK, Current())
+}
+
+// Echoのリクエストをhttpサブシステムのロガーに書くミドルウェア
+// 5xxはerror、4xxはwarn、それ以外はinfoで書く
+func Middleware() echo.MiddlewareFunc {
+	logger := For("http")
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			req, res := c.Request(), c.Response()
+			level := slog.LevelInfo
+			switch {
+			case res.Status >= 500:
+				level = slog.LevelError
+			case res.Status >= 400:
+				level = slog.LevelWarn
+			}
+			attrs := []any{
+				"method", req.Method,
+				"uri", req.RequestURI,
+				"route", c.Path(),
+				"status", res.Status,
+				"latency", time.Since(start),
+				"bytes_out", res.Size,
+				"remote_ip", c.RealIP(),
+			}
+			if err != nil {
+				attrs = append(attrs, "err", err)
+			}
+			logger.Log(req.Context(), level, "request", attrs...)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// ログの出し方
+type Options struct {
+	// 既定のログレベル "debug", "info", "warn", "error"
+	Level string
+	// サブシステムごとのログレベル(キーはサブシステム名 e.g. "sensor")
+	Levels map[string]string
+	// 標準エラー出力の形式 "text", "json"
+	Format string
+	// ログファイルのパス(空ならファイルに書かない)
+	// ファイルには形式によらずJSONで書く
+	File string
+	// ファイルがこのバイト数を超えたら切り替える
+	MaxSize int64
+	// 切り替えた古いファイルを残す数
+	MaxBackups int
+}
+
+// GET /logging のレスポンス
+type State struct {
+	// 既定のログレベル
+	Level string `json:"level"`
+	// サブシステムごとの実際のログレベル
+	Subsystems map[string]string `json:"subsystems"`
+	// 既定のレベルを上書きしているサブシステム
+	Overrides map[string]string `json:"overrides"`
+	Format    string            `json:"format"`
+	File      string            `json:"file,omitempty"`
+}
+
+// サブシステムのロガーが共有する出力先とレベル
+type registry struct {
+	mu sync.RWMutex
+	// 出力先(Setupで差し替える)
+	sink slog.Handler
+	// 既定のレベルと、サブシステムごとに上書きしたレベル
+	level     slog.Level
+	overrides map[string]slog.Level
+	// これまでにロガーを作ったサブシステム
+	subsystems map[string]bool
+	options    Options
+	// 開いているログファイル
+	file *rotatingFile
+}
+
+// サブシステムのロガーのハンドラ
+// 出力先とレベルは呼ばれるたびにregistryから読むので、実行中に切り替えられる
+type handler struct {
+	subsystem string
+	// WithAttrsとWithGroupを呼ばれた順に出力先に適用する
+	ops []func(slog.Handler) slog.Handler
+}
+
+// 複数の出力先に同じレコードを書く
+type fanout []slog.Handler
+
+// サイズを超えたら切り替えるログファイル
+// path.1が一番新しい古いファイル
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
@@ -1,13 +1,66 @@
 package main
 
-import "github.com/TitechMeister/Neon/setup"
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/TitechMeister/Neon/config"
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/setup"
+)
 
 func main() {
 	// This is the main entry point for the Neon application.
-	// The main function is currently empty, but you can add your application logic here.
-	// For example, you might want to initialize the application, set up routes, or start a server.
+	// 設定ファイルは -config フラグか NEON_CONFIG 環境変数で指定する
+	configPath := flag.String("config", os.Getenv(config.PathEnv), "path to the Neon config file (default neon.json)")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	if err := logging.Setup(logging.Options{
+		Level:      cfg.Log.Level,
+		Levels:     cfg.Log.Levels,
+		Format:     cfg.Log.Format,
+		File:       cfg.Log.File,
+		MaxSize:    int64(cfg.Log.MaxSize),
+		MaxBackups: cfg.Log.MaxBackups,
+	}); err != nil {
+		log.Fatalf("logging: %v", err)
+	}
+	defer logging.Close()
+	logger := logging.For("main")
+
+	// Ctrl-CやSIGTERMを受け取ったらctxがキャンセルされる
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	app := setup.Setup(ctx, cfg) // Call the setup function to initialize the application
+	go func() {
+		// Start the Echo server on the configured address
+		logger.Info("starting Neon", "address", cfg.Server.Address)
+		if err := app.Echo.Start(cfg.Server.Address); err != nil && err != http.ErrServerClosed {
+			logger.Error("server stopped", "err", err)
+			stop()
+		}
+	}()
 
-	e := setup.Setup()               // Call the setup function to initialize the application
-	e.Logger.Fatal(e.Start(":8080")) // Start the Echo server on port 8080
+	<-ctx.Done()
+	stop() // 2回目のCtrl-Cで即座に終了できるようにする
+	logger.Info("shutting down Neon")
 
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Std())
+	defer cancel()
+	if err := app.Shutdown(shutdownCtx); err != nil {
+		logger.Error("shutdown failed", "err", err)
+		logging.Close()
+		os.Exit(1)
+	}
+	logger.Info("Neon stopped")
 }
@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 既定のRegistry
+// 各パッケージはパッケージ変数として指標を作り、ここに登録する
+var Default = &Registry{}
+
+// Echoのリクエストの指標
+var (
+	httpRequests = NewCounterVec("neon_http_requests_total",
+		"HTTP requests handled by Neon.", "method", "route", "code")
+	httpDuration = NewHistogramVec("neon_http_request_duration_seconds",
+		"Time to handle HTTP requests.", DefaultBuckets, "method", "route")
+)
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// 登録した指標をPrometheusのテキスト形式で返す
+func (r *Registry) Text() string {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+	b := &builder{}
+	for _, m := range metrics {
+		m.write(b)
+	}
+	return b.String()
+}
+
+func RegisterRoutes(e *echo.Echo) {
+	e.GET("/metrics", GetMetrics)
+}
+
+// Prometheusがスクレイプする
+func GetMetrics(c echo.Context) error {
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(Default.Text()))
+}
+
+// Echoのリクエストを数えるミドルウェア
+// ルートはパスの値ではなく登録したパターン(e.g. "/faults/:sensor")で数える
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			method := c.Request().Method
+			httpRequests.With(method, route, strconv.Itoa(c.Response().Status)).Inc()
+			httpDuration.With(method, route).Observe(time.Since(start).Seconds())
+			return nil
+		}
+	}
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name, help, labels}, series: map[string]*Counter{}}
+	if len(labels) == 0 {
+		// ラベルがなければ0から書き出す
+		c.With()
+	}
+	Default.register(c)
+	return c
+}
+
+// ラベルの値の組に対応するカウンタを返す
+func (c *CounterVec) With(values ...string) *Counter {
+	key := seriesKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, ok := c.series[key]
+	if !ok {
+		counter = &Counter{labels: values}
+		c.series[key] = counter
+	}
+	return counter
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// vは負にしない
+func (c *Counter) Add(v float64) {
+	c.mu.Lock()
+	c.value += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(b *builder) {
+	b.header(c.desc, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.series) {
+		counter := c.series[key]
+		counter.mu.Lock()
+		b.sample(c.name, c.labels, counter.labels, "", "", counter.value)
+		counter.mu.Unlock()
+	}
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{desc: desc{name, help, labels}, series: map[string]*Gauge{}}
+	if len(labels) == 0 {
+		g.With()
+	}
+	Default.register(g)
+	return g
+}
+
+// ラベルの値の組に対応するゲージを返す
+func (g *GaugeVec) With(values ...string) *Gauge {
+	key := seriesKey(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gauge, ok := g.series[key]
+	if !ok {
+		gauge = &Gauge{labels: values}
+		g.series[key] = gauge
+	}
+	return gauge
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.value = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	g.value += v
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) write(b *builder) {
+	b.header(g.desc, "gauge")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range sortedKeys(g.series) {
+		gauge := g.series[key]
+		gauge.mu.Lock()
+		b.sample(g.name, g.labels, gauge.labels, "", "", gauge.value)
+		gauge.mu.Unlock()
+	}
+}
+
+// bucketsは各区間の上限(昇順)
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{desc: desc{name, help, labels}, buckets: buckets, series: map[string]*Histogram{}}
+	if len(labels) == 0 {
+		h.With()
+	}
+	Default.register(h)
+	return h
+}
+
+// ラベルの値の組に対応するヒストグラムを返す
+func (h *HistogramVec) With(values ...string) *Histogram {
+	key := seriesKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	histogram, ok := h.series[key]
+	if !ok {
+		histogram = &Histogram{labels: values, buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = histogram
+	}
+	return histogram
+}
+
+// 値を1つ記録する
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count++
+	h.sum += v
+	// 上限がv以上の最初の区間に数える(どの上限より大きければ+Infだけに入る)
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+}
+
+func (h *HistogramVec) write(b *builder) {
+	b.header(h.desc, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		histogram := h.series[key]
+		histogram.mu.Lock()
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += histogram.counts[i]
+			b.sample(h.name+"_bucket", h.labels, histogram.labels, "le", formatFloat(upper), float64(cumulative))
+		}
+		b.sample(h.name+"_bucket", h.labels, histogram.labels, "le", "+Inf", float64(histogram.count))
+		b.sample(h.name+"_sum", h.labels, histogram.labels, "", "", histogram.sum)
+		b.sample(h.name+"_count", h.labels, histogram.labels, "", "", float64(histogram.count))
+		histogram.mu.Unlock()
+	}
+}
+
+// ラベルの値の組をmapのキーにする
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Prometheusのテキスト形式を組み立てる
+type builder struct {
+	strings.Builder
+}
+
+func (b *builder) header(d desc, kind string) {
+	b.WriteString("# HELP " + d.name + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help) + "\n")
+	b.WriteString("# TYPE " + d.name + " " + kind + "\n")
+}
+
+// extraName, extraValueはヒストグラムのle
+func (b *builder) sample(name string, labels, values []string, extraName, extraValue string, v float64) {
+	b.WriteString(name)
+	pairs := []string{}
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, label+`="`+escapeLabel(value)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapeLabel(extraValue)+`"`)
+	}
+	if len(pairs) > 0 {
+		b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	b.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
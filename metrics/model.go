@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// 既定のヒストグラムの区間(秒)
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// 登録した指標をまとめて書き出す
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Registryに登録できる指標
+type metric interface {
+	// Prometheusのテキスト形式で書き出す
+	write(b *builder)
+}
+
+// 名前・説明・ラベル名が共通の指標の元
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// 増えるだけの値(ラベルの値ごと)
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*Counter
+}
+
+type Counter struct {
+	labels []string
+	mu     sync.Mutex
+	value  float64
+}
+
+// 増減する値(ラベルの値ごと)
+type GaugeVec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*Gauge
+}
+
+type Gauge struct {
+	labels []string
+	mu     sync.Mutex
+	value  float64
+}
+
+// 値の分布(ラベルの値ごと)
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*Histogram
+}
+
+type Histogram struct {
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	// 各区間の上限以下の数(累積ではない)
+	counts []uint64
+	count  uint64
+	sum    float64
+}
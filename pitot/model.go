@@ -1,8 +1,7 @@
 package pitot
 
 import (
-	"net/http"
-	"time"
+	"github.com/TitechMeister/Neon/sensor"
 )
 
 type PitotData struct {
@@ -16,12 +15,19 @@ type PitotData struct {
 }
 
 type Pitot struct {
-	DataHistory  []PitotData  `json:"data_history"`  // データ履歴
-	Client       *http.Client `json:"client"`        // HTTPクライアント
-	LogFrequency int          `json:"log_frequency"` // Frequency of logging data in a second
+	*sensor.Sensor[PitotData, PitotData] // UIにも生データをそのまま返す
 }
 
-type PitotDLlink struct {
-	DownloadLink string    `json:"download_link"` // ダウンロードリンク
-	Timestamp    time.Time `json:"timestamp"`     // リンクの生成時刻
+type PitotDLlink = sensor.DLlink
+
+// シリアルで送られるピトー管のパケット(ビッグエンディアン、28バイト)
+type pitotPacket struct {
+	ID           uint8
+	_            [3]byte
+	Timestamp    uint32
+	Temperature  float32
+	Velocity     float32
+	PressureVRaw float32
+	PressureARaw float32
+	PressureSRaw float32
 }
@@ -0,0 +1,32 @@
+package recovery
+
+import "time"
+
+// 起動時に見つけた一時ログファイルの復旧結果
+type Manifest struct {
+	// 復旧した時刻
+	RecoveredAt time.Time `json:"recovered_at"`
+	// 復旧したファイルの保存先
+	Dir string `json:"dir"`
+	// 復旧したファイルの一覧
+	Files []File `json:"files"`
+}
+
+type File struct {
+	// センサーの名前
+	Sensor string `json:"sensor"`
+	// "raw" か "ui"
+	Kind string `json:"kind"`
+	// 元の一時ログファイル
+	Original string `json:"original"`
+	// 復旧後のファイル
+	Path string `json:"path"`
+	// 読み出せたレコード数
+	Records int `json:"records"`
+	// 途中で切れていた配列を修復したかどうか
+	Repaired bool `json:"repaired"`
+	// 修復で捨てたバイト数
+	DroppedBytes int64 `json:"dropped_bytes"`
+	// 修復できなかったときのエラー
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,224 @@
+package recovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TitechMeister/Neon/logfile"
+	"github.com/labstack/echo"
+)
+
+// 復旧したファイルを置くディレクトリ名(ログの保存先の下に作る)
+const recoveredDir = "recovered"
+
+// 一時ログファイルの復旧を行う
+type Recovery struct {
+	tempDir string
+	logDir  string
+}
+
+func New(tempDir, logDir string) *Recovery {
+	return &Recovery{tempDir: tempDir, logDir: logDir}
+}
+
+// 前回の実行で残った一時ログファイルを探して修復し、復旧用のディレクトリに移動する
+// 見つからなければnilを返す
+func (r *Recovery) Run(sensors []string) (*Manifest, error) {
+	now := time.Now()
+	m := &Manifest{
+		RecoveredAt: now,
+		Dir:         filepath.Join(r.logDir, recoveredDir, now.Format("20060102_150405")),
+	}
+	for _, name := range sensors {
+		for _, kind := range []string{"raw", "ui"} {
+			for _, original := range r.candidates(name, kind) {
+				if _, err := os.Stat(original); errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				if err := os.MkdirAll(m.Dir, 0755); err != nil {
+					return nil, fmt.Errorf("failed to create %s: %w", m.Dir, err)
+				}
+				m.Files = append(m.Files, r.recoverFile(name, kind, original, m.Dir))
+			}
+		}
+	}
+	if len(m.Files) == 0 {
+		return nil, nil
+	}
+
+	json_, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(m.Dir, "manifest.json"), json_, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return m, nil
+}
+
+// これまでに復旧したセッションを新しい順に返す
+func (r *Recovery) List() ([]Manifest, error) {
+	paths, err := filepath.Glob(filepath.Join(r.logDir, recoveredDir, "*", "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	manifests := []Manifest{}
+	for _, p := range paths {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var m Manifest
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+		}
+		manifests = append(manifests, m)
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].RecoveredAt.After(manifests[j].RecoveredAt)
+	})
+	return manifests, nil
+}
+
+// 復旧したセッションの一覧を返す
+func (r *Recovery) GetRecovered(c echo.Context) error {
+	manifests, err := r.List()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error reading recovered logs: %v", err))
+	}
+	return c.JSON(http.StatusOK, manifests)
+}
+
+// 前回の実行で残っている可能性のある一時ログファイル
+// 古い形式のJSON配列、NDJSON、確定処理中に止まったNDJSONの順
+func (r *Recovery) candidates(sensor, kind string) []string {
+	ndjson := logfile.TempName(r.tempDir, sensor, kind == "ui")
+	return []string{
+		strings.TrimSuffix(ndjson, ".ndjson") + ".json",
+		ndjson,
+		ndjson + logfile.FinalizingSuffix,
+	}
+}
+
+// 一時ログファイルを修復してdirに書き出し、元のファイルを削除する
+func (r *Recovery) recoverFile(sensor, kind, original, dir string) File {
+	// 復旧後のファイルはどれもJSON配列にする
+	// 同じクラッシュで古い形式とNDJSONの両方が残っていても上書きしないよう、元の拡張子は残す
+	// e.g. temp_gps_log.ndjson.finalizing -> temp_gps_log.ndjson.finalizing.json
+	base := filepath.Base(original)
+	if !strings.HasSuffix(base, ".json") {
+		base += ".json"
+	}
+	f := File{
+		Sensor:   sensor,
+		Kind:     kind,
+		Original: original,
+		Path:     filepath.Join(dir, base),
+	}
+	if !strings.HasSuffix(original, ".json") {
+		return recoverNDJSON(f)
+	}
+	raw, err := os.ReadFile(original)
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+
+	records, consumed, err := repairArray(raw)
+	if err != nil {
+		// 1件も読めなければ調査用にそのままの内容で残す
+		f.Error = err.Error()
+		f.Path += ".corrupt"
+		if err := os.Rename(original, f.Path); err != nil {
+			f.Error += "; " + err.Error()
+		}
+		return f
+	}
+	f.Records = len(records)
+	f.DroppedBytes = int64(len(bytes.TrimSpace(raw[consumed:])))
+	f.Repaired = f.DroppedBytes > 0 || !bytes.HasSuffix(bytes.TrimSpace(raw), []byte("]"))
+
+	json_, err := json.Marshal(records)
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	if err := os.WriteFile(f.Path, json_, 0644); err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	if err := os.Remove(original); err != nil {
+		f.Error = err.Error()
+	}
+	return f
+}
+
+// NDJSONの一時ログファイルから完全な行だけを取り出してJSON配列として書き出す
+func recoverNDJSON(f File) File {
+	records, dropped, err := logfile.ReadRecords(f.Original)
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	f.Records = len(records)
+	f.DroppedBytes = dropped
+	f.Repaired = dropped > 0
+
+	out, err := os.Create(f.Path)
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	if err := logfile.WriteArray(out, records); err != nil {
+		out.Close()
+		f.Error = err.Error()
+		return f
+	}
+	if err := out.Close(); err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	if err := os.Remove(f.Original); err != nil {
+		f.Error = err.Error()
+	}
+	return f
+}
+
+// JSON配列を先頭から読めるところまで読み、要素と読み終えた位置を返す
+// クラッシュで途中まで書かれた配列でも、完全な要素は取り出せる
+func repairArray(raw []byte) ([]json.RawMessage, int64, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, 0, fmt.Errorf("not a JSON array: %w", err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return nil, 0, errors.New("not a JSON array")
+	}
+	records := []json.RawMessage{}
+	consumed := dec.InputOffset()
+	for dec.More() {
+		var rec json.RawMessage
+		if err := dec.Decode(&rec); err != nil {
+			break
+		}
+		records = append(records, rec)
+		consumed = dec.InputOffset()
+	}
+	// 閉じ括弧まで読めたら配列は完全
+	if tok, err := dec.Token(); err == nil && tok == json.Delim(']') {
+		consumed = dec.InputOffset()
+	} else if err != nil && !errors.Is(err, io.EOF) && len(records) == 0 {
+		return nil, 0, err
+	}
+	return records, consumed, nil
+}
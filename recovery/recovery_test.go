@@ -0,0 +1,62 @@
+package recovery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 同じセンサーの古い形式のJSON配列・NDJSON・確定処理中のNDJSONが残っていても、どれも上書きせずに復旧する
+func TestRunKeepsEverySourceFile(t *testing.T) {
+	temp, logs := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"temp_gps_log.json":              `[{"id":1},{"id":2}`,
+		"temp_gps_log.ndjson":            `{"data":{"id":3}}` + "\n",
+		"temp_gps_log.ndjson.finalizing": `{"data":{"id":4}}` + "\n" + `{"data":{"id":5}}` + "\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(temp, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := New(temp, logs).Run([]string{"gps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil || len(m.Files) != 3 {
+		t.Fatalf("manifest = %+v, want 3 recovered files", m)
+	}
+	want := map[string]int{
+		"temp_gps_log.json":                   2,
+		"temp_gps_log.ndjson.json":            1,
+		"temp_gps_log.ndjson.finalizing.json": 2,
+	}
+	for _, f := range m.Files {
+		if f.Error != "" {
+			t.Errorf("%s: %s", f.Original, f.Error)
+		}
+		base := filepath.Base(f.Path)
+		n, ok := want[base]
+		if !ok {
+			t.Errorf("%s was recovered as %s", f.Original, base)
+			continue
+		}
+		delete(want, base)
+		raw, err := os.ReadFile(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []json.RawMessage
+		if err := json.Unmarshal(raw, &records); err != nil {
+			t.Fatalf("%s: %v", f.Path, err)
+		}
+		if len(records) != n {
+			t.Errorf("%s has %d records, want %d", base, len(records), n)
+		}
+	}
+	for base := range want {
+		t.Errorf("%s was not recovered", base)
+	}
+}
@@ -0,0 +1,137 @@
+package replay
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TitechMeister/Neon/logfile"
+)
+
+// pathからsensorのログを読み込む
+//   - セッションのディレクトリ: <sensor>_log.ndjson (なければ <sensor>_log.json)
+//   - バンドルのzip: <セッションID>/<sensor>_log.ndjson (なければ .json)
+//   - 確定したログのディレクトリ: 一番新しい <sensor>_log_<時刻>.json
+//
+// 受信時刻のないJSON配列のログは、データのreceived_timeかintervalごとの時刻を使う
+func Load(path, sensor string, interval time.Duration) (Track, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		if strings.HasSuffix(path, ".zip") {
+			return loadBundle(path, sensor, interval)
+		}
+		return nil, fmt.Errorf("%s is neither a directory nor a zip bundle", path)
+	}
+
+	// セッションのディレクトリ
+	records := filepath.Join(path, sensor+"_log.ndjson")
+	if _, err := os.Stat(records); err == nil {
+		track, _, err := logfile.ReadRecords(records)
+		return track, err
+	}
+	array := filepath.Join(path, sensor+"_log.json")
+	if _, err := os.Stat(array); err == nil {
+		return loadArrayFile(array, interval)
+	}
+
+	// 確定したログのディレクトリ
+	// ファイル名の時刻は固定長なので名前順で新しいものが最後に来る
+	matches, err := filepath.Glob(filepath.Join(path, sensor+"_log_*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no %s log in %s", sensor, path)
+	}
+	sort.Strings(matches)
+	return loadArrayFile(matches[len(matches)-1], interval)
+}
+
+func loadBundle(path, sensor string, interval time.Duration) (Track, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var array *zip.File
+	for _, f := range zr.File {
+		switch {
+		case strings.HasSuffix(f.Name, "/"+sensor+"_log.ndjson"):
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			track, _, err := logfile.DecodeRecords(r)
+			return track, err
+		case strings.HasSuffix(f.Name, "/"+sensor+"_log.json"):
+			array = f
+		}
+	}
+	if array == nil {
+		return nil, fmt.Errorf("no %s log in %s", sensor, path)
+	}
+	r, err := array.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return loadArray(r, array.Modified, interval)
+}
+
+func loadArrayFile(path string, interval time.Duration) (Track, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return loadArray(file, info.ModTime(), interval)
+}
+
+// JSON配列のログを読む
+// データのreceived_timeが増えていればそれを受信時刻とし、なければ
+// ファイルを書いた時刻(modified)を最後のデータとしてintervalごとに並べる
+func loadArray(r io.Reader, modified time.Time, interval time.Duration) (Track, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, fmt.Errorf("failed to decode log: %w", err)
+	}
+	track := make(Track, len(items))
+	increasing := len(items) > 1
+	for i, item := range items {
+		var probe struct {
+			ReceivedTime int64 `json:"received_time"`
+		}
+		if err := json.Unmarshal(item, &probe); err != nil || probe.ReceivedTime == 0 {
+			increasing = false
+		} else if i > 0 && probe.ReceivedTime < track[i-1].Time {
+			increasing = false
+		}
+		track[i] = logfile.Record{Time: probe.ReceivedTime, Data: item}
+	}
+	if increasing && track[0].Time < track[len(track)-1].Time {
+		return track, nil
+	}
+	if interval <= 0 {
+		return nil, errors.New("log has no usable received_time and no interval")
+	}
+	last := modified.UnixMilli()
+	for i := range track {
+		track[i].Time = last - int64(len(track)-1-i)*interval.Milliseconds()
+	}
+	return track, nil
+}
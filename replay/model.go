@@ -0,0 +1,60 @@
+package replay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TitechMeister/Neon/logfile"
+)
+
+// 再生速度の範囲
+const (
+	MinSpeed = 0.5
+	MaxSpeed = 20
+)
+
+// 記録したログの再生位置を全センサーで共有する時計
+// 時刻は記録時の受信時刻(Unixミリ秒)で表す
+type Controller struct {
+	// 読み込むログの場所(セッションのディレクトリ、バンドルのzip、確定したログのディレクトリ)
+	path string
+
+	mu sync.Mutex
+	// 読み込んだログ全体の最初と最後の時刻
+	start  int64
+	end    int64
+	speed  float64
+	paused bool
+	loop   bool
+	// anchorの時点での再生位置
+	position int64
+	anchor   time.Time
+	started  bool
+	// シークするたびに増える(ループで先頭に戻った回数はnowで足す)
+	seeks int64
+	// 状態が変わると閉じて作り直す
+	changed chan struct{}
+}
+
+// 再生の状態
+type Status struct {
+	Path     string  `json:"path"`
+	Speed    float64 `json:"speed"`
+	Paused   bool    `json:"paused"`
+	Loop     bool    `json:"loop"`
+	Start    int64   `json:"start"`
+	End      int64   `json:"end"`
+	Position int64   `json:"position"`
+	// 0から1までの進み具合
+	Progress float64 `json:"progress"`
+}
+
+// 1センサー分のログを再生するデータ源
+type Source[T any] struct {
+	controller *Controller
+	times      []int64
+	data       []T
+}
+
+// 読み込んだ1センサー分のログ
+type Track = []logfile.Record
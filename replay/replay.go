@@ -0,0 +1,235 @@
+package replay
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 新しい再生の時計を返す
+// Startを呼ぶまでは先頭で止まっている
+func NewController(path string, speed float64, loop bool) *Controller {
+	return &Controller{
+		path:    path,
+		start:   math.MaxInt64,
+		end:     math.MinInt64,
+		speed:   speed,
+		loop:    loop,
+		changed: make(chan struct{}),
+	}
+}
+
+// 読み込むログの場所を返す
+func (c *Controller) Path() string {
+	return c.path
+}
+
+// 読み込んだログの時刻の範囲を全体の範囲に加える
+func (c *Controller) addRange(first, last int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.start = min(c.start, first)
+	c.end = max(c.end, last)
+	c.position = c.start
+}
+
+// 先頭から再生を始める
+// すべてのセンサーのログを読み込んでから呼ぶ
+func (c *Controller) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.start > c.end {
+		return
+	}
+	c.started = true
+	c.position = c.start
+	c.anchor = time.Now()
+	c.notify()
+}
+
+func (c *Controller) Play() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebase(time.Now())
+	c.paused = false
+	c.notify()
+}
+
+func (c *Controller) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebase(time.Now())
+	c.paused = true
+	c.notify()
+}
+
+// 再生位置をpositionに移す(範囲外なら端に寄せる)
+func (c *Controller) SeekTo(position int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebase(time.Now())
+	c.position = min(max(position, c.start), c.end)
+	c.seeks++
+	c.notify()
+}
+
+func (c *Controller) SetSpeed(speed float64) error {
+	if speed < MinSpeed || speed > MaxSpeed {
+		return fmt.Errorf("speed must be between %v and %v", MinSpeed, MaxSpeed)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebase(time.Now())
+	c.speed = speed
+	c.notify()
+	return nil
+}
+
+func (c *Controller) SetLoop(loop bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebase(time.Now())
+	c.loop = loop
+	c.notify()
+}
+
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := Status{Path: c.path, Speed: c.speed, Paused: c.paused, Loop: c.loop}
+	if c.start > c.end {
+		return st
+	}
+	now, _ := c.now(time.Now())
+	st.Start, st.End, st.Position = c.start, c.end, min(now, c.end)
+	if c.end > c.start {
+		st.Progress = float64(st.Position-c.start) / float64(c.end-c.start)
+	}
+	return st
+}
+
+// ソースが次にすべきことを決めるための時計の状態
+type clock struct {
+	now int64
+	// シークやループで位置が飛ぶたびに変わる
+	epoch  int64
+	speed  float64
+	paused bool
+	// ループするなら先頭に戻る時刻、しないなら0
+	wrapAt  int64
+	changed <-chan struct{}
+}
+
+func (c *Controller) clock() clock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now, wraps := c.now(time.Now())
+	cl := clock{now: now, epoch: c.seeks + wraps, speed: c.speed, paused: c.paused || !c.started, changed: c.changed}
+	if c.loop {
+		cl.wrapAt = c.end + 1
+	}
+	return cl
+}
+
+// muを取った状態で呼ぶ
+// 現在の再生位置と、anchorから先頭に戻った回数を返す
+func (c *Controller) now(t time.Time) (int64, int64) {
+	if !c.started || c.paused {
+		return c.position, 0
+	}
+	v := c.position + int64(float64(t.Sub(c.anchor).Milliseconds())*c.speed)
+	if !c.loop || v <= c.end {
+		return v, 0
+	}
+	span := c.end - c.start + 1
+	return c.start + (v-c.start)%span, (v - c.start) / span
+}
+
+// muを取った状態で呼ぶ
+// 現在の位置を基準にし直す(速度や一時停止を変える前に呼ぶ)
+func (c *Controller) rebase(t time.Time) {
+	v, wraps := c.now(t)
+	c.position = min(v, max(c.end, c.start))
+	c.anchor = t
+	c.seeks += wraps
+}
+
+// muを取った状態で呼ぶ
+func (c *Controller) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// 再生操作のルーティングを設定する
+func (c *Controller) RegisterRoutes(e *echo.Echo) {
+	e.GET("/replay", c.GetStatus)
+	e.POST("/replay/play", c.PostPlay)
+	e.POST("/replay/pause", c.PostPause)
+	e.POST("/replay/seek", c.PostSeek)
+	e.POST("/replay/speed", c.PostSpeed)
+	e.POST("/replay/loop", c.PostLoop)
+}
+
+func (c *Controller) GetStatus(ctx echo.Context) error {
+	return ctx.JSON(http.StatusOK, c.Status())
+}
+
+func (c *Controller) PostPlay(ctx echo.Context) error {
+	c.Play()
+	return ctx.JSON(http.StatusOK, c.Status())
+}
+
+func (c *Controller) PostPause(ctx echo.Context) error {
+	c.Pause()
+	return ctx.JSON(http.StatusOK, c.Status())
+}
+
+// to (Unixミリ秒かRFC3339) か offset (先頭からの時間 e.g. "90s") の位置に移る
+func (c *Controller) PostSeek(ctx echo.Context) error {
+	to, offset := ctx.QueryParam("to"), ctx.QueryParam("offset")
+	switch {
+	case to != "":
+		if ms, err := strconv.ParseInt(to, 10, 64); err == nil {
+			c.SeekTo(ms)
+		} else if t, err := time.Parse(time.RFC3339Nano, to); err == nil {
+			c.SeekTo(t.UnixMilli())
+		} else {
+			return ctx.String(http.StatusBadRequest, fmt.Sprintf("Invalid to: %v", to))
+		}
+	case offset != "":
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, fmt.Sprintf("Invalid offset: %v", err))
+		}
+		c.SeekTo(c.Status().Start + d.Milliseconds())
+	default:
+		return ctx.String(http.StatusBadRequest, "to or offset is required")
+	}
+	return ctx.JSON(http.StatusOK, c.Status())
+}
+
+// value の速度にする
+func (c *Controller) PostSpeed(ctx echo.Context) error {
+	speed, err := strconv.ParseFloat(ctx.QueryParam("value"), 64)
+	if err != nil {
+		return ctx.String(http.StatusBadRequest, "value must be a number")
+	}
+	if err := c.SetSpeed(speed); err != nil {
+		return ctx.String(http.StatusBadRequest, err.Error())
+	}
+	return ctx.JSON(http.StatusOK, c.Status())
+}
+
+// enabled (true/false) でループを切り替える
+func (c *Controller) PostLoop(ctx echo.Context) error {
+	loop, err := strconv.ParseBool(ctx.QueryParam("enabled"))
+	if err != nil {
+		return ctx.String(http.StatusBadRequest, "enabled must be true or false")
+	}
+	c.SetLoop(loop)
+	return ctx.JSON(http.StatusOK, c.Status())
+}
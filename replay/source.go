@@ -0,0 +1,83 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/TitechMeister/Neon/source"
+)
+
+// 読み込んだログからデータ源を作り、時刻の範囲をcontrollerに登録する
+func NewSource[T any](controller *Controller, track Track) (*Source[T], error) {
+	s := &Source[T]{controller: controller}
+	for _, rec := range track {
+		var data T
+		if err := json.Unmarshal(rec.Data, &data); err != nil {
+			continue
+		}
+		s.times = append(s.times, rec.Time)
+		s.data = append(s.data, data)
+	}
+	if len(s.data) == 0 {
+		return nil, errors.New("log has no data to replay")
+	}
+	// 受信順に並んでいなくても時刻順に流す
+	sort.Stable(byTime[T]{s})
+	controller.addRange(s.times[0], s.times[len(s.times)-1])
+	return s, nil
+}
+
+// 再生位置に合わせて、記録したときの間隔でデータを流す
+func (s *Source[T]) Run(ctx context.Context, sink source.Sink[T]) error {
+	i := 0
+	epoch := int64(-1)
+	for {
+		cl := s.controller.clock()
+		// シークやループで位置が飛んだら探し直す
+		if cl.epoch != epoch {
+			epoch = cl.epoch
+			i = sort.Search(len(s.times), func(j int) bool { return s.times[j] >= cl.now })
+		}
+		for i < len(s.times) && s.times[i] <= cl.now {
+			sink.Emit(s.data[i])
+			i++
+		}
+
+		// 次のデータ(最後まで流したらループで先頭に戻る時刻)まで待つ
+		var timer *time.Timer
+		var fire <-chan time.Time
+		next := int64(0)
+		if i < len(s.times) {
+			next = s.times[i]
+		} else if cl.wrapAt != 0 {
+			next = cl.wrapAt
+		}
+		if !cl.paused && next != 0 {
+			timer = time.NewTimer(time.Duration(float64(next-cl.now) / cl.speed * float64(time.Millisecond)))
+			fire = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-cl.changed:
+		case <-fire:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+type byTime[T any] struct{ s *Source[T] }
+
+func (b byTime[T]) Len() int           { return len(b.s.times) }
+func (b byTime[T]) Less(i, j int) bool { return b.s.times[i] < b.s.times[j] }
+func (b byTime[T]) Swap(i, j int) {
+	b.s.times[i], b.s.times[j] = b.s.times[j], b.s.times[i]
+	b.s.data[i], b.s.data[j] = b.s.data[j], b.s.data[i]
+}
@@ -0,0 +1,67 @@
+package sensor
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+)
+
+// UI用のデータに足すフィールド
+type field struct {
+	name  string
+	value any
+}
+
+// 受け取ったデータの時刻を時計の推定に加え、3つの時刻を返す
+func (s *Sensor[Raw, UI]) observeClock(data Raw, ingest time.Time) clock.Timestamps {
+	if s.config.Clock == nil {
+		return clock.Timestamps{Ingest: ingest.UnixMilli()}
+	}
+	return s.clock.Observe(s.config.Clock(data), ingest)
+}
+
+// 過去のデータの3つの時刻を今の推定で返す
+func (s *Sensor[Raw, UI]) stampClock(data Raw, ingest time.Time) clock.Timestamps {
+	if s.config.Clock == nil {
+		return clock.Timestamps{Ingest: ingest.UnixMilli()}
+	}
+	return s.clock.Stamp(s.config.Clock(data), ingest)
+}
+
+// デバイスごとの時計の推定結果を返す
+func (s *Sensor[Raw, UI]) ClockStatus() []clock.DeviceStatus {
+	return s.clock.Status()
+}
+
+// UI用のデータのJSONオブジェクトの末尾にフィールドを足す
+// UIが読んでいる既存のフィールドの形と順番は変えない
+func withFields(ui any, fields ...field) ([]byte, error) {
+	payload, err := json.Marshal(ui)
+	if err != nil {
+		return nil, err
+	}
+	payload = bytes.TrimSpace(payload)
+	if len(payload) < 2 || payload[0] != '{' {
+		// オブジェクトでなければそのまま返す
+		return payload, nil
+	}
+	var buf bytes.Buffer
+	buf.Write(payload[:len(payload)-1])
+	for i, f := range fields {
+		if i > 0 || len(payload) > 2 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(f.name)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
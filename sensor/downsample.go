@@ -0,0 +1,47 @@
+package sensor
+
+import "time"
+
+// 時刻をstep幅の区間に分け、各区間の代表だけを残す(min/maxバケット)
+// valueがあれば区間内で最小と最大のデータを時刻順に残し、なければ区間の先頭を残す
+// 区間は絶対時刻で区切るので、ページを分けて問い合わせても同じ結果になる
+func downsample[T any](samples []Sample[T], step time.Duration, value func(T) float64) []Sample[T] {
+	stepMs := step.Milliseconds()
+	if stepMs <= 0 || len(samples) == 0 {
+		return samples
+	}
+	out := []Sample[T]{}
+	for start := 0; start < len(samples); {
+		bucket := samples[start].Time.UnixMilli() / stepMs
+		end := start + 1
+		for end < len(samples) && samples[end].Time.UnixMilli()/stepMs == bucket {
+			end++
+		}
+		if value == nil {
+			out = append(out, samples[start])
+			start = end
+			continue
+		}
+
+		lo, hi := start, start
+		for i := start + 1; i < end; i++ {
+			v := value(samples[i].Data)
+			if v < value(samples[lo].Data) {
+				lo = i
+			}
+			if v > value(samples[hi].Data) {
+				hi = i
+			}
+		}
+		switch {
+		case lo == hi:
+			out = append(out, samples[lo])
+		case lo < hi:
+			out = append(out, samples[lo], samples[hi])
+		default:
+			out = append(out, samples[hi], samples[lo])
+		}
+		start = end
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package sensor
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// 時間範囲のデータを確定したログと同じJSON配列の形式で返す
+// from, to, session はhistoryと同じ
+func (s *Sensor[Raw, UI]) GetExport(c echo.Context) error {
+	q, err := parseRangeQuery(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid export query: %v", err))
+	}
+	samples, err := s.query(q)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error reading %s data: %v", s.config.Name, err))
+	}
+	data := make([]Raw, len(samples))
+	for i, sample := range samples {
+		data[i] = sample.Data
+	}
+
+	name := fmt.Sprintf("%s_log_%d_%d.json", s.config.Name, q.from.UnixMilli(), q.to.UnixMilli())
+	if q.session != nil {
+		name = fmt.Sprintf("%s_log_%s.json", s.config.Name, *q.session)
+	}
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	return c.JSON(http.StatusOK, data)
+}
+
+// 時間範囲のデータの件数・頻度・代表値の最小/最大/平均を返す
+// from, to, session はhistoryと同じ
+func (s *Sensor[Raw, UI]) GetStats(c echo.Context) error {
+	q, err := parseRangeQuery(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid stats query: %v", err))
+	}
+	samples, err := s.query(q)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error reading %s data: %v", s.config.Name, err))
+	}
+	return c.JSON(http.StatusOK, s.stats(samples, q.session))
+}
+
+func (s *Sensor[Raw, UI]) stats(samples []Sample[Raw], session *string) Stats {
+	stats := Stats{Sensor: s.config.Name, Session: session, Count: len(samples)}
+	if len(samples) == 0 {
+		return stats
+	}
+	first, last := samples[0].Time, samples[len(samples)-1].Time
+	stats.First, stats.Last = first.UnixMilli(), last.UnixMilli()
+	if span := last.Sub(first).Seconds(); span > 0 {
+		stats.RateHz = float64(len(samples)-1) / span
+	}
+	if s.config.Value == nil {
+		return stats
+	}
+	// NaNや無限大はJSONにできないので集計から外す
+	var minValue, maxValue, sum float64
+	n := 0
+	for _, sample := range samples {
+		v := s.config.Value(sample.Data)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		if n == 0 {
+			minValue, maxValue = v, v
+		}
+		minValue, maxValue = min(minValue, v), max(maxValue, v)
+		sum += v
+		n++
+	}
+	if n > 0 {
+		mean := sum / float64(n)
+		stats.Min, stats.Max, stats.Mean = &minValue, &maxValue, &mean
+	}
+	return stats
+}
@@ -0,0 +1,69 @@
+package sensor
+
+import "sync"
+
+// 複数のgoroutineから安全に読み書きできるデータ履歴
+// ロガーのgoroutineが追記し、Echoのハンドラがスナップショットを読む
+type History[T any] struct {
+	mu   sync.RWMutex
+	data []T
+}
+
+// 新しい空の履歴を返す
+func NewHistory[T any]() *History[T] {
+	return &History[T]{data: []T{}}
+}
+
+// データを追記する
+// 件数がlimitを超えたら古いデータを切り出し、最新keep件だけを残す
+// 切り出したデータを返す(ファイルへの書き出し用)
+func (h *History[T]) Append(v T, limit, keep int) []T {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.data = append(h.data, v)
+	if len(h.data) <= limit {
+		return nil
+	}
+	overflow := len(h.data) - keep
+	removed := make([]T, overflow)
+	copy(removed, h.data[:overflow])
+	// 古い配列を参照し続けないように詰め直す
+	h.data = append(make([]T, 0, limit+1), h.data[overflow:]...)
+	return removed
+}
+
+// 現在の履歴のコピーを返す
+func (h *History[T]) Snapshot() []T {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	snapshot := make([]T, len(h.data))
+	copy(snapshot, h.data)
+	return snapshot
+}
+
+// 最新のデータを返す
+func (h *History[T]) Latest() (T, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.data) == 0 {
+		var zero T
+		return zero, false
+	}
+	return h.data[len(h.data)-1], true
+}
+
+// 履歴の件数を返す
+func (h *History[T]) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.data)
+}
+
+// 履歴をすべて取り出して空にする
+func (h *History[T]) Drain() []T {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	drained := h.data
+	h.data = []T{}
+	return drained
+}
@@ -0,0 +1,15 @@
+package sensor
+
+import (
+	"github.com/TitechMeister/Neon/metrics"
+)
+
+// センサーの指標
+var (
+	samplesTotal = metrics.NewCounterVec("neon_sensor_samples_total",
+		"Samples accepted into the sensor history.", "sensor")
+	errorsTotal = metrics.NewCounterVec("neon_sensor_errors_total",
+		"Failures to get sensor data, by kind (timeout, unreachable, status, circuit_open, decode or fetch).", "sensor", "kind")
+	historySize = metrics.NewGaugeVec("neon_sensor_history_size",
+		"Samples kept in memory for each sensor.", "sensor")
+)
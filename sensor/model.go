@@ -0,0 +1,196 @@
+package sensor
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/TitechMeister/Neon/fault"
+	"github.com/TitechMeister/Neon/health"
+	"github.com/TitechMeister/Neon/logfile"
+	"github.com/TitechMeister/Neon/replay"
+	"github.com/TitechMeister/Neon/serial"
+	"github.com/TitechMeister/Neon/simulator"
+	"github.com/TitechMeister/Neon/source"
+	"github.com/TitechMeister/Neon/stream"
+	"github.com/TitechMeister/Neon/tsdb"
+	"github.com/TitechMeister/Neon/upstream"
+)
+
+// センサーごとに異なる部分をまとめた設定
+// センサーのパッケージは生データ型・UI用整形関数・serialサーバのパス・モック生成関数だけを宣言する
+type Config[Raw, UI any] struct {
+	// センサーの名前(ルーティングやログファイル名に使う)
+	Name string
+	// エラーメッセージに使う表示名
+	Label string
+	// serialサーバ上のパス e.g. "/data/gps"
+	UpstreamPath string
+	// 生データをUI用データに変換する
+	Format func(Raw) UI
+	// モックモードで使うデータをシミュレータの機体の状態から生成する
+	Mock func(simulator.State) Raw
+	// 履歴を間引くときに極値を残す代表値(nilなら各区間の先頭を残す)
+	Value func(Raw) float64
+	// データに含まれるデバイスの時計とserialサーバの受信時刻(nilならNeonの受信時刻だけを使う)
+	Clock func(Raw) clock.Reading
+	// デバイスの時計の単位と一周の長さ
+	DeviceClock clock.Spec
+	// シリアルで受け取るパケットの種類と、ペイロードを生データにする関数(nilならシリアルでは受け取れない)
+	Packet byte
+	Decode func(payload []byte, received time.Time) (Raw, error)
+}
+
+// 受信時刻付きのデータ
+type Sample[T any] struct {
+	// Neonがデータを受け取った時刻
+	Time time.Time
+	Data T
+	// デバイス・serialサーバ・Neonの時刻
+	Clock clock.Timestamps
+}
+
+// 時間範囲を指定した履歴の問い合わせ結果
+type HistoryPage[T any] struct {
+	Sensor string `json:"sensor"`
+	// 問い合わせた範囲(Unixミリ秒)
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+	// 間引きの区間幅(ミリ秒、0なら間引きなし)
+	Step int64 `json:"step"`
+	// このページの先頭(from, skip)からtoまでに残っている(間引いた後の)件数
+	// このページで返す分も含む。最初のページなら範囲内の件数になる
+	Remaining int `json:"remaining"`
+	// 続きがあるときの次のfrom(Unixミリ秒)とskip
+	// nextと同じ時刻のデータのうちnext_skip件はこのページで返している
+	Next     *int64 `json:"next"`
+	NextSkip int    `json:"next_skip,omitempty"`
+	// 受信時刻付きのデータ
+	Samples []HistorySample[T] `json:"samples"`
+}
+
+type HistorySample[T any] struct {
+	// 受信時刻(Unixミリ秒)
+	Time int64 `json:"t"`
+	Data T     `json:"data"`
+	// デバイス・serialサーバ・Neonの時刻
+	Timestamps clock.Timestamps `json:"timestamps"`
+}
+
+// 設定ファイルから与えられるセンサーの動作設定
+type Options struct {
+	// ログ更新周波数
+	LogFrequency int
+	// serialサーバのベースURL e.g. "http://localhost:7878"
+	UpstreamURL string
+	// serialサーバ上のパス(空ならConfigの値を使う)
+	UpstreamPath string
+	// 全センサーで共有するserialサーバのクライアント(nilならUpstreamURLから作る)
+	Upstream *upstream.Client
+	// serialサーバからまとめて取得する(nilならセンサーごとに取得する)
+	Batch *source.Scheduler
+	// ログのアップロード先のバケット名
+	Bucket string
+	// 確定したログの保存先
+	LogDir string
+	// 確定したUI用ログの保存先
+	UILogDir string
+	// 一時ログファイルの保存先
+	TempDir string
+	// 履歴がこの件数を超えたら一時ログファイルに書き出す
+	HistoryLimit int
+	// 書き出した後にメモリ上に残す件数
+	HistoryKeep int
+	// 一時ログファイルの書き込み方針
+	Writer logfile.Policy
+	// 受け取ったデータを書き込む時系列ストア(nilなら書き込まない)
+	Store *tsdb.Store
+	// データ源の種類 "http", "mock", "replay"
+	Source string
+	// ログ再生の時計(Sourceが"replay"のときに使う)
+	Replay *replay.Controller
+	// モックデータの元になる機体の状態(Sourceが"mock"のときに使う)
+	Simulator *simulator.Simulator
+	// データ源に故障を起こす(nilなら起こさない)
+	Faults *fault.Injector
+	// 受け取ったデータをライブ配信する(nilなら配信しない)
+	Stream *stream.Hub
+	// シリアルデバイス(Sourceが"serial"のときに使う)
+	Serial *serial.Port
+}
+
+// 汎用センサーのクラス
+type Sensor[Raw, UI any] struct {
+	// データの履歴
+	DataHistory *History[Sample[Raw]] `json:"-"`
+	// serialサーバのクライアント
+	Client *upstream.Client `json:"-"`
+	// ログ更新周波数
+	LogFrequency int `json:"log_frequency"` // Frequency of logging data in a second
+
+	config  Config[Raw, UI]
+	options Options
+	// 履歴への追加とログの確定処理を直列化する
+	logMu sync.Mutex
+	// 記録中のフライトセッションのID(logMuで保護)
+	session string
+	// 一時ログファイルのライター
+	logWriter *logfile.Writer
+	// UI用一時ログファイルのライター
+	uiLogWriter *logfile.Writer
+	// データ源
+	source source.Source[Raw]
+	// データ源が失敗し続けているか(最初の失敗だけ表示する)
+	failing atomic.Bool
+	// デバイスの時計の推定
+	clock *clock.Tracker
+	// データの受け取りと失敗の記録
+	health *health.Monitor
+	// 押し込まれたデータの重複を見分ける
+	pushed *dedup
+	// センサーを作った時刻(セッション外の問い合わせはこれより後のデータだけを返す)
+	started time.Time
+}
+
+// 最近押し込まれたデータの鍵を覚えておく
+// 古い鍵から順に忘れる
+type dedup struct {
+	mu sync.Mutex
+	// 覚えている鍵と、そのリングバッファ上の位置
+	seen map[dedupKey]int
+	// 覚えた順の鍵(リングバッファ)
+	order []dedupKey
+	next  int
+}
+
+// データを見分ける鍵
+// 秒単位の時計では同じ時刻に複数のデータがあるので、内容のハッシュも含める
+type dedupKey struct {
+	deviceID uint8
+	device   uint64
+	hash     uint64
+}
+
+// 時間範囲のデータの集計
+type Stats struct {
+	Sensor  string  `json:"sensor"`
+	Session *string `json:"session,omitempty"`
+	Count   int     `json:"count"`
+	// 最初と最後のデータの受信時刻(Unixミリ秒)
+	First int64 `json:"first,omitempty"`
+	Last  int64 `json:"last,omitempty"`
+	// 実際に受け取れた頻度
+	RateHz float64 `json:"rate_hz"`
+	// 代表値の集計(代表値のないセンサーでは省略)
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+	Mean *float64 `json:"mean,omitempty"`
+}
+
+type DLlink struct {
+	// Download link for the sensor data
+	DownloadLink string `json:"download_link"`
+	// Timestamp of the download link creation
+	Timestamp time.Time `json:"timestamp"`
+}
@@ -0,0 +1,127 @@
+package sensor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/TitechMeister/Neon/source"
+)
+
+// センサーごとに覚えておく押し込まれたデータの鍵の数
+const dedupSize = 4096
+
+// serialサーバの受信時刻のフィールド名
+const upstreamTimeField = "received_time"
+
+// データ源が"push"でないセンサーに押し込まれたときに返すエラー
+var ErrNotPush = errors.New("sensor does not accept pushed data")
+
+// 押し込まれたデータを1件受け取って履歴に追加する
+// デバイスIDとデバイスの時刻が同じデータをすでに受け取っていれば追加せずduplicateを返す
+func (s *Sensor[Raw, UI]) Push(payload json.RawMessage) (duplicate bool, err error) {
+	if s.options.Source != source.KindPush {
+		return false, fmt.Errorf("%w: %s source is %q", ErrNotPush, s.config.Name, s.options.Source)
+	}
+	var data Raw
+	if err := json.Unmarshal(payload, &data); err != nil {
+		err = fmt.Errorf("%w: invalid %s data: %v", source.ErrDecode, s.config.Name, err)
+		s.Fail(err)
+		return false, err
+	}
+	key, err := s.dedupKey(data)
+	if err != nil {
+		s.Fail(err)
+		return false, err
+	}
+	if !s.pushed.add(key) {
+		return true, nil
+	}
+	if err := s.accept(data); err != nil {
+		// 受け取れなかったデータは送り直せるようにする
+		s.pushed.forget(key)
+		return false, err
+	}
+	return false, nil
+}
+
+// データを見分ける鍵を返す
+// 1秒より細かいデバイスの時計があれば、デバイスIDと時計の値だけで見分ける
+// 時計がないか秒単位なら、serialサーバの受信時刻を除いた内容のハッシュも使う
+func (s *Sensor[Raw, UI]) dedupKey(data Raw) (dedupKey, error) {
+	var key dedupKey
+	if s.config.Clock != nil {
+		reading := s.config.Clock(data)
+		key.deviceID = reading.DeviceID
+		if reading.HasDevice {
+			key.device = reading.Device
+			if unit := s.config.DeviceClock.Unit; unit > 0 && unit < time.Second {
+				return key, nil
+			}
+		}
+	}
+	hash, err := contentHash(data)
+	if err != nil {
+		return dedupKey{}, fmt.Errorf("%w: invalid %s data: %v", source.ErrDecode, s.config.Name, err)
+	}
+	key.hash = hash
+	return key, nil
+}
+
+// serialサーバの受信時刻を除いた内容のハッシュを返す
+// 送り手ごとの空白や順番の違いを無視するため、デコードしたデータを書き直してハッシュする
+func contentHash(data any) (uint64, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(payload, &fields) == nil {
+		// 送り直すと付け直される受信時刻は内容に含めない
+		delete(fields, upstreamTimeField)
+		if payload, err = json.Marshal(fields); err != nil {
+			return 0, err
+		}
+	}
+	h := fnv.New64a()
+	h.Write(payload)
+	return h.Sum64(), nil
+}
+
+func newDedup(size int) *dedup {
+	return &dedup{seen: map[dedupKey]int{}, order: make([]dedupKey, 0, size)}
+}
+
+// 鍵を覚える
+// すでに覚えていればfalse
+func (d *dedup) add(key dedupKey) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[key]; ok {
+		return false
+	}
+	if len(d.order) < cap(d.order) {
+		d.order = append(d.order, key)
+		d.seen[key] = len(d.order) - 1
+		return true
+	}
+	// いっぱいなら一番古い鍵を忘れる
+	// 忘れた後に覚え直した鍵は別の位置にあるので、古い位置の鍵では消さない
+	if slot, ok := d.seen[d.order[d.next]]; ok && slot == d.next {
+		delete(d.seen, d.order[d.next])
+	}
+	d.order[d.next] = key
+	d.seen[key] = d.next
+	d.next = (d.next + 1) % len(d.order)
+	return true
+}
+
+// 鍵を忘れる
+// リングバッファの位置は、次に上書きされるまで空けておく
+func (d *dedup) forget(key dedupKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, key)
+}
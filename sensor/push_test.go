@@ -0,0 +1,114 @@
+package sensor
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/TitechMeister/Neon/source"
+)
+
+// 同じデータを2回押し込むと、1回目だけを受け取り2回目は重複になる
+func TestPushDuplicate(t *testing.T) {
+	s := newTestSensor(t, Options{})
+	for i, payload := range []string{
+		`{"id":1,"value":2.5,"timestamp":3}`,
+		// 空白や順番が違っても同じデータ
+		`{"timestamp": 3, "value": 2.5, "id": 1}`,
+	} {
+		duplicate, err := s.Push(json.RawMessage(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duplicate != (i > 0) {
+			t.Errorf("push %d: duplicate = %v", i, duplicate)
+		}
+	}
+	if n := s.DataHistory.Len(); n != 1 {
+		t.Fatalf("history has %d items, want 1", n)
+	}
+}
+
+// serialサーバが受信時刻を付け直して送り直したデータも重複になる
+func TestPushDuplicateWithNewReceivedTime(t *testing.T) {
+	tests := []struct {
+		name string
+		unit time.Duration
+		// 2回目に押し込むデータと、それが重複になるか
+		second    string
+		duplicate bool
+	}{
+		{"millisecond clock", time.Millisecond, `{"id":1,"value":2.5,"timestamp":3,"received_time":2000}`, true},
+		// 1秒より細かい時計ならデバイスIDと時刻だけで見分ける
+		{"millisecond clock with other content", time.Millisecond, `{"id":1,"value":9,"timestamp":3,"received_time":2000}`, true},
+		{"second clock", time.Second, `{"id":1,"value":2.5,"timestamp":3,"received_time":2000}`, true},
+		// 秒単位の時計では同じ時刻の別のデータがある
+		{"second clock with other content", time.Second, `{"id":1,"value":9,"timestamp":3,"received_time":2000}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSensor(t, Options{})
+			s.config.DeviceClock.Unit = tt.unit
+			if duplicate, err := s.Push(json.RawMessage(`{"id":1,"value":2.5,"timestamp":3,"received_time":1000}`)); err != nil || duplicate {
+				t.Fatalf("first push: duplicate = %v, err = %v", duplicate, err)
+			}
+			duplicate, err := s.Push(json.RawMessage(tt.second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if duplicate != tt.duplicate {
+				t.Errorf("duplicate = %v, want %v", duplicate, tt.duplicate)
+			}
+		})
+	}
+}
+
+// 受け取りに失敗したデータは、送り直せば受け取る
+func TestPushRetryAfterFailedAccept(t *testing.T) {
+	s := newTestSensor(t, Options{})
+	fail := true
+	s.config.Format = func(d testData) testUI {
+		if fail {
+			// JSONにできないので受け取りに失敗する
+			return testUI{Value: math.NaN()}
+		}
+		return testUI{Value: d.Value}
+	}
+	payload := json.RawMessage(`{"id":1,"value":2.5,"timestamp":3}`)
+
+	duplicate, err := s.Push(payload)
+	if !errors.Is(err, source.ErrDecode) || duplicate {
+		t.Fatalf("first push: duplicate = %v, err = %v, want a decode error", duplicate, err)
+	}
+	fail = false
+	if duplicate, err := s.Push(payload); err != nil || duplicate {
+		t.Fatalf("retry: duplicate = %v, err = %v, want accepted", duplicate, err)
+	}
+	if duplicate, err := s.Push(payload); err != nil || !duplicate {
+		t.Fatalf("second retry: duplicate = %v, err = %v, want a duplicate", duplicate, err)
+	}
+	if n := s.DataHistory.Len(); n != 1 {
+		t.Fatalf("history has %d items, want 1", n)
+	}
+}
+
+// 忘れてから覚え直した鍵は、リングバッファに残った古い位置が上書きされても忘れない
+func TestDedupForgetKeepsRelearnedKey(t *testing.T) {
+	d := newDedup(2)
+	a, b := dedupKey{hash: 1}, dedupKey{hash: 2}
+	d.add(a)
+	d.forget(a)
+	if !d.add(a) {
+		t.Fatal("forgotten key was not added again")
+	}
+	// 満杯なので、aが最初にあった位置をbで上書きする
+	d.add(b)
+	if d.add(a) {
+		t.Fatal("relearned key was evicted by its stale ring entry")
+	}
+	if d.add(b) {
+		t.Fatal("b was forgotten")
+	}
+}
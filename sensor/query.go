@@ -0,0 +1,276 @@
+package sensor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/TitechMeister/Neon/frame"
+	"github.com/TitechMeister/Neon/logfile"
+	"github.com/TitechMeister/Neon/tsdb"
+	"github.com/labstack/echo"
+)
+
+const (
+	// 1ページの既定の件数
+	defaultHistoryLimit = 1000
+	// 1ページの最大件数
+	maxHistoryLimit = 10000
+)
+
+// 履歴の問い合わせ条件
+type historyQuery struct {
+	from  time.Time
+	to    time.Time
+	limit int
+	// fromと同じ受信時刻のデータのうち、前のページで返した件数
+	skip int
+	step time.Duration
+	// 指定されたセッションのID("all"なら全セッション、nilなら現在のセッション)
+	session *string
+}
+
+// 全セッションを対象にするときのsessionパラメータの値
+const allSessions = "all"
+
+// 現在のデータ履歴を取得する
+// from, to, limit, step のいずれかを指定すると、現在のセッションのログも含めて時間範囲で問い合わせる
+//   - from, to: Unixミリ秒かRFC3339 (省略時は全範囲)
+//   - limit: 1ページの件数 (続きはレスポンスのnextをfrom、next_skipをskipに指定して取得する)
+//   - skip: fromと同じ受信時刻のデータのうち読み飛ばす件数
+//   - step: 間引きの区間幅 (ミリ秒か "500ms" のような時間)
+//   - session: セッションID ("all"なら全セッション、省略時は現在のセッション)
+//
+// セッション外の「現在のセッション」は、このNeonを起動してから受け取ったセッション外のデータ
+func (s *Sensor[Raw, UI]) GetHistory(c echo.Context) error {
+	q, err := parseHistoryQuery(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid history query: %v", err))
+	}
+	if q == nil {
+		// 条件がなければこれまで通りメモリ上の履歴を返す
+		snapshot := s.DataHistory.Snapshot()
+		data := make([]Raw, len(snapshot))
+		for i, sample := range snapshot {
+			data[i] = sample.Data
+		}
+		return c.JSON(http.StatusOK, data)
+	}
+
+	// 間引くときはfromを含む区間の先頭から読み、ページの境目で区間が割れないようにする
+	rq := *q
+	if stepMs := q.step.Milliseconds(); stepMs > 0 {
+		rq.from = time.UnixMilli(q.from.UnixMilli() / stepMs * stepMs)
+	}
+	samples, err := s.query(&rq)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error reading %s history: %v", s.config.Name, err))
+	}
+	samples = afterCursor(downsample(samples, q.step, s.config.Value), q.from.UnixMilli(), q.skip)
+
+	page := HistoryPage[Raw]{
+		Sensor:    s.config.Name,
+		From:      q.from.UnixMilli(),
+		To:        q.to.UnixMilli(),
+		Step:      q.step.Milliseconds(),
+		Remaining: len(samples),
+		Samples:   []HistorySample[Raw]{},
+	}
+	if len(samples) > q.limit {
+		// 次のページは(時刻, その時刻で読み飛ばす件数)のカーソルから始める
+		next := samples[q.limit].Time.UnixMilli()
+		page.Next = &next
+		for i := q.limit - 1; i >= 0 && samples[i].Time.UnixMilli() == next; i-- {
+			page.NextSkip++
+		}
+		if next == q.from.UnixMilli() {
+			page.NextSkip += q.skip
+		}
+		samples = samples[:q.limit]
+	}
+	for _, sample := range samples {
+		page.Samples = append(page.Samples, HistorySample[Raw]{Time: sample.Time.UnixMilli(), Data: sample.Data, Timestamps: sample.Clock})
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// 受信時刻(Unixミリ秒)がfromより前のデータと、fromと同じ時刻のデータのうち先頭のskip件を除く
+func afterCursor[T any](samples []Sample[T], from int64, skip int) []Sample[T] {
+	i := 0
+	for i < len(samples) && samples[i].Time.UnixMilli() < from {
+		i++
+	}
+	for n := 0; n < skip && i < len(samples) && samples[i].Time.UnixMilli() == from; n++ {
+		i++
+	}
+	return samples[i:]
+}
+
+// 受信時刻がfrom以上to以下の現在のセッションのデータを古い順に返す
+// メモリ上の履歴で足りなければ時系列ストアから読む
+// セッション外なら、前回までの実行のデータを含めないようにこのNeonを起動してからのデータだけを返す
+func (s *Sensor[Raw, UI]) SamplesBetween(from, to time.Time) ([]Sample[Raw], error) {
+	memory := s.DataHistory.Snapshot()
+	if len(memory) > 0 && !from.Before(memory[0].Time) {
+		samples := []Sample[Raw]{}
+		for _, sample := range memory {
+			if !sample.Time.Before(from) && !sample.Time.After(to) {
+				samples = append(samples, sample)
+			}
+		}
+		return samples, nil
+	}
+	s.logMu.Lock()
+	session := s.session
+	s.logMu.Unlock()
+	if session == "" && from.Before(s.started) {
+		from = s.started
+	}
+	return s.Samples(tsdb.Query{From: from, To: to, Session: session})
+}
+
+// 条件に合うデータを古い順に返す
+// 時系列ストアがなければ一時ログファイルから読む(確定済みのログは含まない)
+func (s *Sensor[Raw, UI]) Samples(q tsdb.Query) ([]Sample[Raw], error) {
+	samples := []Sample[Raw]{}
+	if s.options.Store != nil {
+		points, err := s.options.Store.Query(s.config.Name, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range points {
+			var data Raw
+			if err := json.Unmarshal(p.Payload, &data); err != nil {
+				continue
+			}
+			samples = append(samples, Sample[Raw]{Time: p.Time, Data: data, Clock: s.stampClock(data, p.Time)})
+		}
+		return samples, nil
+	}
+
+	// 書き込み待ちのレコードもファイルに出してから読む
+	if err := s.logWriter.Flush(); err != nil {
+		return nil, err
+	}
+	records, _, err := logfile.ReadRecords(s.logWriter.Path())
+	if errors.Is(err, os.ErrNotExist) {
+		return samples, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		t := time.UnixMilli(rec.Time)
+		if (!q.AllSessions && rec.Session != q.Session) || t.Before(q.From) || t.After(q.To) {
+			continue
+		}
+		var data Raw
+		if err := json.Unmarshal(rec.Data, &data); err != nil {
+			continue
+		}
+		samples = append(samples, Sample[Raw]{Time: t, Data: data, Clock: s.stampClock(data, t)})
+	}
+	return samples, nil
+}
+
+// 問い合わせ条件のセッションに応じてデータを読む
+func (s *Sensor[Raw, UI]) query(q *historyQuery) ([]Sample[Raw], error) {
+	if q.session == nil {
+		return s.SamplesBetween(q.from, q.to)
+	}
+	return s.Samples(tsdb.Query{From: q.from, To: q.to, Session: *q.session, AllSessions: *q.session == allSessions})
+}
+
+// クエリパラメータから問い合わせ条件を作る
+// 条件が何も指定されていなければnilを返す
+func parseHistoryQuery(c echo.Context) (*historyQuery, error) {
+	if len(c.QueryParams()) == 0 {
+		return nil, nil
+	}
+	return parseRangeQuery(c)
+}
+
+// クエリパラメータから問い合わせ条件を作る
+// 指定されていない条件は既定値にする
+func parseRangeQuery(c echo.Context) (*historyQuery, error) {
+	from, to, limit, skip, step := c.QueryParam("from"), c.QueryParam("to"), c.QueryParam("limit"), c.QueryParam("skip"), c.QueryParam("step")
+	q := &historyQuery{
+		from:  time.UnixMilli(0),
+		to:    time.Now(),
+		limit: defaultHistoryLimit,
+	}
+	var err error
+	if from != "" {
+		if q.from, err = parseQueryTime(from); err != nil {
+			return nil, fmt.Errorf("from: %w", err)
+		}
+	}
+	if to != "" {
+		if q.to, err = parseQueryTime(to); err != nil {
+			return nil, fmt.Errorf("to: %w", err)
+		}
+	}
+	if q.to.Before(q.from) {
+		return nil, errors.New("to must not be before from")
+	}
+	if limit != "" {
+		if q.limit, err = strconv.Atoi(limit); err != nil || q.limit <= 0 {
+			return nil, fmt.Errorf("limit must be a positive integer")
+		}
+		q.limit = min(q.limit, maxHistoryLimit)
+	}
+	if skip != "" {
+		if q.skip, err = strconv.Atoi(skip); err != nil || q.skip < 0 {
+			return nil, fmt.Errorf("skip must be a non-negative integer")
+		}
+	}
+	if step != "" {
+		if ms, err := strconv.ParseInt(step, 10, 64); err == nil {
+			q.step = time.Duration(ms) * time.Millisecond
+		} else if q.step, err = time.ParseDuration(step); err != nil {
+			return nil, fmt.Errorf("step: %w", err)
+		}
+		if q.step < 0 {
+			return nil, errors.New("step must not be negative")
+		}
+	}
+	if params := c.QueryParams(); params.Has("session") {
+		session := params.Get("session")
+		q.session = &session
+	}
+	return q, nil
+}
+
+// Unixミリ秒かRFC3339の時刻を読む
+func parseQueryTime(v string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// 最新のデータをUI用に整形して返す
+func (s *Sensor[Raw, UI]) LatestPoint() (frame.Point, bool) {
+	latest, ok := s.DataHistory.Latest()
+	if !ok {
+		return frame.Point{}, false
+	}
+	return frame.Point{Time: latest.Time, Data: s.config.Format(latest.Data), Clock: latest.Clock}, true
+}
+
+// 受信時刻がfrom以上to以下の現在のセッションのデータをUI用に整形して古い順に返す
+func (s *Sensor[Raw, UI]) Points(from, to time.Time) ([]frame.Point, error) {
+	samples, err := s.SamplesBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]frame.Point, len(samples))
+	for i, sample := range samples {
+		points[i] = frame.Point{Time: sample.Time, Data: s.config.Format(sample.Data), Clock: sample.Clock}
+	}
+	return points, nil
+}
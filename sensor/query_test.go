@@ -0,0 +1,115 @@
+package sensor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TitechMeister/Neon/tsdb"
+	"github.com/labstack/echo"
+)
+
+// 時系列ストアを持つテスト用センサーを返す
+func newStoreSensor(t *testing.T) (*Sensor[testData, testUI], *tsdb.Store) {
+	t.Helper()
+	store, err := tsdb.Open(t.TempDir(), tsdb.Options{SegmentDuration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return newTestSensor(t, Options{Store: store}), store
+}
+
+// 履歴を問い合わせてページを返す
+func getPage(t *testing.T, s *Sensor[testData, testUI], target string) HistoryPage[testData] {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+	if err := s.GetHistory(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	var page HistoryPage[testData]
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+// next と next_skip をたどって全ページを読む
+// 各ページのremainingは、そのページ以降で読む件数と同じ
+func getAllPages(t *testing.T, s *Sensor[testData, testUI], from, to int64, query string) []uint32 {
+	t.Helper()
+	ids := []uint32{}
+	skip := 0
+	remaining := []int{}
+	for range 100 {
+		page := getPage(t, s, fmt.Sprintf("/data/test/history?from=%d&to=%d&skip=%d&%s", from, to, skip, query))
+		remaining = append(remaining, len(ids)+page.Remaining)
+		for _, sample := range page.Samples {
+			ids = append(ids, sample.Data.Timestamp)
+		}
+		if page.Next == nil {
+			for i, n := range remaining {
+				if n != len(ids) {
+					t.Errorf("page %d: remaining counts %d samples in all, want %d", i, n, len(ids))
+				}
+			}
+			return ids
+		}
+		from, skip = *page.Next, page.NextSkip
+	}
+	t.Fatal("too many pages")
+	return nil
+}
+
+// 同じミリ秒に複数のデータがあっても、ページに分けて読んだ結果は1回で読んだ結果と同じ
+func TestHistoryPaging(t *testing.T) {
+	s, store := newStoreSensor(t)
+	base := time.Now().Add(time.Hour).Truncate(time.Second)
+	for i := range 60 {
+		// 1ミリ秒に3件ずつ、値はばらばら
+		data := testData{DeviceID: 1, Value: float64(i * 7 % 60), Timestamp: uint32(i)}
+		payload, _ := json.Marshal(data)
+		if err := store.Append("test", tsdb.Point{Time: base.Add(time.Duration(i/3) * time.Millisecond), Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	from, to := base.UnixMilli(), base.Add(time.Second).UnixMilli()
+
+	for _, query := range []string{"", "step=4", "step=3ms"} {
+		whole := getAllPages(t, s, from, to, "limit=10000&"+query)
+		for _, limit := range []int{1, 2, 4, 5} {
+			paged := getAllPages(t, s, from, to, fmt.Sprintf("limit=%d&%s", limit, query))
+			if fmt.Sprint(paged) != fmt.Sprint(whole) {
+				t.Errorf("%s limit=%d: paged %v, want %v", query, limit, paged, whole)
+			}
+		}
+	}
+}
+
+// セッション外の問い合わせは、前回までの実行のセッション外のデータを含めない
+func TestHistoryCurrentRun(t *testing.T) {
+	s, store := newStoreSensor(t)
+	old, _ := json.Marshal(testData{DeviceID: 1, Timestamp: 1})
+	if err := store.Append("test", tsdb.Point{Time: s.started.Add(-time.Hour), Payload: old}); err != nil {
+		t.Fatal(err)
+	}
+	current, _ := json.Marshal(testData{DeviceID: 1, Timestamp: 2})
+	if err := store.Append("test", tsdb.Point{Time: s.started.Add(time.Millisecond), Payload: current}); err != nil {
+		t.Fatal(err)
+	}
+	to := s.started.Add(time.Second).UnixMilli()
+
+	if ids := getAllPages(t, s, 0, to, "limit=10"); fmt.Sprint(ids) != "[2]" {
+		t.Errorf("current run = %v, want [2]", ids)
+	}
+	if ids := getAllPages(t, s, 0, to, "limit=10&session="); fmt.Sprint(ids) != "[1 2]" {
+		t.Errorf("all sessionless data = %v, want [1 2]", ids)
+	}
+}
@@ -0,0 +1,491 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/TitechMeister/Neon/cloudstorage"
+	"github.com/TitechMeister/Neon/fault"
+	"github.com/TitechMeister/Neon/health"
+	"github.com/TitechMeister/Neon/logfile"
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/replay"
+	"github.com/TitechMeister/Neon/serial"
+	"github.com/TitechMeister/Neon/simulator"
+	"github.com/TitechMeister/Neon/source"
+	"github.com/TitechMeister/Neon/tsdb"
+	"github.com/TitechMeister/Neon/upstream"
+	"github.com/labstack/echo"
+)
+
+var logger = logging.For("sensor")
+
+// 確定するデータがないときに返すエラー
+var ErrNoData = errors.New("no data to finalize")
+
+// 新しい汎用センサーの構造体を返す
+func New[Raw, UI any](config Config[Raw, UI], options Options) *Sensor[Raw, UI] {
+	if options.UpstreamPath != "" {
+		config.UpstreamPath = options.UpstreamPath
+	}
+	client := options.Upstream
+	if client == nil {
+		client = upstream.New(options.UpstreamURL, upstream.Options{})
+	}
+	s := &Sensor[Raw, UI]{
+		DataHistory:  NewHistory[Sample[Raw]](),
+		Client:       client,               // serialサーバのクライアントを設定
+		LogFrequency: options.LogFrequency, // ログ更新周波数を設定
+		config:       config,
+		options:      options,
+		logWriter:    logfile.NewWriter(logfile.TempName(options.TempDir, config.Name, false), options.Writer),
+		uiLogWriter:  logfile.NewWriter(logfile.TempName(options.TempDir, config.Name, true), options.Writer),
+		clock:        clock.NewTracker(config.DeviceClock),
+		health:       health.NewMonitor(options.LogFrequency, options.Source),
+		pushed:       newDedup(dedupSize),
+		started:      time.Now(),
+	}
+	s.SetSource(s.newSource(options.Source))
+	return s
+}
+
+// 設定された種類のデータ源を作る
+func (s *Sensor[Raw, UI]) newSource(kind string) source.Source[Raw] {
+	interval := time.Second / time.Duration(max(s.LogFrequency, 1))
+	switch kind {
+	case source.KindMock:
+		sim := s.options.Simulator
+		if sim == nil {
+			sim = simulator.New()
+		}
+		return source.Poll(source.Mock(func() Raw { return s.config.Mock(sim.State()) }), interval)
+	case source.KindPush:
+		return source.Idle[Raw]()
+	case source.KindSerial:
+		if s.options.Serial == nil {
+			return source.Failed[Raw](errors.New("serial device is not configured"))
+		}
+		if s.config.Decode == nil {
+			return source.Failed[Raw](fmt.Errorf("%s cannot be read from a serial device", s.config.Name))
+		}
+		return serial.Source(s.options.Serial, s.config.Packet, s.config.Decode)
+	case source.KindReplay:
+		if s.options.Replay == nil {
+			return source.Failed[Raw](errors.New("replay is not configured"))
+		}
+		track, err := replay.Load(s.options.Replay.Path(), s.config.Name, interval)
+		if err != nil {
+			return source.Failed[Raw](err)
+		}
+		src, err := replay.NewSource[Raw](s.options.Replay, track)
+		if err != nil {
+			return source.Failed[Raw](err)
+		}
+		return src
+	default:
+		if s.options.Batch != nil {
+			return source.Batched[Raw](s.options.Batch, s.config.UpstreamPath, interval)
+		}
+		return source.Poll[Raw](&source.HTTP[Raw]{
+			Client:  s.Client,
+			Path:    s.config.UpstreamPath,
+			Timeout: s.Client.Timeout(interval),
+		}, interval)
+	}
+}
+
+// データ源を差し替える
+// Runを呼ぶ前に行う
+func (s *Sensor[Raw, UI]) SetSource(src source.Source[Raw]) {
+	if s.options.Faults != nil {
+		src = fault.Wrap(src, s.options.Faults, s.config.DeviceClock)
+	}
+	s.source = src
+}
+
+func (s *Sensor[Raw, UI]) GetSencorName() string {
+	// センサーの名前を返す
+	return s.config.Name
+}
+
+func (s *Sensor[Raw, UI]) GetLogFrequency() int {
+	// ログ更新周波数を返す
+	return s.LogFrequency
+}
+
+// serialサーバ上のパスから完全なURLを返す
+func (s *Sensor[Raw, UI]) Upstream(path string) string {
+	return s.Client.URL(path)
+}
+
+// センサーのルーティングを設定する
+func (s *Sensor[Raw, UI]) RegisterRoutes(e *echo.Echo) {
+	e.GET("/data/"+s.config.Name, s.GetData)
+	e.POST("/data/"+s.config.Name+"/log", s.PostData)
+	e.GET("/data/"+s.config.Name+"/history", s.GetHistory)
+	e.GET("/data/"+s.config.Name+"/export", s.GetExport)
+	e.GET("/data/"+s.config.Name+"/stats", s.GetStats)
+}
+
+// 最新のデータをUI用に整形して返す
+func (s *Sensor[Raw, UI]) GetData(c echo.Context) error {
+	// DataHistoryの最新一件
+	latest, ok := s.DataHistory.Latest()
+	if !ok {
+		return c.String(404, fmt.Sprintf("No %s data available", s.config.Label))
+	}
+	// JSON形式でデータを返す
+	// UI用のデータに3つの時刻と古さを足す
+	age, stale, _ := s.health.Age(time.Now())
+	res, err := withFields(s.config.Format(latest.Data),
+		field{"timestamps", latest.Clock},
+		field{"stale", stale},
+		field{"age_ms", age.Milliseconds()},
+	)
+	if err != nil {
+		return c.String(500, fmt.Sprintf("Error encoding %s data: %v", s.config.Label, err))
+	}
+	return c.JSONBlob(200, res)
+}
+
+// データ源からデータを受け取って履歴に追加し続ける
+// UIからの操作とは独立にサーバ内で行う
+// ctxがキャンセルされるまで戻らない
+func (s *Sensor[Raw, UI]) Run(ctx context.Context) {
+	if err := s.source.Run(ctx, s); err != nil {
+		logger.Error("source stopped", "sensor", s.config.Name, "err", err)
+	}
+}
+
+// データ源から1件だけ取得して、履歴に追加する
+// 周期的に取得するデータ源でなければエラーを返す
+func (s *Sensor[Raw, UI]) LogData() error {
+	fetcher, _, ok := source.PollerOf(s.source)
+	if !ok {
+		return fmt.Errorf("%s source does not support polling", s.config.Name)
+	}
+	data, err := fetcher.Fetch(context.Background())
+	if err != nil {
+		return err
+	}
+	// データを履歴に追加
+	return s.addData(data)
+}
+
+// データ源から受け取ったデータを履歴に追加する
+func (s *Sensor[Raw, UI]) Emit(data Raw) {
+	s.accept(data)
+}
+
+// データを履歴に追加し、失敗すれば記録する
+func (s *Sensor[Raw, UI]) accept(data Raw) error {
+	if err := s.addData(data); err != nil {
+		s.Fail(err)
+		return err
+	}
+	if s.failing.Swap(false) {
+		logger.Info("source recovered", "sensor", s.config.Name)
+	}
+	return nil
+}
+
+// データ源の失敗を記録する
+// 失敗が続いている間は最初の1回だけ表示する
+func (s *Sensor[Raw, UI]) Fail(err error) {
+	kind := errorKind(err)
+	s.health.Failure(err, kind, time.Now())
+	errorsTotal.With(s.config.Name, kind).Inc()
+	if !s.failing.Swap(true) {
+		logger.Warn("failed to get data", "sensor", s.config.Name, "err", err)
+	} else {
+		logger.Debug("failed to get data", "sensor", s.config.Name, "err", err)
+	}
+}
+
+// 失敗の種類を返す
+// serialサーバへのリクエストの失敗ならその種類("timeout"など)、データを読めなければ"decode"
+func errorKind(err error) string {
+	if errors.Is(err, source.ErrDecode) {
+		return health.KindDecode
+	}
+	if kind, ok := upstream.KindOf(err); ok {
+		return kind
+	}
+	return "fetch"
+}
+
+// データの受け取りと失敗の状態を返す
+func (s *Sensor[Raw, UI]) Status() health.Status {
+	return s.health.Status(s.config.Name, time.Now())
+}
+
+func (s *Sensor[Raw, UI]) PostData(c echo.Context) error {
+	res := &DLlink{}
+	// 現在までのデータをログとして確定する
+	newName, err := s.Finalize()
+	if err != nil {
+		return c.String(500, fmt.Sprintf("Error finalizing %s data log: %v", s.config.Name, err))
+	}
+
+	url, err := cloudstorage.UploadFile(c.Response().Writer, s.options.Bucket, newName)
+	if err != nil {
+		return c.String(500, fmt.Sprintf("Error uploading %s log file: %v", s.config.Name, err))
+	}
+	// データのDLリンクを返す
+	res.DownloadLink = *url
+	res.Timestamp = time.Now()
+	return c.JSON(200, res)
+}
+
+// 書き込み待ちのログをすべて一時ログファイルに書き出す
+func (s *Sensor[Raw, UI]) Flush() error {
+	return errors.Join(s.logWriter.Flush(), s.uiLogWriter.Flush())
+}
+
+// 一時ログファイルを閉じる
+// 閉じた後はログに書き込めない
+func (s *Sensor[Raw, UI]) Close() error {
+	return errors.Join(s.logWriter.Close(), s.uiLogWriter.Close())
+}
+
+// 現在までのデータを書き出し、一時ログファイルを確定したログとして保存する
+// 確定したログはこれまでと同じJSON配列の形式で、そのパスを返す
+func (s *Sensor[Raw, UI]) Finalize() (string, error) {
+	stamp := time.Now().Format("20060102_150405")
+	newName := filepath.Join(s.options.LogDir, fmt.Sprintf("%s_log_%s.json", s.config.Name, stamp))
+	uiNewName := filepath.Join(s.options.UILogDir, fmt.Sprintf("%s_ui_log_%s.json", s.config.Name, stamp))
+	return s.finalize(newName, uiNewName)
+}
+
+// フライトセッションを開始する
+// それまでに溜まっていたデータは通常のログとして確定し、以降のレコードにセッションIDを付ける
+func (s *Sensor[Raw, UI]) BeginSession(id string) error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	stamp := time.Now().Format("20060102_150405")
+	newName := filepath.Join(s.options.LogDir, fmt.Sprintf("%s_log_%s.json", s.config.Name, stamp))
+	uiNewName := filepath.Join(s.options.UILogDir, fmt.Sprintf("%s_ui_log_%s.json", s.config.Name, stamp))
+	if err := s.finalizeLocked(newName, uiNewName, false); err != nil && !errors.Is(err, ErrNoData) {
+		return err
+	}
+	s.session = id
+	return nil
+}
+
+// フライトセッションを終了する
+// セッション中のデータをdirの下に<センサー名>_log.jsonと<センサー名>_ui_log.jsonとして確定し、そのパスを返す
+// セッションIDと受信時刻付きのレコードも<センサー名>_log.ndjsonとして残す
+// 失敗したらセッションを終了する前の状態に戻す
+func (s *Sensor[Raw, UI]) EndSession(dir string) ([]string, error) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	id := s.session
+	s.session = ""
+	newName := filepath.Join(dir, s.config.Name+"_log.json")
+	uiNewName := filepath.Join(dir, s.config.Name+"_ui_log.json")
+	err := s.finalizeLocked(newName, uiNewName, true)
+	if errors.Is(err, ErrNoData) {
+		return nil, err
+	}
+	if err != nil {
+		s.session = id
+		// 切り離した一時ログファイルを戻す(logMuを取っているので、その後のレコードはない)
+		pending := s.logWriter.Path() + logfile.FinalizingSuffix
+		if _, serr := os.Stat(pending); serr == nil {
+			if rerr := os.Rename(pending, s.logWriter.Path()); rerr != nil {
+				logger.Warn("failed to restore temp log file", "sensor", s.config.Name, "err", rerr)
+			}
+		}
+		os.Remove(newName)
+		return nil, err
+	}
+	files := []string{}
+	for _, name := range []string{newName, recordsName(newName), uiNewName, recordsName(uiNewName)} {
+		if _, err := os.Stat(name); err == nil {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// EndSessionを取り消し、記録中のセッションをidに戻す
+// filesはEndSessionが返したファイルで、セッション中のレコードを一時ログファイルの先頭に戻して消す
+// その後に受け取ったレコードにもセッションIDを付け直す
+// メモリ上の履歴は戻さない(一時ログファイルと時系列ストアには残っている)
+func (s *Sensor[Raw, UI]) RestoreSession(id string, files []string) error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.session = id
+	var errs []error
+	for _, f := range files {
+		switch filepath.Base(f) {
+		case s.config.Name + "_log.ndjson":
+			errs = append(errs, restoreLog(s.logWriter, f, id))
+		case s.config.Name + "_ui_log.ndjson":
+			errs = append(errs, restoreLog(s.uiLogWriter, f, id))
+		default:
+			// JSON配列のログはNDJSONから作り直せる
+			if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Sensor[Raw, UI]) finalize(newName, uiNewName string) (string, error) {
+	// 確定中にロガーが履歴へ書き込まないようにロックする
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if err := s.finalizeLocked(newName, uiNewName, false); err != nil {
+		return "", err
+	}
+	return newName, nil
+}
+
+// 確定したJSON配列のログの隣に残すNDJSONのパス
+func recordsName(name string) string {
+	return strings.TrimSuffix(name, ".json") + ".ndjson"
+}
+
+// logMuを取った状態で呼ぶ
+func (s *Sensor[Raw, UI]) finalizeLocked(newName, uiNewName string, keepRecords bool) error {
+	if err := finalizeLog(s.logWriter, newName, keepRecords); err != nil {
+		return err
+	}
+	// ログを確定したら履歴をクリア
+	s.DataHistory.Drain()
+	historySize.With(s.config.Name).Set(0)
+
+	// UI用ログファイルの処理
+	if err := finalizeLog(s.uiLogWriter, uiNewName, keepRecords); err != nil && !errors.Is(err, ErrNoData) {
+		logger.Warn("failed to finalize UI log file", "sensor", s.config.Name, "err", err)
+	}
+	return nil
+}
+
+// ライターの一時ログファイルを切り離し、JSON配列の形式でdstに書き出す
+// 書き出しに失敗したら切り離したファイルは復旧用に残しておく
+// keepRecordsならセッションIDや受信時刻を含む元のNDJSONもdstの隣に残す
+func finalizeLog(w *logfile.Writer, dst string, keepRecords bool) error {
+	pending := w.Path() + logfile.FinalizingSuffix
+	moved, err := w.Rotate(pending)
+	if err != nil {
+		return err
+	}
+	if !moved {
+		return ErrNoData
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	if _, err := logfile.Export(pending, dst); err != nil {
+		return err
+	}
+	if keepRecords {
+		return os.Rename(pending, recordsName(dst))
+	}
+	return os.Remove(pending)
+}
+
+// 確定したNDJSONのrecordsをライターの一時ログファイルの先頭に戻す
+// 確定した後に書かれたレコードはその後ろに続け、セッションIDがなければsessionを付ける
+// logMuを取った状態で呼ぶ
+func restoreLog(w *logfile.Writer, records, session string) error {
+	later := w.Path() + logfile.FinalizingSuffix
+	moved, err := w.Rotate(later)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(records)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(w.Path(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to restore %s: %w", records, err)
+	}
+	if moved {
+		recs, _, err := logfile.ReadRecords(later)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		for _, rec := range recs {
+			if rec.Session == "" {
+				rec.Session = session
+			}
+			line, err := json.Marshal(rec)
+			if err != nil {
+				out.Close()
+				return err
+			}
+			if _, err := out.Write(append(line, '\n')); err != nil {
+				out.Close()
+				return fmt.Errorf("failed to restore %s: %w", records, err)
+			}
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if moved {
+		os.Remove(later)
+	}
+	return os.Remove(records)
+}
+
+// JSONにできないデータ(NaNなど)はログにも履歴にも入れずにエラーを返す
+func (s *Sensor[Raw, UI]) addData(data Raw) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("%w: invalid %s data: %v", source.ErrDecode, s.config.Name, err)
+	}
+	uiPayload, err := json.Marshal(s.config.Format(data))
+	if err != nil {
+		return fmt.Errorf("%w: invalid %s data: %v", source.ErrDecode, s.config.Name, err)
+	}
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	now := time.Now()
+	stamps := s.observeClock(data, now)
+	s.health.Success(now)
+	// 受け取ったデータはすぐに一時ログファイルへ送る
+	if err := s.logWriter.Write(now, s.session, json.RawMessage(payload)); err != nil {
+		logger.Warn("failed to write log", "sensor", s.config.Name, "err", err)
+	}
+	// UI用に整形したデータも受け取った時点で書き込む
+	// (UIが取りに来た頻度によらず、受け取ったデータがすべて残る)
+	if err := s.uiLogWriter.Write(now, s.session, json.RawMessage(uiPayload)); err != nil {
+		logger.Warn("failed to write UI log", "sensor", s.config.Name, "err", err)
+	}
+	// 時系列ストアにも書き込む
+	if s.options.Store != nil {
+		if err := s.options.Store.Append(s.config.Name, tsdb.Point{Time: now, Session: s.session, Payload: payload}); err != nil {
+			logger.Warn("failed to store data", "sensor", s.config.Name, "err", err)
+		}
+	}
+	// データを履歴に追加
+	// 履歴が上限を超えたら最新の数件だけ残す(古いデータはログに書き込み済み)
+	s.DataHistory.Append(Sample[Raw]{Time: now, Data: data, Clock: stamps}, s.options.HistoryLimit, s.options.HistoryKeep)
+	samplesTotal.With(s.config.Name).Inc()
+	historySize.With(s.config.Name).Set(float64(s.DataHistory.Len()))
+	// ライブ配信を購読しているクライアントに送る
+	if s.options.Stream != nil {
+		s.options.Stream.Publish(s.config.Name, stamps, uiPayload)
+	}
+	return nil
+}
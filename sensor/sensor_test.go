@@ -0,0 +1,305 @@
+package sensor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/TitechMeister/Neon/logfile"
+	"github.com/TitechMeister/Neon/source"
+	"github.com/labstack/echo"
+)
+
+// テスト用のセンサーの生データ
+type testData struct {
+	DeviceID  uint8   `json:"id"`
+	Value     float64 `json:"value"`
+	Timestamp uint32  `json:"timestamp"`
+	// serialサーバの受信時刻
+	ReceivedTime int64 `json:"received_time,omitempty"`
+}
+
+type testUI struct {
+	Value float64 `json:"value"`
+}
+
+// 一時ディレクトリにログを書く、押し込み待ちのテスト用センサーを返す
+func newTestSensor(t *testing.T, options Options) *Sensor[testData, testUI] {
+	t.Helper()
+	dir := t.TempDir()
+	options.TempDir = filepath.Join(dir, "temp")
+	options.LogDir = filepath.Join(dir, "log")
+	options.UILogDir = filepath.Join(dir, "ui_log")
+	if options.HistoryLimit == 0 {
+		options.HistoryLimit, options.HistoryKeep = 100, 10
+	}
+	if options.Source == "" {
+		options.Source = source.KindPush
+	}
+	options.LogFrequency = 10
+	options.Writer = logfile.DefaultPolicy()
+	for _, d := range []string{options.TempDir, options.LogDir, options.UILogDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := New(Config[testData, testUI]{
+		Name:   "test",
+		Label:  "Test",
+		Format: func(d testData) testUI { return testUI{Value: d.Value} },
+		Value:  func(d testData) float64 { return d.Value },
+		Clock: func(d testData) clock.Reading {
+			return clock.Reading{DeviceID: d.DeviceID, Device: uint64(d.Timestamp), HasDevice: true}
+		},
+		DeviceClock: clock.Spec{Unit: time.Millisecond, Period: 1 << 32},
+	}, options)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// echoのハンドラを呼び、ステータスコードを返す
+func call(t *testing.T, handler echo.HandlerFunc, target string) int {
+	t.Helper()
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+	if err := handler(c); err != nil {
+		t.Errorf("%s: %v", target, err)
+	}
+	return rec.Code
+}
+
+// ロガーが追記している間にハンドラ・確定処理・セッションの開始と終了が走っても競合しない
+// go test -race で確かめる
+func TestConcurrentAddData(t *testing.T) {
+	s := newTestSensor(t, Options{})
+	const writers, perWriter = 4, 200
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				if err := s.addData(testData{DeviceID: 1, Value: float64(i), Timestamp: uint32(w*perWriter + i)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	loop := func(f func(i int)) {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				f(i)
+			}
+		}()
+	}
+	loop(func(int) {
+		if code := call(t, s.GetData, "/data/test"); code != http.StatusOK && code != http.StatusNotFound {
+			t.Errorf("GetData: status %d", code)
+		}
+	})
+	loop(func(int) {
+		if code := call(t, s.GetHistory, "/data/test/history"); code != http.StatusOK {
+			t.Errorf("GetHistory: status %d", code)
+		}
+		if code := call(t, s.GetHistory, "/data/test/history?limit=10&step=5"); code != http.StatusOK {
+			t.Errorf("GetHistory range: status %d", code)
+		}
+	})
+	// PostDataはFinalizeしたログをアップロードするだけなので、Finalizeを呼ぶ
+	loop(func(int) {
+		if _, err := s.Finalize(); err != nil && !errors.Is(err, ErrNoData) {
+			t.Errorf("Finalize: %v", err)
+		}
+	})
+	sessionDir := t.TempDir()
+	loop(func(i int) {
+		if err := s.BeginSession(fmt.Sprintf("session-%d", i)); err != nil {
+			t.Errorf("BeginSession: %v", err)
+		}
+		if _, err := s.EndSession(filepath.Join(sessionDir, fmt.Sprint(i))); err != nil && !errors.Is(err, ErrNoData) {
+			t.Errorf("EndSession: %v", err)
+		}
+	})
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+}
+
+// 履歴のスナップショットはその後の追記や書き換えの影響を受けない
+func TestHistorySnapshot(t *testing.T) {
+	h := NewHistory[int]()
+	for i := range 5 {
+		h.Append(i, 100, 10)
+	}
+	snapshot := h.Snapshot()
+	h.Append(5, 100, 10)
+	snapshot[0] = -1
+
+	if len(snapshot) != 5 {
+		t.Fatalf("snapshot has %d items, want 5", len(snapshot))
+	}
+	if got := h.Snapshot(); len(got) != 6 || got[0] != 0 {
+		t.Fatalf("history = %v, want 0..5", got)
+	}
+}
+
+// 履歴の取り出しと空にするのは一度に行うので、追記と並んでも1件も失われず重複もしない
+func TestHistoryDrainAtomic(t *testing.T) {
+	h := NewHistory[int]()
+	const total = 10000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range total {
+			h.Append(i, total, total)
+		}
+	}()
+	seen := map[int]int{}
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		for _, v := range h.Drain() {
+			seen[v]++
+		}
+	}
+	for i := range total {
+		if seen[i] != 1 {
+			t.Fatalf("item %d drained %d times", i, seen[i])
+		}
+	}
+}
+
+// 確定処理は一時ログと履歴を一度に取り出すので、追記と並んでもログから1件も失われず重複もしない
+func TestFinalizeWhileAdding(t *testing.T) {
+	s := newTestSensor(t, Options{HistoryLimit: 1 << 20, HistoryKeep: 1 << 20})
+	const total = 1000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range total {
+			if err := s.addData(testData{DeviceID: 1, Value: float64(i), Timestamp: uint32(i)}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	dir := t.TempDir()
+	names := []string{}
+	finalize := func() {
+		name := filepath.Join(dir, fmt.Sprintf("log_%d.json", len(names)))
+		ui := filepath.Join(dir, fmt.Sprintf("ui_log_%d.json", len(names)))
+		if _, err := s.finalize(name, ui); err != nil && !errors.Is(err, ErrNoData) {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(time.Millisecond):
+		}
+		finalize()
+	}
+
+	seen := map[uint32]int{}
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []testData
+		if err := json.Unmarshal(b, &records); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, r := range records {
+			seen[r.Timestamp]++
+		}
+	}
+	for i := range uint32(total) {
+		if seen[i] != 1 {
+			t.Fatalf("record %d finalized %d times", i, seen[i])
+		}
+	}
+	if n := s.DataHistory.Len(); n != 0 {
+		t.Fatalf("history has %d items after the last finalize", n)
+	}
+}
+
+// 取り消したセッションのレコードは、その後に受け取ったレコードとともにセッションIDを付けて一時ログファイルに戻る
+func TestRestoreSession(t *testing.T) {
+	s := newTestSensor(t, Options{})
+	if err := s.BeginSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+	add := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := s.addData(testData{DeviceID: 1, Value: float64(i), Timestamp: uint32(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	add(0, 3)
+	files, err := s.EndSession(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(3, 5)
+	if err := s.RestoreSession("s1", files); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s is left after restore", f)
+		}
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	records, _, err := logfile.ReadRecords(s.logWriter.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("temp log has %d records, want 5", len(records))
+	}
+	for i, rec := range records {
+		var data testData
+		if err := json.Unmarshal(rec.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Session != "s1" || data.Timestamp != uint32(i) {
+			t.Errorf("record %d = %s in session %q", i, rec.Data, rec.Session)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package serial
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// チェックサムが合わないフレームを読んだときに返すエラー
+var ErrChecksum = errors.New("frame checksum mismatch")
+
+// typのフレームにしたpayloadをdstの末尾に足して返す
+func AppendFrame(dst []byte, typ byte, payload []byte) []byte {
+	if len(payload) > MaxPayload {
+		panic(fmt.Sprintf("serial: payload is %d bytes, max %d", len(payload), MaxPayload))
+	}
+	start := len(dst)
+	dst = append(dst, sync0, sync1, typ, byte(len(payload)))
+	dst = append(dst, payload...)
+	return binary.BigEndian.AppendUint16(dst, checksum(dst[start+2:]))
+}
+
+// CRC-16/CCITT-FALSE
+func checksum(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// 次のフレームを読む
+// 同期の2バイトまでの余計なバイトは読み飛ばす
+// チェックサムが合わなければ、種類だけ入ったFrameとErrChecksumを返す(続けて読める)
+// 壊れた長さで後ろのフレームを読み捨てないように、そのときは同期の2バイトの直後から探し直す
+func (r *Reader) Next() (Frame, error) {
+	if err := r.sync(); err != nil {
+		return Frame{}, err
+	}
+	// チェックサムを確かめるまでは読み進めない
+	header, err := r.r.Peek(headerSize - 2)
+	if err != nil {
+		return Frame{}, noEOF(err)
+	}
+	size := len(header) + int(header[1]) + crcSize
+	raw, err := r.r.Peek(size)
+	if err != nil {
+		return Frame{}, noEOF(err)
+	}
+	typ, body := raw[0], raw[2:size-crcSize]
+	want := binary.BigEndian.Uint16(raw[size-crcSize:])
+	if got := checksum(raw[:size-crcSize]); got != want {
+		return Frame{Type: typ}, fmt.Errorf("%w: type 0x%02x, got 0x%04x, want 0x%04x", ErrChecksum, typ, got, want)
+	}
+	frame := Frame{Type: typ, Payload: append([]byte{}, body...)}
+	r.r.Discard(size)
+	return frame, nil
+}
+
+// 同期の2バイトの直後まで読み進める
+func (r *Reader) sync() error {
+	prev := byte(0)
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if prev == sync0 && b == sync1 {
+			return nil
+		}
+		prev = b
+	}
+}
+
+// フレームの途中で終わったらio.ErrUnexpectedEOFにする
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// 固定長の構造体vをビッグエンディアンのペイロードにする
+// 名前が_のフィールドは0で埋める(パディング)
+func Pack(v any) []byte {
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.BigEndian, v); err != nil {
+		panic(fmt.Sprintf("serial: cannot pack %T: %v", v, err))
+	}
+	return b.Bytes()
+}
+
+// ビッグエンディアンのペイロードを固定長の構造体vに読み込む
+// 長さが合わなければエラー
+func Unpack(payload []byte, v any) error {
+	if size := binary.Size(v); len(payload) != size {
+		return fmt.Errorf("payload is %d bytes, want %d", len(payload), size)
+	}
+	return binary.Read(bytes.NewReader(payload), binary.BigEndian, v)
+}
@@ -0,0 +1,139 @@
+package serial_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/TitechMeister/Neon/altimeter"
+	"github.com/TitechMeister/Neon/gps"
+	"github.com/TitechMeister/Neon/pitot"
+	"github.com/TitechMeister/Neon/serial"
+	"github.com/TitechMeister/Neon/servo"
+	"github.com/TitechMeister/Neon/simulator"
+	"github.com/TitechMeister/Neon/tacho"
+)
+
+// 1種類のパケットの作り方と読み方
+type codec struct {
+	name string
+	typ  byte
+	size int
+	// シミュレータの状態からペイロードを作る
+	encode func(simulator.State) []byte
+	// ペイロードを読んでから作り直す
+	reencode func([]byte) ([]byte, error)
+}
+
+func newCodec[T any](name string, typ byte, size int, simulate func(simulator.State) T, encode func(T) []byte, decode func([]byte, time.Time) (T, error)) codec {
+	return codec{
+		name:   name,
+		typ:    typ,
+		size:   size,
+		encode: func(st simulator.State) []byte { return encode(simulate(st)) },
+		reencode: func(payload []byte) ([]byte, error) {
+			data, err := decode(payload, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			return encode(data), nil
+		},
+	}
+}
+
+var codecs = []codec{
+	newCodec("altimeter", serial.TypeAltimeter, 16, altimeter.Simulate, altimeter.Encode, altimeter.Decode),
+	newCodec("gps", serial.TypeGPS, 44, gps.Simulate, gps.Encode, gps.Decode),
+	newCodec("pitot", serial.TypePitot, 28, pitot.Simulate, pitot.Encode, pitot.Decode),
+	newCodec("tacho", serial.TypeTacho, 16, tacho.Simulate, tacho.Encode, tacho.Decode),
+	newCodec("servo", serial.TypeServo, 48, servo.Simulate, servo.Encode, servo.Decode),
+}
+
+// 全種類のフレームを続けて並べ、各フレームの先頭の位置も返す
+func allFrames(st simulator.State) ([]byte, []int) {
+	var stream []byte
+	starts := []int{}
+	for _, c := range codecs {
+		starts = append(starts, len(stream))
+		stream = serial.AppendFrame(stream, c.typ, c.encode(st))
+	}
+	return stream, starts
+}
+
+// 全種類のパケットがフレームを通しても同じバイト列で読め、デコードして作り直しても変わらない
+func TestFrameRoundTrip(t *testing.T) {
+	st := simulator.New().State()
+	for _, c := range codecs {
+		payload := c.encode(st)
+		if len(payload) != c.size {
+			t.Errorf("%s: payload is %d bytes, want %d", c.name, len(payload), c.size)
+		}
+		// 前に余計なバイトがあっても読み飛ばす
+		stream := append([]byte{0x00, 0xA5, 0x13}, serial.AppendFrame(nil, c.typ, payload)...)
+		frame, err := serial.NewReader(bytes.NewReader(stream)).Next()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if frame.Type != c.typ || !bytes.Equal(frame.Payload, payload) {
+			t.Errorf("%s: read type 0x%02x %x, want 0x%02x %x", c.name, frame.Type, frame.Payload, c.typ, payload)
+		}
+		again, err := c.reencode(frame.Payload)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !bytes.Equal(again, payload) {
+			t.Errorf("%s: re-encoded %x, want %x", c.name, again, payload)
+		}
+	}
+}
+
+// フレームを読み、チェックサムが合わなかった種類と読めたフレームの種類を返す
+func readAll(t *testing.T, stream []byte) (bad, good []byte) {
+	t.Helper()
+	r := serial.NewReader(bytes.NewReader(stream))
+	for {
+		frame, err := r.Next()
+		switch {
+		case errors.Is(err, serial.ErrChecksum):
+			bad = append(bad, frame.Type)
+		case errors.Is(err, io.EOF):
+			return bad, good
+		case err != nil:
+			t.Fatal(err)
+		default:
+			good = append(good, frame.Type)
+		}
+	}
+}
+
+// チェックサムが壊れたフレームだけを失敗にし、続くフレームは読める
+func TestFrameCorruptedChecksum(t *testing.T) {
+	stream, starts := allFrames(simulator.New().State())
+	// 高度計のフレームのCRCの最後のバイトを壊す
+	stream[starts[1]-1] ^= 0xFF
+
+	bad, good := readAll(t, stream)
+	if !bytes.Equal(bad, []byte{serial.TypeAltimeter}) {
+		t.Errorf("checksum errors for types %x, want the altimeter", bad)
+	}
+	if !bytes.Equal(good, []byte{serial.TypeGPS, serial.TypePitot, serial.TypeTacho, serial.TypeServo}) {
+		t.Errorf("read types %x, want all but the altimeter", good)
+	}
+}
+
+// 長さが壊れたフレームは、その長さ分を読み捨てずに後ろのフレームを読める
+func TestFrameCorruptedLength(t *testing.T) {
+	stream, starts := allFrames(simulator.New().State())
+	// 高度計のフレームの長さを、後ろのGPSとピトー管のフレームまで飲み込む長さにする
+	stream[starts[0]+3] = byte(starts[3] - starts[0])
+
+	bad, good := readAll(t, stream)
+	if !bytes.Equal(bad, []byte{serial.TypeAltimeter}) {
+		t.Errorf("checksum errors for types %x, want the altimeter", bad)
+	}
+	if !bytes.Equal(good, []byte{serial.TypeGPS, serial.TypePitot, serial.TypeTacho, serial.TypeServo}) {
+		t.Errorf("read types %x, want all but the altimeter", good)
+	}
+}
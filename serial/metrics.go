@@ -0,0 +1,13 @@
+package serial
+
+import (
+	"github.com/TitechMeister/Neon/metrics"
+)
+
+// シリアルデバイスの指標
+var (
+	framesTotal = metrics.NewCounterVec("neon_serial_frames_total",
+		"Frames read from the serial device, by packet type and result (ok, checksum, unknown or dropped).", "type", "result")
+	portOpen = metrics.NewGaugeVec("neon_serial_port_open",
+		"1 while the serial device is open, otherwise 0.")
+)
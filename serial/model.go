@@ -0,0 +1,73 @@
+package serial
+
+import (
+	"bufio"
+	"sync"
+	"time"
+)
+
+// パケットの種類(フレームの3バイト目)
+const (
+	TypeAltimeter byte = 0x01
+	TypeGPS       byte = 0x02
+	TypePitot     byte = 0x03
+	TypeTacho     byte = 0x04
+	TypeServo     byte = 0x05
+)
+
+// フレームの形
+// 0xA5 0x5A | 種類(1) | 長さ(1) | ペイロード(長さ分、ビッグエンディアン) | CRC-16/CCITT-FALSE(2、種類から末尾まで)
+const (
+	sync0 = 0xA5
+	sync1 = 0x5A
+	// 同期の2バイトと種類と長さ
+	headerSize = 4
+	crcSize    = 2
+	// 長さは1バイトなのでペイロードは255バイトまで
+	MaxPayload = 255
+)
+
+// 1つのフレーム
+type Frame struct {
+	Type    byte
+	Payload []byte
+}
+
+// 同期の2バイトを探してフレームを1つずつ読む
+type Reader struct {
+	r *bufio.Reader
+}
+
+// シリアルデバイスの設定
+type Options struct {
+	// デバイスのパス e.g. "/dev/ttyUSB0"、擬似端末なら "/dev/pts/3"
+	Device string
+	// ボーレート
+	Baud int
+}
+
+// シリアルデバイスからフレームを読み、種類ごとに受け取り側へ振り分ける
+// デバイスが外れたり開けなかったりすれば開き直す
+type Port struct {
+	options Options
+
+	mu sync.Mutex
+	// 種類ごとの受け取り側
+	subscribers map[byte][]chan Packet
+}
+
+// 受け取り側に渡す1つのパケット
+type Packet struct {
+	Payload []byte
+	// Neonがフレームを読み終えた時刻
+	Received time.Time
+	// チェックサムが合わない、デバイスを開けないなどの失敗
+	Err error
+}
+
+// Portから1種類のパケットを受け取ってデータにするSource
+type packetSource[T any] struct {
+	port   *Port
+	typ    byte
+	decode func(payload []byte, received time.Time) (T, error)
+}
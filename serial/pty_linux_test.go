@@ -0,0 +1,63 @@
+//go:build linux
+
+package serial_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TitechMeister/Neon/altimeter"
+	"github.com/TitechMeister/Neon/logfile"
+	"github.com/TitechMeister/Neon/sensor"
+	"github.com/TitechMeister/Neon/serial"
+	"github.com/TitechMeister/Neon/simulator"
+	"github.com/TitechMeister/Neon/source"
+)
+
+// 擬似端末の片側に書いたフレームを、もう片側を開いたセンサーが履歴に入れる
+func TestPTY(t *testing.T) {
+	master, slave, err := serial.OpenPTY()
+	if err != nil {
+		t.Skipf("pty is not available: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := serial.NewPort(serial.Options{Device: slave.Name(), Baud: 115200})
+	go port.Run(ctx)
+	dir := t.TempDir()
+	a := altimeter.New(sensor.Options{
+		LogFrequency: 10,
+		TempDir:      dir,
+		LogDir:       dir,
+		UILogDir:     dir,
+		HistoryLimit: 100,
+		HistoryKeep:  10,
+		Writer:       logfile.DefaultPolicy(),
+		Source:       source.KindSerial,
+		Serial:       port,
+	})
+	defer a.Close()
+	go a.Run(ctx)
+
+	sim := simulator.New()
+	deadline := time.Now().Add(5 * time.Second)
+	for a.DataHistory.Len() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("history has %d items after 5s, status %+v", a.DataHistory.Len(), a.Status())
+		}
+		// 高度計のフレームと、受け取り側のない種類のフレームを混ぜて書く
+		frames := serial.AppendFrame(nil, serial.TypeAltimeter, altimeter.Encode(altimeter.Simulate(sim.State())))
+		frames = serial.AppendFrame(frames, 0x7F, []byte{1, 2, 3})
+		master.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		master.Write(frames)
+		time.Sleep(20 * time.Millisecond)
+	}
+	latest, _ := a.DataHistory.Latest()
+	if latest.Data.DeviceID != 1 || latest.Data.ReceivedTime == 0 {
+		t.Errorf("latest = %+v, want device 1 with the time Neon read the frame", latest.Data)
+	}
+}
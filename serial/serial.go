@@ -0,0 +1,170 @@
+package serial
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/source"
+)
+
+var logger = logging.For("serial")
+
+const (
+	// デバイスを開き直すまでの時間
+	reopenInterval = time.Second
+	// 受け取り側ごとに溜めておくパケットの数
+	subscriberBuffer = 64
+)
+
+func NewPort(options Options) *Port {
+	return &Port{options: options, subscribers: map[byte][]chan Packet{}}
+}
+
+// typのパケットを受け取るチャンネルと、受け取りをやめる関数を返す
+func (p *Port) Subscribe(typ byte) (<-chan Packet, func()) {
+	ch := make(chan Packet, subscriberBuffer)
+	p.mu.Lock()
+	p.subscribers[typ] = append(p.subscribers[typ], ch)
+	p.mu.Unlock()
+	return ch, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		subs := p.subscribers[typ]
+		for i, other := range subs {
+			if other == ch {
+				p.subscribers[typ] = append(subs[:i], subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// ctxがキャンセルされるまでデバイスからフレームを読み続ける
+// 開けなかったり読めなくなったりしたら、全ての受け取り側に失敗を渡して開き直す
+func (p *Port) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := p.read(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		err = fmt.Errorf("serial %s: %w", p.options.Device, err)
+		logger.Debug("serial device failed", "device", p.options.Device, "err", err)
+		p.broadcast(Packet{Received: time.Now(), Err: err})
+		timer := time.NewTimer(reopenInterval)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// デバイスを開いて、読めなくなるまでフレームを振り分ける
+func (p *Port) read(ctx context.Context) error {
+	f, err := open(p.options.Device, p.options.Baud)
+	if err != nil {
+		return err
+	}
+	portOpen.With().Set(1)
+	defer portOpen.With().Set(0)
+	// ctxがキャンセルされたら閉じて読み込みを止める
+	stop := context.AfterFunc(ctx, func() { f.Close() })
+	defer func() {
+		if stop() {
+			f.Close()
+		}
+	}()
+	logger.Info("serial device opened", "device", p.options.Device, "baud", p.options.Baud)
+	r := NewReader(f)
+	for {
+		frame, err := r.Next()
+		now := time.Now()
+		switch {
+		case errors.Is(err, ErrChecksum):
+			framesTotal.With(typeLabel(frame.Type), "checksum").Inc()
+			p.dispatch(frame.Type, Packet{Received: now, Err: fmt.Errorf("%w: %w", source.ErrDecode, err)})
+		case errors.Is(err, io.EOF):
+			return errors.New("device closed")
+		case err != nil:
+			return err
+		default:
+			p.dispatch(frame.Type, Packet{Payload: frame.Payload, Received: now})
+		}
+	}
+}
+
+// typの受け取り側にパケットを渡す
+// 受け取り側が遅れていれば捨てる
+func (p *Port) dispatch(typ byte, packet Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	subs := p.subscribers[typ]
+	if len(subs) == 0 {
+		if packet.Err == nil {
+			framesTotal.With(typeLabel(typ), "unknown").Inc()
+			logger.Debug("frame without receiver", "type", typ, "payload", hex.EncodeToString(packet.Payload))
+		}
+		return
+	}
+	for _, ch := range subs {
+		select {
+		case ch <- packet:
+			if packet.Err == nil {
+				framesTotal.With(typeLabel(typ), "ok").Inc()
+			}
+		default:
+			framesTotal.With(typeLabel(typ), "dropped").Inc()
+		}
+	}
+}
+
+// 全ての受け取り側にパケットを渡す
+func (p *Port) broadcast(packet Packet) {
+	p.mu.Lock()
+	types := make([]byte, 0, len(p.subscribers))
+	for typ := range p.subscribers {
+		types = append(types, typ)
+	}
+	p.mu.Unlock()
+	for _, typ := range types {
+		p.dispatch(typ, packet)
+	}
+}
+
+// 指標のラベルに使うパケットの種類
+func typeLabel(typ byte) string {
+	return fmt.Sprintf("0x%02x", typ)
+}
+
+// portからtypのパケットを受け取り、decodeでデータにするSourceを返す
+// decodeはペイロードとNeonが読み終えた時刻から生データを作る
+func Source[T any](port *Port, typ byte, decode func(payload []byte, received time.Time) (T, error)) source.Source[T] {
+	return &packetSource[T]{port: port, typ: typ, decode: decode}
+}
+
+func (s *packetSource[T]) Run(ctx context.Context, sink source.Sink[T]) error {
+	packets, unsubscribe := s.port.Subscribe(s.typ)
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case packet := <-packets:
+			if packet.Err != nil {
+				sink.Fail(packet.Err)
+				continue
+			}
+			data, err := s.decode(packet.Payload, packet.Received)
+			if err != nil {
+				sink.Fail(fmt.Errorf("%w: %v", source.ErrDecode, err))
+				continue
+			}
+			sink.Emit(data)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package serial
+
+import (
+	"errors"
+	"os"
+)
+
+// Linux以外ではシリアルデバイスを開けない
+var errUnsupported = errors.New("serial devices are only supported on Linux")
+
+func open(device string, baud int) (*os.File, error) {
+	return nil, errUnsupported
+}
+
+func OpenPTY() (master, slave *os.File, err error) {
+	return nil, nil, errUnsupported
+}
@@ -0,0 +1,54 @@
+package serialserver
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/TitechMeister/Neon/replay"
+	"github.com/TitechMeister/Neon/simulator"
+	"github.com/labstack/echo"
+)
+
+// 動作設定
+type Options struct {
+	// 再生するログの場所(空ならシミュレータのデータを返す)
+	// セッションのディレクトリ、バンドルのzip、確定したログのディレクトリ
+	Replay string
+	// 再生速度と、最後まで再生したら先頭に戻るかどうか
+	Speed float64
+	Loop  bool
+}
+
+// /serial/write に書き込まれた内容
+type Write struct {
+	ReceivedAt time.Time       `json:"received_at"`
+	Body       json.RawMessage `json:"body"`
+	// ボディが {"payload": [48バイト]} ならその16進表記
+	Hex string `json:"hex,omitempty"`
+}
+
+// serialサーバ(localhost:7878)の代わりに、同じHTTPの約束でセンサーのデータを返すサーバ
+type Server struct {
+	// ルーティング済みのEchoサーバ
+	Echo *echo.Echo
+
+	simulator *simulator.Simulator
+	replay    *replay.Controller
+	// 再生中の各センサーの最新のデータ(キーはセンサー名)
+	latestMu sync.Mutex
+	latest   map[string]json.RawMessage
+
+	writesMu sync.Mutex
+	writes   []Write
+}
+
+// serialサーバ上のパスと、そのデータを作るセンサー
+type endpoint struct {
+	path   string
+	sensor string
+	// シミュレータの状態からデータを作る
+	simulate func(simulator.State) any
+	// シミュレータの状態からシリアルで送るフレームを作る
+	frame func(simulator.State) []byte
+}
@@ -0,0 +1,48 @@
+package serialserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/TitechMeister/Neon/serial"
+)
+
+// 擬似端末を開き、intervalごとに全センサーのシミュレータのデータをフレームにして書き込む
+// Neonの serial.device に渡すパスを返す(Linuxのみ)
+// ctxがキャンセルされると擬似端末を閉じる
+func (s *Server) ServePTY(ctx context.Context, interval time.Duration) (string, error) {
+	if s.simulator == nil {
+		return "", errors.New("serial output needs the simulator (not available while replaying)")
+	}
+	master, slave, err := serial.OpenPTY()
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		defer master.Close()
+		defer slave.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			var frames []byte
+			st := s.simulator.State()
+			for _, ep := range endpoints {
+				frames = append(frames, ep.frame(st)...)
+			}
+			// 読む側がいなくて詰まったら、そのデータは捨てる
+			master.SetWriteDeadline(time.Now().Add(interval))
+			if _, err := master.Write(frames); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				logger.Warn("failed to write to pty", "err", err)
+				return
+			}
+		}
+	}()
+	return slave.Name(), nil
+}
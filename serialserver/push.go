@@ -0,0 +1,73 @@
+package serialserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// つながらなかったときに接続し直すまでの時間
+const redialInterval = time.Second
+
+// Neonの ingest.tcp_address にintervalごとに全センサーのデータを1行1件のNDJSONで押し込む
+// 再生中は同じデータを何度も送るが、Neonが重複として捨てる
+// ctxがキャンセルされるまで戻らない
+func (s *Server) Push(ctx context.Context, addr string, interval time.Duration) {
+	dialer := net.Dialer{}
+	for ctx.Err() == nil {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			logger.Warn("failed to connect to neon", "addr", addr, "err", err)
+			sleep(ctx, redialInterval)
+			continue
+		}
+		logger.Info("pushing data to neon", "addr", addr)
+		err = s.pushTo(ctx, conn, interval)
+		conn.Close()
+		if err != nil && ctx.Err() == nil {
+			logger.Warn("lost connection to neon", "addr", addr, "err", err)
+			sleep(ctx, redialInterval)
+		}
+	}
+}
+
+func (s *Server) pushTo(ctx context.Context, conn net.Conn, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		for _, ep := range endpoints {
+			data, ok := s.data(ep)
+			if !ok {
+				continue
+			}
+			frame := struct {
+				Sensor string `json:"sensor"`
+				Data   any    `json:"data"`
+			}{ep.sensor, data}
+			if err := enc.Encode(frame); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
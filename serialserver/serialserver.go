@@ -0,0 +1,227 @@
+package serialserver
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TitechMeister/Neon/altimeter"
+	"github.com/TitechMeister/Neon/gps"
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/pitot"
+	"github.com/TitechMeister/Neon/replay"
+	"github.com/TitechMeister/Neon/serial"
+	"github.com/TitechMeister/Neon/servo"
+	"github.com/TitechMeister/Neon/simulator"
+	"github.com/TitechMeister/Neon/tacho"
+	"github.com/labstack/echo"
+)
+
+var logger = logging.For("serialserver")
+
+var endpoints = []endpoint{
+	newEndpoint("/data/ultrasonic", "altimeter", serial.TypeAltimeter, altimeter.Simulate, altimeter.Encode),
+	newEndpoint("/data/gps", "gps", serial.TypeGPS, gps.Simulate, gps.Encode),
+	newEndpoint("/data/pitot", "pitot", serial.TypePitot, pitot.Simulate, pitot.Encode),
+	newEndpoint("/data/tachometer", "tachometer", serial.TypeTacho, tacho.Simulate, tacho.Encode),
+	newEndpoint("/data/servo", "servo", serial.TypeServo, servo.Simulate, servo.Encode),
+}
+
+// センサーのパッケージのSimulateとEncodeからendpointを作る
+func newEndpoint[T any](path, sensor string, typ byte, simulate func(simulator.State) T, encode func(T) []byte) endpoint {
+	return endpoint{
+		path:     path,
+		sensor:   sensor,
+		simulate: func(st simulator.State) any { return simulate(st) },
+		frame:    func(st simulator.State) []byte { return serial.AppendFrame(nil, typ, encode(simulate(st))) },
+	}
+}
+
+// 新しいサーバを返す
+// 再生するならctxがキャンセルされるまでログを流し続ける
+func New(ctx context.Context, options Options) (*Server, error) {
+	s := &Server{latest: map[string]json.RawMessage{}}
+	if options.Replay == "" {
+		s.simulator = simulator.New()
+	} else {
+		if options.Speed == 0 {
+			options.Speed = 1
+		}
+		if options.Speed < replay.MinSpeed || options.Speed > replay.MaxSpeed {
+			return nil, fmt.Errorf("replay speed must be between %v and %v, got %v", replay.MinSpeed, replay.MaxSpeed, options.Speed)
+		}
+		s.replay = replay.NewController(options.Replay, options.Speed, options.Loop)
+		loaded := 0
+		for _, ep := range endpoints {
+			// 受信時刻のないログは1秒間隔で並べる
+			track, err := replay.Load(options.Replay, ep.sensor, time.Second)
+			if err != nil {
+				logger.Warn("no log to replay", "sensor", ep.sensor, "err", err)
+				continue
+			}
+			src, err := replay.NewSource[json.RawMessage](s.replay, track)
+			if err != nil {
+				logger.Warn("no log to replay", "sensor", ep.sensor, "err", err)
+				continue
+			}
+			go src.Run(ctx, &latestSink{server: s, sensor: ep.sensor})
+			loaded++
+		}
+		if loaded == 0 {
+			return nil, fmt.Errorf("no logs to replay in %s", options.Replay)
+		}
+		s.replay.Start()
+	}
+	s.Echo = s.echoSetup()
+	return s, nil
+}
+
+func (s *Server) echoSetup() *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	for _, ep := range endpoints {
+		e.GET(ep.path, s.dataHandler(ep))
+	}
+	e.GET("/data/batch", s.GetBatch)
+	e.POST("/serial/write", s.PostWrite)
+	e.GET("/serial/writes", s.GetWrites)
+	e.DELETE("/serial/writes", s.DeleteWrites)
+	if s.simulator != nil {
+		s.simulator.RegisterRoutes(e)
+	}
+	if s.replay != nil {
+		s.replay.RegisterRoutes(e)
+	}
+	return e
+}
+
+// addrで待ち受けて、実際に待ち受けているアドレスを返す
+// ":0" なら空いているポートを使う
+// ctxがキャンセルされるとサーバを止める
+func (s *Server) Start(ctx context.Context, addr string) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	srv := &http.Server{Handler: s.Echo}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("serial server stopped", "err", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	return ln.Addr().String(), nil
+}
+
+// これまでに /serial/write に書き込まれた内容を返す
+func (s *Server) Writes() []Write {
+	s.writesMu.Lock()
+	defer s.writesMu.Unlock()
+	return append([]Write{}, s.writes...)
+}
+
+func (s *Server) dataHandler(ep endpoint) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		data, ok := s.data(ep)
+		if !ok {
+			return c.String(http.StatusServiceUnavailable, fmt.Sprintf("No %s data yet", ep.sensor))
+		}
+		return c.JSON(http.StatusOK, data)
+	}
+}
+
+// ?paths=/data/gps,/data/pitot のデータをまとめて {"/data/gps": {...}, ...} で返す
+// pathsがなければすべて返す。まだデータのないパスは含めない
+func (s *Server) GetBatch(c echo.Context) error {
+	paths := map[string]bool{}
+	for _, path := range strings.Split(c.QueryParam("paths"), ",") {
+		if path != "" {
+			paths[path] = true
+		}
+	}
+	frames := map[string]any{}
+	for _, ep := range endpoints {
+		if len(paths) > 0 && !paths[ep.path] {
+			continue
+		}
+		if data, ok := s.data(ep); ok {
+			frames[ep.path] = data
+		}
+	}
+	return c.JSON(http.StatusOK, frames)
+}
+
+// 今のデータを返す
+// 再生中でまだデータがなければokはfalse
+func (s *Server) data(ep endpoint) (any, bool) {
+	if s.simulator != nil {
+		return ep.simulate(s.simulator.State()), true
+	}
+	s.latestMu.Lock()
+	defer s.latestMu.Unlock()
+	data, ok := s.latest[ep.sensor]
+	return data, ok
+}
+
+// 書き込まれた内容を記録する
+func (s *Server) PostWrite(c echo.Context) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Error reading body: %v", err))
+	}
+	if !json.Valid(body) {
+		return c.String(http.StatusBadRequest, "Body must be JSON")
+	}
+	w := Write{ReceivedAt: time.Now(), Body: body}
+	// gps.PostTargetが送る48バイトのペイロード
+	var target struct {
+		Payload *[48]byte `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &target); err == nil && target.Payload != nil {
+		w.Hex = hex.EncodeToString(target.Payload[:])
+	}
+	s.writesMu.Lock()
+	s.writes = append(s.writes, w)
+	s.writesMu.Unlock()
+	logger.Info("serial write", "body", string(body), "hex", w.Hex)
+	return c.JSON(http.StatusOK, map[string]string{"message": "ok"})
+}
+
+func (s *Server) GetWrites(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.Writes())
+}
+
+func (s *Server) DeleteWrites(c echo.Context) error {
+	s.writesMu.Lock()
+	s.writes = nil
+	s.writesMu.Unlock()
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 再生したデータを最新のデータとして残す
+type latestSink struct {
+	server *Server
+	sensor string
+}
+
+func (l *latestSink) Emit(data json.RawMessage) {
+	l.server.latestMu.Lock()
+	l.server.latest[l.sensor] = data
+	l.server.latestMu.Unlock()
+}
+
+func (l *latestSink) Fail(err error) {
+	logger.Warn("failed to replay", "sensor", l.sensor, "err", err)
+}
@@ -0,0 +1,144 @@
+package serialserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TitechMeister/Neon/altimeter"
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/TitechMeister/Neon/gps"
+	"github.com/TitechMeister/Neon/logfile"
+	"github.com/TitechMeister/Neon/pitot"
+	"github.com/TitechMeister/Neon/sensor"
+	"github.com/TitechMeister/Neon/serialserver"
+	"github.com/TitechMeister/Neon/servo"
+	"github.com/TitechMeister/Neon/source"
+	"github.com/TitechMeister/Neon/tacho"
+	"github.com/labstack/echo"
+)
+
+// テストで使うセンサーの操作
+type testSensor interface {
+	GetSencorName() string
+	LogData() error
+	GetData(c echo.Context) error
+	Close() error
+}
+
+// 同じプロセスで起動したserialサーバから、どのセンサーも取得したデータを返せる
+func TestEndToEnd(t *testing.T) {
+	tests := []struct {
+		new func(sensor.Options) testSensor
+		// GetDataのレスポンスから各センサーに固有の値を確かめる
+		check func(t *testing.T, body []byte)
+	}{
+		{
+			new: func(o sensor.Options) testSensor { return altimeter.New(o) },
+			check: func(t *testing.T, body []byte) {
+				var res altimeter.AltimeterUIData
+				decode(t, body, &res)
+				if res.DeviceID != 1 || res.Altitude < 0 {
+					t.Errorf("data = %+v, want device 1 at a non-negative altitude", res)
+				}
+			},
+		},
+		{
+			new: func(o sensor.Options) testSensor { return gps.New(o) },
+			check: func(t *testing.T, body []byte) {
+				var res gps.GPSUIData
+				decode(t, body, &res)
+				if res.Unixtime == 0 || res.Lat == 0 || res.Lon == 0 {
+					t.Errorf("data = %+v, want a simulated fix", res)
+				}
+			},
+		},
+		{
+			new: func(o sensor.Options) testSensor { return pitot.New(o) },
+			check: func(t *testing.T, body []byte) {
+				var res pitot.PitotData
+				decode(t, body, &res)
+				if res.ID != 1 || res.Timestamp == 0 {
+					t.Errorf("data = %+v, want device 1 with its clock", res)
+				}
+			},
+		},
+		{
+			new: func(o sensor.Options) testSensor { return servo.New(o) },
+			check: func(t *testing.T, body []byte) {
+				var res servo.ServoUIData
+				decode(t, body, &res)
+				if res.Timestamp == 0 || res.ReceivedTime == 0 {
+					t.Errorf("data = %+v, want the simulated clocks", res)
+				}
+			},
+		},
+		{
+			new: func(o sensor.Options) testSensor { return tacho.New(o) },
+			check: func(t *testing.T, body []byte) {
+				var res tacho.TachoData
+				decode(t, body, &res)
+				if res.ID != 1 || res.Timestamp == 0 {
+					t.Errorf("data = %+v, want device 1 with its clock", res)
+				}
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, err := serialserver.New(ctx, serialserver.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := server.Start(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		s := tt.new(sensor.Options{
+			LogFrequency: 10,
+			UpstreamURL:  "http://" + addr,
+			TempDir:      dir,
+			LogDir:       dir,
+			UILogDir:     dir,
+			HistoryLimit: 100,
+			HistoryKeep:  10,
+			Writer:       logfile.DefaultPolicy(),
+			Source:       source.KindHTTP,
+		})
+		t.Run(s.GetSencorName(), func(t *testing.T) {
+			defer s.Close()
+			if err := s.LogData(); err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			if err := s.GetData(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/data/"+s.GetSencorName(), nil), rec)); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			var res struct {
+				Timestamps clock.Timestamps `json:"timestamps"`
+			}
+			decode(t, rec.Body.Bytes(), &res)
+			if res.Timestamps.DeviceID != 1 || res.Timestamps.Device == nil {
+				t.Errorf("timestamps = %+v, want the simulated device clock of device 1", res.Timestamps)
+			}
+			tt.check(t, rec.Body.Bytes())
+		})
+	}
+}
+
+// JSONを読めなければテストを止める
+func decode(t *testing.T, body []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatal(err)
+	}
+}
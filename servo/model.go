@@ -1,8 +1,7 @@
 package servo
 
 import (
-	"net/http"
-	"time"
+	"github.com/TitechMeister/Neon/sensor"
 )
 
 // hoge無印→入力された値
@@ -29,17 +28,12 @@ type ServoData struct {
 }
 
 type Servo struct {
-	DataHistory      []ServoData  `json:"data_history"`
-	Client           *http.Client `json:"-"`
-	LogFrequency     int          `json:"log_frequency"` // Frequency of logging data in a second
+	*sensor.Sensor[ServoData, ServoUIData]
 	RevElevatorValue []float64
 	RevRudderValue   []float64
 }
 
-type ServoDLlink struct {
-	DownloadLink string    `json:"download_link"`
-	Timestamp    time.Time `json:"timestamp"`
-}
+type ServoDLlink = sensor.DLlink
 
 type ServoUIData struct {
 	Rudder              float64 `json:"rudder"`
@@ -52,3 +46,21 @@ type ServoUIData struct {
 	ReceivedTime        uint64  `json:"received_time"`
 	Timestamp           uint32  `json:"timestamp"`
 }
+
+// シリアルで送られるサーボのパケット(ビッグエンディアン、48バイト)
+type servoPacket struct {
+	ID                  uint8
+	Status              uint8
+	_                   [2]byte
+	Timestamp           uint32
+	Rudder              float32
+	Elevator            float32
+	Voltage             float32
+	RudderCurrent       float32
+	ElevatorCurrent     float32
+	Trim                float32
+	RudderServoAngle    float32
+	ElevatorServoAngle  float32
+	RudderTemperature   float32
+	ElevatorTemperature float32
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// セッションの状態
+const (
+	StatusActive      = "active"
+	StatusStopped     = "stopped"
+	StatusInterrupted = "interrupted" // 記録中にNeonが止まった
+)
+
+// フライトの付帯情報
+type Metadata struct {
+	Pilot    string `json:"pilot"`
+	Aircraft string `json:"aircraft"`
+	Location string `json:"location"`
+	Weather  string `json:"weather"`
+	Notes    string `json:"notes"`
+}
+
+// 1回のフライトの記録
+type Session struct {
+	ID string `json:"id"`
+	Metadata
+	Status    string     `json:"status"`
+	StartedAt time.Time  `json:"started_at"`
+	StoppedAt *time.Time `json:"stopped_at,omitempty"`
+	// 確定したログの保存先
+	Dir string `json:"dir,omitempty"`
+	// 確定したログファイル
+	Files []string `json:"files,omitempty"`
+	// 中断したセッションのログを復旧した先
+	RecoveredDir string `json:"recovered_dir,omitempty"`
+}
+
+// セッションに参加するセンサー
+type Target interface {
+	// センサーの名前を取得する
+	GetSencorName() string
+	// それまでのログを確定し、以降のレコードにセッションIDを付ける
+	BeginSession(id string) error
+	// セッション中のログをdirの下に確定し、そのパスを返す
+	EndSession(dir string) ([]string, error)
+	// 開始や終了に失敗したセッションを取り消し、記録中のセッションをidに戻す
+	// filesはEndSessionが返したファイル
+	RestoreSession(id string, files []string) error
+}
+
+// セッションの開始・終了と一覧を管理する
+type Manager struct {
+	logDir  string
+	targets []Target
+
+	mu     sync.Mutex
+	active *Session
+}
@@ -0,0 +1,347 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/sensor"
+	"github.com/labstack/echo"
+)
+
+var logger = logging.For("session")
+
+var (
+	// すでにセッションを記録中
+	ErrActive = errors.New("a session is already active")
+	// 指定したセッションは記録中ではない
+	ErrNotActive = errors.New("session is not active")
+	// 記録中のセッションがなく、確定するデータもない
+	ErrEmpty = errors.New("no active session and no data to finalize")
+	// 指定したセッションは保存されていない
+	ErrNotFound = errors.New("session not found")
+)
+
+// メタデータのファイル名
+const metadataFile = "session.json"
+
+// 記録中のセッションを保存しておくファイル名(ログの保存先の直下)
+const activeFile = "active_session.json"
+
+// 新しいセッションマネージャを返す
+// 前回記録中のままNeonが止まったセッションがあれば中断扱いで保存する
+// recoveredDirには起動時に一時ログファイルを復旧した先を渡す(なければ空文字)
+func NewManager(logDir string, targets []Target, recoveredDir string) (*Manager, error) {
+	m := &Manager{logDir: logDir, targets: targets}
+	if err := m.restoreInterrupted(recoveredDir); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// 新しいセッションを開始する
+// セッション開始前に溜まっていたデータは通常のログとして確定しておく
+func (m *Manager) Start(meta Metadata) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active != nil {
+		return nil, ErrActive
+	}
+
+	now := time.Now()
+	s := &Session{
+		ID:        m.newID(now),
+		Metadata:  meta,
+		Status:    StatusActive,
+		StartedAt: now,
+	}
+	activePath := filepath.Join(m.logDir, activeFile)
+	if err := m.writeJSON(activePath, s); err != nil {
+		return nil, err
+	}
+	for i, t := range m.targets {
+		if err := t.BeginSession(s.ID); err != nil {
+			err = fmt.Errorf("begin session on %s: %w", t.GetSencorName(), err)
+			// 開始できたセンサーをセッション外に戻し、再起動時に復元されないようにする
+			for _, began := range m.targets[:i] {
+				if rerr := began.RestoreSession("", nil); rerr != nil {
+					err = errors.Join(err, fmt.Errorf("reset %s: %w", began.GetSencorName(), rerr))
+				}
+			}
+			if rerr := os.Remove(activePath); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+				err = errors.Join(err, rerr)
+			}
+			return nil, err
+		}
+	}
+	m.active = s
+	return s, nil
+}
+
+// 記録中のセッションを終了し、全センサーのログをlogs/<セッションID>/に確定する
+func (m *Manager) Stop(id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active == nil || m.active.ID != id {
+		return nil, ErrNotActive
+	}
+	return m.finish(*m.active, false)
+}
+
+// フライトを終える
+// 記録中のセッションがあれば終了し、なければそれまでのデータを新しいセッションとしてまとめて確定する
+// 記録中のセッションもデータもなければ空のセッションは作らずErrEmptyを返す
+func (m *Manager) End(meta Metadata) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active != nil {
+		return m.finish(*m.active, false)
+	}
+	now := time.Now()
+	return m.finish(Session{
+		ID:        m.newID(now),
+		Metadata:  meta,
+		StartedAt: now,
+	}, true)
+}
+
+// 全センサーのログをlogs/<セッションID>/に確定する
+// 一時ディレクトリに書き出してから名前を変えるので、途中で失敗しても中途半端なディレクトリは残らない
+// 失敗したら確定済みのセンサーのログを一時ログファイルに戻し、全センサーを元のセッションに戻す
+// requireDataなら、どのセンサーにもデータがなければ何も確定せずErrEmptyを返す
+// mu を取った状態で呼ぶ
+func (m *Manager) finish(s Session, requireData bool) (*Session, error) {
+	staging := filepath.Join(m.logDir, "."+s.ID+".tmp")
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", staging, err)
+	}
+	previous := ""
+	if m.active != nil {
+		previous = m.active.ID
+	}
+	// 終了したセンサーの番号と確定したファイル
+	ended := map[int][]string{}
+	var files []string
+	for i, t := range m.targets {
+		f, err := t.EndSession(staging)
+		if errors.Is(err, sensor.ErrNoData) {
+			ended[i] = nil
+			continue
+		}
+		if err != nil {
+			return nil, m.rollback(staging, previous, ended, fmt.Errorf("finalize %s: %w", t.GetSencorName(), err))
+		}
+		ended[i] = f
+		files = append(files, f...)
+	}
+	if requireData && len(files) == 0 {
+		return nil, m.rollback(staging, previous, ended, ErrEmpty)
+	}
+
+	now := time.Now()
+	s.Status = StatusStopped
+	s.StoppedAt = &now
+	s.Dir = filepath.Join(m.logDir, s.ID)
+	s.Files = []string{}
+	for _, f := range files {
+		s.Files = append(s.Files, filepath.Join(s.Dir, filepath.Base(f)))
+	}
+	if err := m.writeJSON(filepath.Join(staging, metadataFile), &s); err != nil {
+		return nil, m.rollback(staging, previous, ended, err)
+	}
+	if err := os.Rename(staging, s.Dir); err != nil {
+		return nil, m.rollback(staging, previous, ended, fmt.Errorf("failed to move session logs into %s: %w", s.Dir, err))
+	}
+	if err := os.Remove(filepath.Join(m.logDir, activeFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warn("failed to remove active session file", "file", activeFile, "err", err)
+	}
+	m.active = nil
+	return &s, nil
+}
+
+// 終了したセンサーのログを一時ログファイルに戻してセッションをpreviousに戻し、一時ディレクトリを消す
+// 戻せなかったセンサーがあれば、そのログが残っている一時ディレクトリは消さずにエラーに足して返す
+func (m *Manager) rollback(staging, previous string, ended map[int][]string, err error) error {
+	restored := true
+	for i, t := range m.targets {
+		files, ok := ended[i]
+		if !ok {
+			continue
+		}
+		if rerr := t.RestoreSession(previous, files); rerr != nil {
+			err = errors.Join(err, fmt.Errorf("restore %s: %w", t.GetSencorName(), rerr))
+			restored = false
+		}
+	}
+	if !restored {
+		logger.Error("failed to roll back session logs", "dir", staging, "err", err)
+		return err
+	}
+	if rerr := os.RemoveAll(staging); rerr != nil {
+		err = errors.Join(err, rerr)
+	}
+	return err
+}
+
+// 記録中のセッションを返す
+func (m *Manager) Active() *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active == nil {
+		return nil
+	}
+	s := *m.active
+	return &s
+}
+
+// 保存済みのセッションを返す
+// なければErrNotFoundを返す
+func (m *Manager) Get(id string) (*Session, error) {
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, id)
+	}
+	p := filepath.Join(m.logDir, id, metadataFile)
+	raw, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+	}
+	return &s, nil
+}
+
+// 記録中と保存済みのセッションを新しい順に返す
+func (m *Manager) List() ([]Session, error) {
+	sessions := []Session{}
+	if active := m.Active(); active != nil {
+		sessions = append(sessions, *active)
+	}
+	paths, err := filepath.Glob(filepath.Join(m.logDir, "*", metadataFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var s Session
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+		}
+		sessions = append(sessions, s)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.After(sessions[j].StartedAt)
+	})
+	return sessions, nil
+}
+
+// セッションのルーティングを設定する
+func (m *Manager) RegisterRoutes(e *echo.Echo) {
+	e.GET("/sessions", m.GetSessions)
+	e.POST("/sessions", m.PostSession)
+	e.POST("/sessions/:id/stop", m.PostStop)
+}
+
+// セッションの一覧を返す
+func (m *Manager) GetSessions(c echo.Context) error {
+	sessions, err := m.List()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error listing sessions: %v", err))
+	}
+	return c.JSON(http.StatusOK, sessions)
+}
+
+// リクエストボディのメタデータで新しいセッションを開始する
+func (m *Manager) PostSession(c echo.Context) error {
+	var meta Metadata
+	if err := c.Bind(&meta); err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Error binding session metadata: %v", err))
+	}
+	s, err := m.Start(meta)
+	if errors.Is(err, ErrActive) {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error starting session: %v", err))
+	}
+	return c.JSON(http.StatusCreated, s)
+}
+
+// セッションを終了してログを確定する
+func (m *Manager) PostStop(c echo.Context) error {
+	s, err := m.Stop(c.Param("id"))
+	if errors.Is(err, ErrNotActive) {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error stopping session: %v", err))
+	}
+	return c.JSON(http.StatusOK, s)
+}
+
+// 同じ秒に複数のセッションを作っても重ならないIDを返す
+func (m *Manager) newID(now time.Time) string {
+	id := now.Format("20060102_150405")
+	for i := 2; ; i++ {
+		_, err := os.Stat(filepath.Join(m.logDir, id))
+		if errors.Is(err, os.ErrNotExist) {
+			return id
+		}
+		id = fmt.Sprintf("%s_%d", now.Format("20060102_150405"), i)
+	}
+}
+
+// 前回記録中のままだったセッションを中断扱いで保存する
+// ログ本体は起動時の復旧処理でrecoveredに移される
+func (m *Manager) restoreInterrupted(recoveredDir string) error {
+	path := filepath.Join(m.logDir, activeFile)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s Session
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	s.Status = StatusInterrupted
+	s.Dir = filepath.Join(m.logDir, s.ID)
+	s.RecoveredDir = recoveredDir
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	if err := m.writeJSON(filepath.Join(s.Dir, metadataFile), &s); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (m *Manager) writeJSON(path string, v any) error {
+	json_, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, json_, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
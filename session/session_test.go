@@ -0,0 +1,181 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TitechMeister/Neon/sensor"
+)
+
+// セッションの開始と終了を記録するだけのセンサー
+type fakeTarget struct {
+	name     string
+	beginErr error
+	endErr   error
+	session  string
+	restored []string
+}
+
+func (f *fakeTarget) GetSencorName() string {
+	return f.name
+}
+
+func (f *fakeTarget) BeginSession(id string) error {
+	if f.beginErr != nil {
+		return f.beginErr
+	}
+	f.session = id
+	return nil
+}
+
+func (f *fakeTarget) EndSession(dir string) ([]string, error) {
+	if f.endErr != nil {
+		return nil, f.endErr
+	}
+	name := filepath.Join(dir, f.name+"_log.json")
+	if err := os.WriteFile(name, []byte("[]"), 0644); err != nil {
+		return nil, err
+	}
+	f.session = ""
+	return []string{name}, nil
+}
+
+func (f *fakeTarget) RestoreSession(id string, files []string) error {
+	f.session = id
+	for _, name := range files {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		f.restored = append(f.restored, filepath.Base(name))
+	}
+	return nil
+}
+
+// 途中のセンサーで確定に失敗したら、確定済みのセンサーも含めてセッションを終了する前に戻す
+func TestStopRollsBackOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	a, b := &fakeTarget{name: "a"}, &fakeTarget{name: "b"}
+	m, err := NewManager(dir, []Target{a, b}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := m.Start(Metadata{Pilot: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.endErr = errors.New("disk full")
+	if _, err := m.Stop(s.ID); err == nil {
+		t.Fatal("Stop succeeded with a failing target")
+	}
+	for _, name := range []string{"." + s.ID + ".tmp", s.ID} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists after a failed stop", name)
+		}
+	}
+	if active := m.Active(); active == nil || active.ID != s.ID {
+		t.Fatalf("active session = %v, want %s", active, s.ID)
+	}
+	if _, err := os.Stat(filepath.Join(dir, activeFile)); err != nil {
+		t.Errorf("active session file: %v", err)
+	}
+	if a.session != s.ID || b.session != s.ID {
+		t.Errorf("sessions = %q, %q, want %q", a.session, b.session, s.ID)
+	}
+	if len(a.restored) != 1 || a.restored[0] != "a_log.json" {
+		t.Errorf("restored files of a = %v", a.restored)
+	}
+
+	// 原因がなくなれば同じセッションを終了できる
+	b.endErr = nil
+	stopped, err := m.Stop(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stopped.Files) != 2 {
+		t.Errorf("files = %v, want logs of a and b", stopped.Files)
+	}
+	for _, f := range stopped.Files {
+		if _, err := os.Stat(f); err != nil {
+			t.Error(err)
+		}
+	}
+	if m.Active() != nil {
+		t.Error("session is still active after stop")
+	}
+}
+
+// 途中のセンサーで開始に失敗したら、開始したセンサーを戻し、再起動しても中断扱いのセッションを残さない
+func TestStartRollsBackOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	a, b := &fakeTarget{name: "a"}, &fakeTarget{name: "b", beginErr: errors.New("disk full")}
+	m, err := NewManager(dir, []Target{a, b}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Start(Metadata{}); err == nil {
+		t.Fatal("Start succeeded with a failing target")
+	}
+	if a.session != "" {
+		t.Errorf("session of a = %q, want none", a.session)
+	}
+	if m.Active() != nil {
+		t.Error("session is active after a failed start")
+	}
+	if _, err := os.Stat(filepath.Join(dir, activeFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("active session file exists after a failed start")
+	}
+
+	restarted, err := NewManager(dir, []Target{a, b}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := restarted.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("sessions after restart = %v, want none", sessions)
+	}
+}
+
+// 記録中のセッションもデータもなければ、フライトを終えても空のセッションを作らない
+func TestEndWithoutData(t *testing.T) {
+	dir := t.TempDir()
+	a := &fakeTarget{name: "a", endErr: sensor.ErrNoData}
+	m, err := NewManager(dir, []Target{a}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.End(Metadata{}); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("End = %v, want ErrEmpty", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("log dir has %d entries after an empty end, want none", len(entries))
+	}
+
+	// データがあれば確定し、保存済みのセッションとして読める
+	a.endErr = nil
+	s, err := m.End(Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.Get(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != s.ID || got.Dir != s.Dir || len(got.Files) != 1 {
+		t.Errorf("Get = %+v, want %+v", got, s)
+	}
+	for _, id := range []string{"missing", "../" + s.ID, ".", ""} {
+		if _, err := m.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) = %v, want ErrNotFound", id, err)
+		}
+	}
+}
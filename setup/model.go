@@ -1,6 +1,28 @@
 package setup
 
-import "github.com/labstack/echo"
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/TitechMeister/Neon/config"
+	"github.com/TitechMeister/Neon/fault"
+	"github.com/TitechMeister/Neon/frame"
+	"github.com/TitechMeister/Neon/health"
+	"github.com/TitechMeister/Neon/ingest"
+	"github.com/TitechMeister/Neon/recovery"
+	"github.com/TitechMeister/Neon/replay"
+	"github.com/TitechMeister/Neon/serial"
+	"github.com/TitechMeister/Neon/session"
+	"github.com/TitechMeister/Neon/simulator"
+	"github.com/TitechMeister/Neon/source"
+	"github.com/TitechMeister/Neon/stream"
+	"github.com/TitechMeister/Neon/tsdb"
+	"github.com/TitechMeister/Neon/upstream"
+	"github.com/labstack/echo"
+)
 
 type Sencor interface {
 	// センサーの名前を取得する
@@ -9,14 +31,68 @@ type Sencor interface {
 	GetData(c echo.Context) error
 	// Echoサーバ経由のリクエストでデータをログに記録する
 	PostData(c echo.Context) error
-	// serialサーバを叩いてログ記録
+	// データ源から1件取得してログ記録
 	LogData() error
+	// データ源からデータを受け取り続ける(ctxがキャンセルされるまで戻らない)
+	Run(ctx context.Context)
 	// serialサーバを叩く頻度を返す(周波数)
 	GetLogFrequency() int
+	// 最新のデータをUI用に整形して返す
+	LatestPoint() (frame.Point, bool)
+	// 時間範囲のデータをUI用に整形して返す
+	Points(from, to time.Time) ([]frame.Point, error)
+	// データの受け取りと失敗の状態を返す
+	Status() health.Status
+	// 押し込まれたデータを1件受け取り、すでに受け取っていたかを返す
+	Push(data json.RawMessage) (duplicate bool, err error)
+	// デバイスごとの時計の推定結果を返す
+	ClockStatus() []clock.DeviceStatus
 	// Echoサーバ経由のリクエストでデータの履歴を取得する
 	GetHistory(c echo.Context) error
+	// センサーのルーティングをEchoに登録する
+	RegisterRoutes(e *echo.Echo)
+	// 書き込み待ちのログをすべて一時ログファイルに書き出す
+	Flush() error
+	// 一時ログファイルを閉じる
+	Close() error
+	// 一時ログファイルを確定したログとして保存し、そのパスを返す
+	Finalize() (string, error)
+	// それまでのログを確定し、以降のログにフライトセッションのIDを付ける
+	BeginSession(id string) error
+	// セッション中のログをdirの下に確定し、そのパスを返す
+	EndSession(dir string) ([]string, error)
+	// 開始や終了に失敗したセッションを取り消し、記録中のセッションをidに戻す
+	RestoreSession(id string, files []string) error
 }
 
 type Neon struct {
 	Sencors []*Sencor
+	// 起動時に読み込んだ設定
+	Config *config.Config
+	// ルーティング済みのEchoサーバ
+	Echo *echo.Echo
+	// 一時ログファイルの復旧
+	Recovery *recovery.Recovery
+	// フライトセッションの管理
+	Sessions *session.Manager
+	Store    *tsdb.Store
+	// ログ再生の時計(再生するセンサーがなければnil)
+	Replay *replay.Controller
+	// モックデータの元になる機体のシミュレータ(モックのセンサーがなければnil)
+	Simulator *simulator.Simulator
+	// センサーごとの故障の起こし方
+	Faults *fault.Manager
+	// 受け取ったデータのライブ配信
+	Stream *stream.Hub
+	// 全センサーで共有するserialサーバのクライアント
+	Upstream *upstream.Client
+	// serialサーバからまとめて取得する(まとめないならnil)
+	Batch *source.Scheduler
+	// 押し込まれたデータの受け付け
+	Ingest *ingest.Server
+	// シリアルデバイス(シリアルから読むセンサーがなければnil)
+	Serial *serial.Port
+
+	// 動作中のロガーのgoroutine
+	loggers sync.WaitGroup
 }
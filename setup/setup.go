@@ -1,37 +1,191 @@
 package setup
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"time"
 
 	"github.com/TitechMeister/Neon/altimeter"
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/TitechMeister/Neon/config"
+	"github.com/TitechMeister/Neon/fault"
+	"github.com/TitechMeister/Neon/flight"
+	"github.com/TitechMeister/Neon/frame"
 	"github.com/TitechMeister/Neon/gps"
+	"github.com/TitechMeister/Neon/health"
+	"github.com/TitechMeister/Neon/ingest"
+	"github.com/TitechMeister/Neon/logfile"
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/TitechMeister/Neon/metrics"
 	"github.com/TitechMeister/Neon/pitot"
+	"github.com/TitechMeister/Neon/recovery"
+	"github.com/TitechMeister/Neon/replay"
+	"github.com/TitechMeister/Neon/sensor"
+	"github.com/TitechMeister/Neon/serial"
 	"github.com/TitechMeister/Neon/servo"
+	"github.com/TitechMeister/Neon/session"
+	"github.com/TitechMeister/Neon/simulator"
+	"github.com/TitechMeister/Neon/source"
+	"github.com/TitechMeister/Neon/stream"
 	"github.com/TitechMeister/Neon/tacho"
+	"github.com/TitechMeister/Neon/tsdb"
+	"github.com/TitechMeister/Neon/upstream"
 	"github.com/labstack/echo"
-	"github.com/labstack/echo/middleware"
 )
 
-func Setup() *echo.Echo {
-	app := &Neon{}
-	altimeter := altimeter.New(2) // Create a new instance of the Altimeter struct
-	gps := gps.New(1)             // Create a new instance of the GPS struct
-	pitot := pitot.New(2)         // Create a new instance of the Pitot struct
-	tacho := tacho.New(1)         // Create a new instance of the TachoMeter struct
-	servo := servo.New(2)         // Create a new instance of the Servo struct
-	// Initialize the Altimeter instance, which is a struct that handles altimeter data.
-	app.AddSencor(altimeter) // Add the Altimeter instance to the Neon application
-	app.AddSencor(gps)       // Add the GPS instance to the Neon application
-	app.AddSencor(pitot)     // Add the Pitot instance to the Neon application
-	app.AddSencor(tacho)     // Add the TachoMeter instance to the Neon application
-	app.AddSencor(servo)     // Add the Servo instance to the Neon
+var logger = logging.For("setup")
+
+// ctxがキャンセルされるとロガーが停止する
+func Setup(ctx context.Context, cfg *config.Config) *Neon {
+	app := &Neon{Config: cfg}
+	// 時系列ストアを開く
+	// 開けなければストアなしで動かす(履歴は一時ログファイルから読む)
+	store, err := tsdb.Open(cfg.Store.Dir, tsdb.Options{
+		SegmentDuration: cfg.Store.SegmentDuration.Std(),
+		Retention:       cfg.Store.Retention.Std(),
+		CompactSize:     int64(cfg.Store.CompactSize),
+	})
+	if err != nil {
+		logger.Warn("failed to open time-series store", "dir", cfg.Store.Dir, "err", err)
+	} else {
+		app.Store = store
+		app.loggers.Add(1)
+		go func() {
+			defer app.loggers.Done()
+			store.Run(ctx, cfg.Store.MaintainInterval.Std())
+		}()
+	}
+	// 全センサーでserialサーバへの接続と遮断器を共有する
+	app.Upstream = upstream.New(cfg.Upstream.URL, upstream.Options{
+		Timeout:            cfg.Upstream.Timeout.Std(),
+		Retries:            cfg.Upstream.Retries,
+		RetryBackoff:       cfg.Upstream.RetryBackoff.Std(),
+		BreakerThreshold:   cfg.Upstream.Breaker.Threshold,
+		BreakerCooldown:    cfg.Upstream.Breaker.Cooldown.Std(),
+		BreakerMaxCooldown: cfg.Upstream.Breaker.MaxCooldown.Std(),
+	})
+	if cfg.Upstream.Batch {
+		// serialサーバを叩くセンサーのデータを1回のリクエストでまとめて取得する
+		app.Batch = source.NewScheduler(app.Upstream, cfg.Upstream.BatchPath)
+		app.loggers.Add(1)
+		go func() {
+			defer app.loggers.Done()
+			app.Batch.Run(ctx)
+		}()
+	}
+	// 試験用にセンサーのデータ源に故障を起こす
+	app.Faults = fault.NewManager()
+	for name, sc := range cfg.Sensors {
+		if sc.Faults != nil {
+			app.Faults.Injector(name).SetProfile(*sc.Faults)
+		}
+	}
+	// 受け取ったデータをUIにライブ配信する
+	names := []string{}
+	for name := range cfg.Sensors {
+		names = append(names, name)
+	}
+	app.Stream = stream.NewHub(names...)
+	// ログを再生するセンサーがあれば再生の時計を、モックのセンサーがあれば共有するシミュレータを、
+	// シリアルから読むセンサーがあればシリアルデバイスを用意する
+	for _, sc := range cfg.Sensors {
+		switch {
+		case sc.Source == source.KindReplay && app.Replay == nil:
+			app.Replay = replay.NewController(cfg.Replay.Path, cfg.Replay.Speed, cfg.Replay.Loop)
+		case sc.Source == source.KindMock && app.Simulator == nil:
+			app.Simulator = simulator.New()
+		case sc.Source == source.KindSerial && app.Serial == nil:
+			app.Serial = serial.NewPort(serial.Options{Device: cfg.Serial.Device, Baud: cfg.Serial.Baud})
+			app.loggers.Add(1)
+			go func() {
+				defer app.loggers.Done()
+				app.Serial.Run(ctx)
+			}()
+		}
+	}
+	// 設定ファイルの値で各センサーを初期化する
+	app.AddSencor(altimeter.New(app.sensorOptions("altimeter"))) // Add the Altimeter instance to the Neon application
+	app.AddSencor(gps.New(app.sensorOptions("gps")))             // Add the GPS instance to the Neon application
+	app.AddSencor(pitot.New(app.sensorOptions("pitot")))         // Add the Pitot instance to the Neon application
+	app.AddSencor(tacho.New(app.sensorOptions("tachometer")))    // Add the TachoMeter instance to the Neon application
+	app.AddSencor(servo.New(app.sensorOptions("servo")))         // Add the Servo instance to the Neon
+	if app.Replay != nil {
+		// すべてのセンサーのログを読み込んだので先頭から再生する
+		app.Replay.Start()
+	}
+	// 前回の実行で残った一時ログファイルを復旧する
+	// ロガーが一時ログファイルに書き込み始める前に行う
+	app.Recovery = recovery.New(cfg.Storage.TempDir, cfg.Storage.LogDir)
+	names = []string{}
+	for _, sencor := range app.Sencors {
+		names = append(names, (*sencor).GetSencorName())
+	}
+	recoveredDir := ""
+	var manifest *recovery.Manifest
+	manifest, err = app.Recovery.Run(names)
+	if err != nil {
+		logger.Warn("failed to recover temp logs", "err", err)
+	} else if manifest != nil {
+		logger.Info("recovered temp log files", "count", len(manifest.Files), "dir", manifest.Dir)
+		recoveredDir = manifest.Dir
+	}
+	// フライトセッションの管理
+	targets := []session.Target{}
+	for _, sencor := range app.Sencors {
+		targets = append(targets, *sencor)
+	}
+	app.Sessions, err = session.NewManager(cfg.Storage.LogDir, targets, recoveredDir)
+	if err != nil {
+		logger.Warn("failed to restore interrupted session", "err", err)
+	}
+	// serialサーバやロガーから押し込まれたデータを受け付ける
+	ingestTargets := []ingest.Target{}
+	for _, sencor := range app.Sencors {
+		ingestTargets = append(ingestTargets, *sencor)
+	}
+	app.Ingest = ingest.New(ingestTargets)
+	if cfg.Ingest.TCPAddress != "" {
+		if _, err := app.Ingest.ListenTCP(cfg.Ingest.TCPAddress); err != nil {
+			logger.Warn("failed to listen for pushed data", "addr", cfg.Ingest.TCPAddress, "err", err)
+		}
+	}
 	// すべてのセンサーのロガーをセットアップ
-	for _, sensor := range app.Sencors {
-		app.loggerSetup(*sensor)
+	for _, sencor := range app.Sencors {
+		app.loggerSetup(ctx, *sencor)
+	}
+	app.Echo = app.echoSetup()
+	return app // Return the application with the configured routes
+}
+
+// 設定ファイルの内容からセンサーの動作設定を作る
+func (app *Neon) sensorOptions(name string) sensor.Options {
+	cfg := app.Config
+	sc := cfg.Sensors[name]
+	return sensor.Options{
+		LogFrequency: sc.LogFrequency,
+		UpstreamURL:  cfg.Upstream.URL,
+		UpstreamPath: sc.UpstreamPath,
+		Upstream:     app.Upstream,
+		Batch:        app.Batch,
+		Bucket:       cfg.Storage.Bucket,
+		LogDir:       cfg.Storage.LogDir,
+		UILogDir:     cfg.Storage.UILogDir,
+		TempDir:      cfg.Storage.TempDir,
+		HistoryLimit: cfg.History.Limit,
+		HistoryKeep:  cfg.History.Keep,
+		Source:       sc.Source,
+		Replay:       app.Replay,
+		Simulator:    app.Simulator,
+		Faults:       app.Faults.Injector(name),
+		Stream:       app.Stream,
+		Serial:       app.Serial,
+		Writer: logfile.Policy{
+			BufferSize:    cfg.Storage.Writer.BufferSize,
+			FlushInterval: cfg.Storage.Writer.FlushInterval.Std(),
+			Sync:          cfg.Storage.Writer.Sync,
+		},
+		Store: app.Store,
 	}
-	e := app.echoSetup()
-	return e // Return the Echo instance with the configured routes
 }
 
 func (app *Neon) AddSencor(sencor Sencor) {
@@ -40,21 +194,78 @@ func (app *Neon) AddSencor(sencor Sencor) {
 	app.Sencors = append(app.Sencors, &sencor)
 }
 
-func (app *Neon) loggerSetup(sencor Sencor) {
-	// altimeter内の関数LogDataをgoroutineを用いて周波数に合わせて実行
+func (app *Neon) loggerSetup(ctx context.Context, sencor Sencor) {
+	// センサーごとにgoroutineでデータ源からデータを受け取る
+	app.loggers.Add(1)
+	go func() {
+		defer app.loggers.Done()
+		logger.Info("starting logger", "sensor", sencor.GetSencorName())
+		// ctxがキャンセルされたら終了する
+		sencor.Run(ctx)
+	}()
+}
+
+// Echoサーバを止め、ロガーの終了を待ってからメモリ上の履歴をすべて書き出す
+// Setupに渡したctxは先にキャンセルしておくこと
+func (app *Neon) Shutdown(ctx context.Context) error {
+	var errs []error
+	// ライブ配信の接続は終わらないので先に切る
+	app.Stream.Close()
+	// データを押し込む接続も切る
+	if err := app.Ingest.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("close ingest: %w", err))
+	}
+	// 新しいリクエストの受付を止め、処理中のリクエストを待つ
+	if err := app.Echo.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("echo shutdown: %w", err))
+	}
+
+	// ロガーのgoroutineが止まるのを待つ
+	done := make(chan struct{})
 	go func() {
-		// This function sets up a logger for the Altimeter instance.
-		fmt.Println("Setting up logger for sencor:", sencor.GetSencorName())
+		app.loggers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("waiting for loggers: %w", ctx.Err()))
+	}
 
-		// Tickerを作成
-		ticker := time.NewTicker(time.Second / time.Duration(sencor.GetLogFrequency()))
-		defer ticker.Stop() // goroutineが終了する際にTickerを停止
+	// 記録中のセッションがあれば終了して確定する
+	if active := app.Sessions.Active(); active != nil && app.Config.Server.FinalizeOnShutdown {
+		if s, err := app.Sessions.Stop(active.ID); err != nil {
+			errs = append(errs, fmt.Errorf("stop session %s: %w", active.ID, err))
+		} else {
+			logger.Info("finalized session", "session", s.ID, "dir", s.Dir)
+		}
+	}
 
-		// Tickerのチャンネルから定期的にシグナルを受信
-		for range ticker.C {
-			sencor.LogData()
+	for _, sencor := range app.Sencors {
+		s := *sencor
+		if err := s.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("flush %s: %w", s.GetSencorName(), err))
 		}
-	}()
+		if app.Config.Server.FinalizeOnShutdown {
+			name, err := s.Finalize()
+			switch {
+			case errors.Is(err, sensor.ErrNoData):
+			case err != nil:
+				errs = append(errs, fmt.Errorf("finalize %s: %w", s.GetSencorName(), err))
+			default:
+				logger.Info("finalized log", "sensor", s.GetSencorName(), "file", name)
+			}
+		}
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close %s: %w", s.GetSencorName(), err))
+		}
+	}
+	if app.Store != nil {
+		if err := app.Store.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close store: %w", err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (app *Neon) echoSetup() *echo.Echo {
@@ -68,18 +279,43 @@ func (app *Neon) echoSetup() *echo.Echo {
 
 	// Create a new Echo instance, which is a web framework for Go.
 	e.GET("/ping", ping)
+	e.GET("/recovery", app.Recovery.GetRecovered)
+	app.Sessions.RegisterRoutes(e)
+	if app.Replay != nil {
+		app.Replay.RegisterRoutes(e)
+	}
+	if app.Simulator != nil {
+		app.Simulator.RegisterRoutes(e)
+	}
+	app.Faults.RegisterRoutes(e)
+	app.Stream.RegisterRoutes(e)
+	flight.New(app.Sessions, app.Config.Storage.Bucket).RegisterRoutes(e)
+	// 全センサーをまとめたデータ
+	frameTargets := []frame.Target{}
+	for _, sencor := range app.Sencors {
+		frameTargets = append(frameTargets, *sencor)
+	}
+	frame.New(frameTargets).RegisterRoutes(e)
+	// デバイスの時計の推定結果
+	clockTargets := []clock.Target{}
+	for _, sencor := range app.Sencors {
+		clockTargets = append(clockTargets, *sencor)
+	}
+	clock.NewHandler(clockTargets).RegisterRoutes(e)
+	// センサーごとの受け取りの状態
+	healthTargets := []health.Target{}
+	for _, sencor := range app.Sencors {
+		healthTargets = append(healthTargets, *sencor)
+	}
+	health.NewHandler(healthTargets).RegisterRoutes(e)
+	app.Upstream.RegisterRoutes(e)
+	app.Ingest.RegisterRoutes(e)
+	metrics.RegisterRoutes(e)
+	logging.RegisterRoutes(e)
 	for _, sencor := range app.Sencors {
-		s := sencor // Create a local variable to avoid closure issues in the loop
 		// Loop through all sensors in the Neon application and set up their routes.
-		// Each sensor has its own routes for getting data, logging data, and getting history.
-		e.GET("/data/"+(*s).GetSencorName(), (*s).GetData)
-		e.POST("/data/"+(*s).GetSencorName()+"/log", (*s).PostData)
-		e.GET("/data/"+(*s).GetSencorName()+"/history", (*s).GetHistory)
-		// sencorタイプがGPSの場合
-		if g, ok := (*s).(*gps.GPS); ok {
-			// GPSセンサーの特定のルートを設定
-			e.POST("/data/gps/target", (*g).PostTarget)
-		}
+		// Each sensor registers its own routes for getting data, logging data, and getting history.
+		(*sencor).RegisterRoutes(e)
 	}
 
 	// e.GET("/altimeter", altimeter.GetAltimeterData)
@@ -87,8 +323,10 @@ func (app *Neon) echoSetup() *echo.Echo {
 	// e.GET("/altimeter/history", altimeter.GetAltimeterHistory)
 
 	// Define a route that listens for GET requests on the /ping endpoint and calls the ping function.
-	// middlewareのロガーを利用する
-	e.Use(middleware.Logger())
+	// リクエストのログもNeonのログと同じ出力先に書く
+	e.Use(logging.Middleware())
+	// リクエストの数と処理時間を数える
+	e.Use(metrics.Middleware())
 	return e
 }
 
@@ -0,0 +1,84 @@
+package simulator
+
+import (
+	"sync"
+	"time"
+)
+
+// 飛行の段階
+const (
+	// プラットフォームの上で発進を待っている
+	PhasePlatform = "platform"
+	// プラットフォームの上を助走している
+	PhaseLaunch = "launch"
+	// 飛んでいる(ペダルを漕いでいるかどうかはPowerで分かる)
+	PhaseFlight = "flight"
+	// 着水して水面に浮いている
+	PhaseSplashdown = "splashdown"
+)
+
+// 機体の状態
+// 角度は度、長さはメートル、速さはm/s
+type State struct {
+	Time  time.Time `json:"time"`
+	Phase string    `json:"phase"`
+	// 発進を始めてからの秒数
+	Elapsed float64 `json:"elapsed"`
+
+	// プラットフォームからの位置(東、北)
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	// 緯度経度
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	// 水面からの高度
+	Altitude  float64 `json:"altitude"`
+	ClimbRate float64 `json:"climb_rate"`
+
+	Airspeed    float64 `json:"airspeed"`
+	GroundSpeed float64 `json:"ground_speed"`
+	// 機首方位と対地の進行方向(北から時計回り)
+	Heading float64 `json:"heading"`
+	Track   float64 `json:"track"`
+	// 経路角、バンク角、迎角、横滑り角
+	FlightPath    float64 `json:"flight_path"`
+	Bank          float64 `json:"bank"`
+	AngleOfAttack float64 `json:"angle_of_attack"`
+	Sideslip      float64 `json:"sideslip"`
+
+	// パイロットの出力(W)
+	Power float64 `json:"power"`
+	// プロペラの回転数(rev/s)とトルク(N・m)
+	PropRPS    float64 `json:"prop_rps"`
+	PropTorque float64 `json:"prop_torque"`
+
+	// 操縦の指令と実際の舵角
+	RudderCommand   float64 `json:"rudder_command"`
+	ElevatorCommand float64 `json:"elevator_command"`
+	Trim            float64 `json:"trim"`
+	RudderAngle     float64 `json:"rudder_angle"`
+	ElevatorAngle   float64 `json:"elevator_angle"`
+	// サーボの電流(A)、温度(℃)、電池の電圧(V)
+	RudderCurrent    float64 `json:"rudder_current"`
+	ElevatorCurrent  float64 `json:"elevator_current"`
+	ServoTemperature float64 `json:"servo_temperature"`
+	Voltage          float64 `json:"voltage"`
+
+	// 外気温(℃)
+	AirTemperature float64 `json:"air_temperature"`
+}
+
+// 人力飛行機の簡単なモデルで、全センサーが共有する機体の状態を進める
+// 状態は読まれたときに現在時刻まで積分する
+type Simulator struct {
+	mu    sync.Mutex
+	state State
+	// 今の段階に入った時刻
+	phaseStart time.Time
+	// 経路角の指令に追従している経路角(rad)
+	gamma float64
+	// 旋回の残りの角度(度、右旋回が正)
+	turnLeft float64
+	// 次の旋回の番号
+	nextTurn int
+}
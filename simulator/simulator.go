@@ -0,0 +1,318 @@
+package simulator
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 積分の刻み
+const step = 10 * time.Millisecond
+
+// これ以上読まれない時間が空いたら最初からやり直す
+const maxGap = 10 * time.Minute
+
+// 機体とパイロット
+const (
+	gravity        = 9.81
+	airDensity     = 1.2
+	mass           = 100.0  // 機体+パイロット(kg)
+	wingArea       = 22.0   // m^2
+	parasiteDrag   = 0.015  // 有害抗力係数
+	inducedDrag    = 0.0114 // 1/(π e AR)
+	liftSlope      = 5.5    // 揚力傾斜(1/rad)
+	zeroLiftAngle  = -5.0   // 零揚力角(度)
+	maxLift        = 1.5    // 最大揚力係数
+	propDiameter   = 3.0    // m
+	advanceRatio   = 0.75
+	propEfficiency = 0.85
+	cadence        = 1.5 // ペダルの回転数(rev/s)
+)
+
+// 琵琶湖のプラットフォームと飛び方
+const (
+	originLat      = 35.2786
+	originLon      = 136.0952
+	lakeElevation  = 84.4  // 湖面の標高(m)
+	platformHeight = 10.0  // m
+	platformLength = 10.0  // 助走の距離(m)
+	launchSpeed    = 7.0   // 助走で出す速さ(m/s)
+	launchHeading  = 300.0 // 度
+	cruiseAltitude = 4.0   // m
+	turnBank       = 5.0   // 旋回のバンク角(度)
+	waitTime       = 10 * time.Second
+	floatTime      = 30 * time.Second
+	windSpeed      = 1.5   // m/s
+	windFrom       = 330.0 // 度
+	airTemperature = 22.0  // ℃
+)
+
+// 発進からの秒数と、そこで始める旋回の角度(度、右旋回が正)
+var turns = []struct {
+	at     float64
+	change float64
+}{
+	{40, 180},
+	{120, -180},
+	{200, 90},
+}
+
+// プラットフォームの上で待っている状態から始めるシミュレータを返す
+func New() *Simulator {
+	s := &Simulator{}
+	s.reset(time.Now())
+	return s
+}
+
+// 現在時刻まで進めた状態を返す
+func (s *Simulator) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(time.Now())
+	return s.state
+}
+
+// プラットフォームの上に戻す
+func (s *Simulator) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset(time.Now())
+}
+
+// シミュレータのルーティングを設定する
+func (s *Simulator) RegisterRoutes(e *echo.Echo) {
+	e.GET("/simulator", s.GetState)
+	e.POST("/simulator/reset", s.PostReset)
+}
+
+func (s *Simulator) GetState(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.State())
+}
+
+func (s *Simulator) PostReset(c echo.Context) error {
+	s.Reset()
+	return c.JSON(http.StatusOK, s.State())
+}
+
+// muを取った状態で呼ぶ
+func (s *Simulator) reset(now time.Time) {
+	s.state = State{
+		Time:           now,
+		Phase:          PhasePlatform,
+		Lat:            originLat,
+		Lon:            originLon,
+		Altitude:       platformHeight,
+		Heading:        launchHeading,
+		Track:          launchHeading,
+		Trim:           -1.5,
+		ElevatorAngle:  -1.5,
+		Voltage:        12.6,
+		AirTemperature: airTemperature,
+	}
+	s.state.ServoTemperature = airTemperature
+	s.phaseStart = now
+	s.gamma = 0
+	s.turnLeft = 0
+	s.nextTurn = 0
+}
+
+// muを取った状態で呼ぶ
+func (s *Simulator) advance(now time.Time) {
+	if now.Sub(s.state.Time) > maxGap {
+		s.reset(now)
+		return
+	}
+	for s.state.Time.Add(step).Before(now) {
+		s.step(step.Seconds())
+		s.state.Time = s.state.Time.Add(step)
+	}
+}
+
+// muを取った状態で呼ぶ
+func (s *Simulator) enter(phase string) {
+	s.state.Phase = phase
+	s.phaseStart = s.state.Time
+}
+
+// 状態をdt秒進める
+func (s *Simulator) step(dt float64) {
+	st := &s.state
+	inPhase := st.Time.Sub(s.phaseStart)
+	if st.Phase != PhasePlatform {
+		st.Elapsed += dt
+	}
+
+	switch st.Phase {
+	case PhasePlatform:
+		if inPhase >= waitTime {
+			s.enter(PhaseLaunch)
+		}
+		return
+
+	case PhaseLaunch:
+		// 一定の加速度で助走し、プラットフォームの端で飛び出す
+		st.Power = 300
+		st.Airspeed += launchSpeed * launchSpeed / (2 * platformLength) * dt
+		if math.Hypot(st.X, st.Y) >= platformLength {
+			st.Airspeed = launchSpeed
+			s.enter(PhaseFlight)
+		}
+
+	case PhaseFlight:
+		s.fly(dt)
+		if st.Altitude <= 0 {
+			st.Altitude = 0
+			st.FlightPath = 0
+			s.enter(PhaseSplashdown)
+		}
+
+	case PhaseSplashdown:
+		// 水の抵抗ですぐに止まる
+		st.Power = 0
+		st.Airspeed -= 1.5 * st.Airspeed * dt
+		st.Bank = 0
+		st.ClimbRate = 0
+		if inPhase >= floatTime {
+			s.reset(st.Time)
+			return
+		}
+	}
+
+	s.move(dt)
+	s.propeller()
+	s.servos(dt)
+	st.ServoTemperature = airTemperature + 15*(1-math.Exp(-st.Elapsed/300))
+	st.Voltage = max(12.6-0.002*st.Elapsed-0.05*(st.RudderCurrent+st.ElevatorCurrent), 11.0)
+}
+
+// 飛行中の運動
+func (s *Simulator) fly(dt float64) {
+	st := &s.state
+	st.Power = s.pilotPower()
+
+	// 旋回
+	if s.nextTurn < len(turns) && st.Elapsed >= turns[s.nextTurn].at {
+		s.turnLeft = turns[s.nextTurn].change
+		s.nextTurn++
+	}
+	bank := 0.0
+	if math.Abs(s.turnLeft) > 1 {
+		bank = math.Copysign(turnBank, s.turnLeft)
+	}
+	st.Bank += (bank - st.Bank) * dt / 1.0
+	v := max(st.Airspeed, 1)
+	turnRate := gravity * math.Tan(st.Bank*math.Pi/180) / v * 180 / math.Pi
+	st.Heading = math.Mod(st.Heading+turnRate*dt+360, 360)
+	if s.turnLeft != 0 {
+		before := s.turnLeft
+		s.turnLeft -= turnRate * dt
+		if before*s.turnLeft <= 0 {
+			s.turnLeft = 0
+		}
+	}
+
+	// 揚力と抗力
+	q := 0.5 * airDensity * v * v
+	weight := mass * gravity
+	cl := weight * math.Cos(s.gamma) / math.Cos(st.Bank*math.Pi/180) / (q * wingArea)
+	stalled := cl > maxLift
+	cl = min(cl, maxLift)
+	drag := q * wingArea * (parasiteDrag + inducedDrag*cl*cl)
+	thrust := propEfficiency * st.Power / max(v, 3)
+	st.AngleOfAttack = cl/liftSlope*180/math.Pi + zeroLiftAngle
+
+	// 巡航高度を保つように経路角を変える
+	// 揚力が足りなければ落ちていく
+	gammaCmd := math.Max(math.Min(0.08*(cruiseAltitude-st.Altitude), 3*math.Pi/180), -4*math.Pi/180)
+	if stalled {
+		lift := cl * q * wingArea * math.Cos(st.Bank*math.Pi/180)
+		s.gamma += (lift - weight*math.Cos(s.gamma)) / (mass * v) * dt
+	} else {
+		s.gamma += (gammaCmd - s.gamma) * dt / 1.5
+	}
+	st.Airspeed += ((thrust-drag)/mass - gravity*math.Sin(s.gamma)) * dt
+	st.Airspeed = max(st.Airspeed, 0)
+	st.FlightPath = s.gamma * 180 / math.Pi
+	st.ClimbRate = st.Airspeed * math.Sin(s.gamma)
+	st.Altitude += st.ClimbRate * dt
+	st.Sideslip = -0.3 * st.Bank
+
+	// 操縦: 昇降舵で経路角を、方向舵でバンクを作る
+	st.ElevatorCommand = clamp(st.Trim-2-10*(cl-1.0)-60*(gammaCmd-s.gamma), -14, 3.6)
+	st.RudderCommand = clamp(2*bank, -15, 15)
+}
+
+// パイロットの出力
+// 90秒は全力で漕ぎ、そこから60秒かけて疲れていく
+func (s *Simulator) pilotPower() float64 {
+	t := s.state.Elapsed
+	power := 260.0
+	switch {
+	case t > 150:
+		power = 120
+	case t > 90:
+		power = 260 - 140*(t-90)/60
+	}
+	// ペダルを踏むたびに出力が揺れる
+	return power * (1 + 0.1*math.Sin(2*math.Pi*2*cadence*t))
+}
+
+// 位置を進める
+func (s *Simulator) move(dt float64) {
+	st := &s.state
+	heading := st.Heading * math.Pi / 180
+	horizontal := st.Airspeed * math.Cos(s.gamma)
+	vx, vy := horizontal*math.Sin(heading), horizontal*math.Cos(heading)
+	if st.Phase != PhaseLaunch {
+		// プラットフォームの上以外は風に流される
+		wind := windFrom*math.Pi/180 + math.Pi
+		vx += windSpeed * math.Sin(wind)
+		vy += windSpeed * math.Cos(wind)
+	}
+	st.X += vx * dt
+	st.Y += vy * dt
+	st.GroundSpeed = math.Hypot(vx, vy)
+	if st.GroundSpeed > 0.1 {
+		st.Track = math.Mod(math.Atan2(vx, vy)*180/math.Pi+360, 360)
+	}
+	st.Lat = originLat + st.Y/111320
+	st.Lon = originLon + st.X/(111320*math.Cos(originLat*math.Pi/180))
+}
+
+// プロペラの回転数とトルク
+func (s *Simulator) propeller() {
+	st := &s.state
+	rps := st.Airspeed / (advanceRatio * propDiameter)
+	if st.Power == 0 {
+		// 漕いでいなければ風車になって回転が落ちる
+		rps *= 0.3
+	}
+	st.PropRPS = rps
+	st.PropTorque = 0
+	if rps > 0.1 {
+		st.PropTorque = st.Power / (2 * math.Pi * rps)
+	}
+}
+
+// サーボが指令に遅れて追従する
+func (s *Simulator) servos(dt float64) {
+	st := &s.state
+	const lag = 0.15 // 時定数(s)
+	rudderRate := (st.RudderCommand - st.RudderAngle) / lag
+	elevatorRate := (st.ElevatorCommand - st.ElevatorAngle) / lag
+	st.RudderAngle += rudderRate * dt
+	st.ElevatorAngle += elevatorRate * dt
+	st.RudderCurrent = min(0.3+0.05*math.Abs(rudderRate), 4)
+	st.ElevatorCurrent = min(0.3+0.05*math.Abs(elevatorRate)+0.02*st.Airspeed*st.Airspeed/10, 4)
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(math.Min(v, hi), lo)
+}
+
+// 湖面の標高を足した楕円体高(m)
+func (st State) Height() float64 {
+	return st.Altitude + lakeElevation
+}
@@ -0,0 +1,164 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/TitechMeister/Neon/upstream"
+)
+
+// 取得する時刻がこれだけ先のセンサーも同じリクエストにまとめる
+const batchSlack = 10 * time.Millisecond
+
+// pathはまとめて取得するserialサーバ上のパス e.g. "/data/batch"
+// serialサーバは ?paths=/data/gps,/data/pitot に {"/data/gps": {...}, "/data/pitot": {...}} を返す
+func NewScheduler(client *upstream.Client, path string) *Scheduler {
+	return &Scheduler{client: client, path: path, wake: make(chan struct{}, 1)}
+}
+
+// Schedulerからpathのデータをintervalごとに受け取るSourceを返す
+func Batched[T any](scheduler *Scheduler, path string, interval time.Duration) Source[T] {
+	return &batched[T]{scheduler: scheduler, path: path, interval: interval}
+}
+
+func (b *batched[T]) Run(ctx context.Context, sink Sink[T]) error {
+	m := b.scheduler.add(b.path, b.interval)
+	defer b.scheduler.remove(m)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case r := <-m.results:
+			if r.err != nil {
+				sink.Fail(r.err)
+				continue
+			}
+			var data T
+			if err := json.Unmarshal(r.data, &data); err != nil {
+				sink.Fail(fmt.Errorf("%w: %v", ErrDecode, err))
+				continue
+			}
+			sink.Emit(data)
+		}
+	}
+}
+
+// センサーを加える
+// 同じ間隔のセンサーが同じリクエストにまとまるように、取得する時刻を間隔の区切りに揃える
+func (s *Scheduler) add(path string, interval time.Duration) *member {
+	m := &member{
+		path:     path,
+		interval: interval,
+		next:     time.Now().Truncate(interval).Add(interval),
+		results:  make(chan result, 1),
+	}
+	s.mu.Lock()
+	s.members = append(s.members, m)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return m
+}
+
+func (s *Scheduler) remove(m *member) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.members {
+		if other == m {
+			s.members = append(s.members[:i], s.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// ctxがキャンセルされるまで、取得する時刻が来たセンサーをまとめて取得する
+func (s *Scheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		due, wait := s.due(time.Now())
+		if len(due) > 0 {
+			s.fetch(ctx, due)
+			continue
+		}
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// 取得する時刻が来たセンサーと、次のセンサーまでの待ち時間を返す
+// 返したセンサーの次に取得する時刻は進めておく
+func (s *Scheduler) due(now time.Time) ([]*member, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*member
+	wait := time.Hour
+	for _, m := range s.members {
+		if m.next.After(now.Add(batchSlack)) {
+			wait = min(wait, m.next.Sub(now))
+			continue
+		}
+		due = append(due, m)
+		m.next = m.next.Add(m.interval)
+		// 取得が遅れて時刻を過ぎていれば、過ぎた分は取得せず区切りに揃え直す
+		if !m.next.After(now) {
+			m.next = now.Truncate(m.interval).Add(m.interval)
+		}
+	}
+	return due, wait
+}
+
+// dueのセンサーのデータを1回のリクエストで取得してそれぞれに渡す
+func (s *Scheduler) fetch(ctx context.Context, due []*member) {
+	paths := make([]string, len(due))
+	interval := due[0].interval
+	for i, m := range due {
+		paths[i] = m.path
+		interval = min(interval, m.interval)
+	}
+	start := time.Now()
+	body, err := s.client.Get(ctx, s.path+"?paths="+url.QueryEscape(strings.Join(paths, ",")), s.client.Timeout(interval))
+	var frames map[string]json.RawMessage
+	if err == nil {
+		if err = json.Unmarshal(body, &frames); err != nil {
+			err = fmt.Errorf("%w: %v", ErrDecode, err)
+		}
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	fetchDuration.With(s.path, result).Observe(time.Since(start).Seconds())
+	if ctx.Err() != nil {
+		return
+	}
+	for _, m := range due {
+		r := resultFor(m.path, frames, err)
+		select {
+		case m.results <- r:
+		default:
+		}
+	}
+}
+
+func resultFor(path string, frames map[string]json.RawMessage, err error) result {
+	if err != nil {
+		return result{err: err}
+	}
+	data, ok := frames[path]
+	if !ok || string(data) == "null" {
+		return result{err: fmt.Errorf("%s is missing from the batch response", path)}
+	}
+	return result{data: data}
+}
@@ -0,0 +1,9 @@
+package source
+
+import (
+	"github.com/TitechMeister/Neon/metrics"
+)
+
+// serialサーバへのリクエストの指標
+var fetchDuration = metrics.NewHistogramVec("neon_upstream_fetch_duration_seconds",
+	"Time to fetch a sample from the serial server, by path and result.", metrics.DefaultBuckets, "path", "result")
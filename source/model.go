@@ -0,0 +1,119 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/TitechMeister/Neon/upstream"
+)
+
+// データ源の種類
+const (
+	// serialサーバ(localhost:7878)をHTTPで叩く
+	KindHTTP = "http"
+	// センサーごとのモックデータを作る
+	KindMock = "mock"
+	// 記録したログを再生する
+	KindReplay = "replay"
+	// serialサーバやロガーから押し込まれるのを待つ
+	KindPush = "push"
+	// シリアルデバイスから直接読む
+	KindSerial = "serial"
+)
+
+// Fetcherが今回はデータがないことを表すエラー(失敗としては扱わない)
+var ErrSkip = errors.New("no sample")
+
+// データを読めなかったことを表すエラー(通信の失敗と分けて数える)
+var ErrDecode = errors.New("undecodable data")
+
+// 設定で選べるデータ源の種類
+var Kinds = []string{KindHTTP, KindMock, KindReplay, KindPush, KindSerial}
+
+// センサーのデータ源
+// 受け取ったデータや失敗をsinkに渡し、ctxがキャンセルされるまで戻らない
+type Source[T any] interface {
+	Run(ctx context.Context, sink Sink[T]) error
+}
+
+// データ源から呼ばれる受け取り側
+type Sink[T any] interface {
+	// データを1件受け取る
+	Emit(data T)
+	// データの取得に失敗した
+	Fail(err error)
+}
+
+// 呼ばれるたびに1件取得するデータ源
+// Pollで周期的に呼び出すSourceにする
+type Fetcher[T any] interface {
+	Fetch(ctx context.Context) (T, error)
+}
+
+// 関数をFetcherとして使う
+type FetchFunc[T any] func(ctx context.Context) (T, error)
+
+// serialサーバからJSONを取得するFetcher
+type HTTP[T any] struct {
+	Client *upstream.Client
+	// serialサーバ上のパス e.g. "/data/gps"
+	Path string
+	// 1回の取得の時間制限(0なら制限しない)
+	Timeout time.Duration
+}
+
+// すぐにエラーを返すSource
+// データ源を作れなかったときに使う
+type failed[T any] struct {
+	err error
+}
+
+// 自分からは何も取得しないSource
+// データはSourceの外からSinkに渡す
+type idle[T any] struct{}
+
+// Fetcherを一定間隔で呼び出すSource
+type poller[T any] struct {
+	fetcher  Fetcher[T]
+	interval time.Duration
+}
+
+// 複数のセンサーのデータをserialサーバへの1回のリクエストでまとめて取得する
+// 取得する時刻が来たセンサーをまとめ、結果をそれぞれのセンサーに渡す
+type Scheduler struct {
+	client *upstream.Client
+	// まとめて取得するパス e.g. "/data/batch"
+	path string
+
+	mu      sync.Mutex
+	members []*member
+	// センサーが加わったことをRunに知らせる
+	wake chan struct{}
+}
+
+// Schedulerから取得する1センサー分
+type member struct {
+	// serialサーバ上のパス e.g. "/data/gps"
+	path     string
+	interval time.Duration
+	// 次に取得する時刻
+	next time.Time
+	// 取得した結果(受け取り側が遅れていれば新しい結果を捨てる)
+	results chan result
+}
+
+// まとめて取得した1センサー分の結果
+type result struct {
+	data json.RawMessage
+	err  error
+}
+
+// Schedulerから結果を受け取るSource
+type batched[T any] struct {
+	scheduler *Scheduler
+	path      string
+	interval  time.Duration
+}
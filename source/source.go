@@ -0,0 +1,106 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func (f FetchFunc[T]) Fetch(ctx context.Context) (T, error) {
+	return f(ctx)
+}
+
+// モックデータを作る関数をFetcherにする
+func Mock[T any](mock func() T) Fetcher[T] {
+	return FetchFunc[T](func(context.Context) (T, error) {
+		return mock(), nil
+	})
+}
+
+// serialサーバを叩いてデータを取得する
+func (h *HTTP[T]) Fetch(ctx context.Context) (T, error) {
+	start := time.Now()
+	data, err := h.fetch(ctx)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	fetchDuration.With(h.Path, result).Observe(time.Since(start).Seconds())
+	return data, err
+}
+
+func (h *HTTP[T]) fetch(ctx context.Context) (T, error) {
+	var data T
+	body, err := h.Client.Get(ctx, h.Path, h.Timeout)
+	if err != nil {
+		return data, err
+	}
+	// レスポンスボディをデコード
+	if err := json.Unmarshal(body, &data); err != nil {
+		return data, fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return data, nil
+}
+
+// fetcherをintervalごとに呼び出すSourceを返す
+func Poll[T any](fetcher Fetcher[T], interval time.Duration) Source[T] {
+	return &poller[T]{fetcher: fetcher, interval: interval}
+}
+
+// Runがすぐにerrを返すSourceを返す
+func Failed[T any](err error) Source[T] {
+	return failed[T]{err: err}
+}
+
+func (f failed[T]) Run(context.Context, Sink[T]) error {
+	return f.err
+}
+
+// ctxがキャンセルされるまで何もしないSourceを返す
+// データを外から押し込まれるセンサーで使う
+func Idle[T any]() Source[T] {
+	return idle[T]{}
+}
+
+func (idle[T]) Run(ctx context.Context, _ Sink[T]) error {
+	<-ctx.Done()
+	return nil
+}
+
+// Pollで作ったSourceならその中のFetcherと呼び出す間隔を返す
+func PollerOf[T any](src Source[T]) (Fetcher[T], time.Duration, bool) {
+	p, ok := src.(*poller[T])
+	if !ok {
+		return nil, 0, false
+	}
+	return p.fetcher, p.interval, true
+}
+
+func (p *poller[T]) Run(ctx context.Context, sink Sink[T]) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop() // 終了する際にTickerを停止
+
+	// Tickerのチャンネルから定期的にシグナルを受信
+	// ctxがキャンセルされたら終了する
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			data, err := p.fetcher.Fetch(ctx)
+			if errors.Is(err, ErrSkip) {
+				continue
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				sink.Fail(err)
+				continue
+			}
+			sink.Emit(data)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package stream
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+)
+
+// 1クライアントに溜めておけるイベントの数
+// 溜まりきったら新しいイベントを落とし、落とした件数を後で知らせる
+const bufferSize = 256
+
+// 受信したデータ1件分のイベント
+type Event struct {
+	Sensor string `json:"sensor"`
+	// 受信時刻(Unixミリ秒)
+	Time int64 `json:"t"`
+	// UI用に整形したデータ
+	Data json.RawMessage `json:"data"`
+	// デバイス・serialサーバ・Neonの時刻
+	Timestamps clock.Timestamps `json:"timestamps"`
+}
+
+// 受信したデータを購読しているクライアントに配る
+type Hub struct {
+	mu sync.Mutex
+	// 配信できるセンサーの名前
+	sensors map[string]bool
+	clients map[*client]struct{}
+	closed  bool
+}
+
+// 1クライアント分の購読
+type client struct {
+	// 購読しているセンサー
+	sensors map[string]bool
+	// 同じセンサーのイベントを送る最小の間隔(0なら間引かない)
+	interval time.Duration
+	events   chan Event
+
+	// 以下はHubのmuで保護
+	// センサーごとの最後に送ったイベントの受信時刻
+	last map[string]time.Time
+	// 溜まりきって落としたイベントの数
+	dropped int
+}
@@ -0,0 +1,185 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TitechMeister/Neon/clock"
+	"github.com/labstack/echo"
+)
+
+// 購読しているクライアントが何も受け取らないときに接続を保つ間隔
+const keepAlive = 15 * time.Second
+
+// sensorsのデータを配信するHubを返す
+func NewHub(sensors ...string) *Hub {
+	h := &Hub{sensors: map[string]bool{}, clients: map[*client]struct{}{}}
+	for _, name := range sensors {
+		h.sensors[name] = true
+	}
+	return h
+}
+
+func (h *Hub) RegisterRoutes(e *echo.Echo) {
+	e.GET("/stream", h.GetStream)
+}
+
+// 受信したデータを購読しているクライアントに配る
+// クライアントが読むのを待たないので、遅いクライアントがいてもロガーは止まらない
+func (h *Hub) Publish(sensor string, stamps clock.Timestamps, data json.RawMessage) {
+	t := time.UnixMilli(stamps.Ingest)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if !c.sensors[sensor] {
+			continue
+		}
+		if c.interval > 0 && t.Sub(c.last[sensor]) < c.interval {
+			continue
+		}
+		select {
+		case c.events <- Event{Sensor: sensor, Time: stamps.Ingest, Data: data, Timestamps: stamps}:
+			c.last[sensor] = t
+		default:
+			c.dropped++
+		}
+	}
+}
+
+// すべてのクライアントの接続を終わらせる
+// 以降の購読は断る
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for c := range h.clients {
+		close(c.events)
+		delete(h.clients, c)
+	}
+}
+
+func (h *Hub) subscribe(sensors map[string]bool, interval time.Duration) (*client, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	c := &client{
+		sensors:  sensors,
+		interval: interval,
+		events:   make(chan Event, bufferSize),
+		last:     map[string]time.Time{},
+	}
+	h.clients[c] = struct{}{}
+	return c, true
+}
+
+func (h *Hub) unsubscribe(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; ok {
+		close(c.events)
+		delete(h.clients, c)
+	}
+}
+
+// 落としたイベントの数を返して数え直す
+func (h *Hub) takeDropped(c *client) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := c.dropped
+	c.dropped = 0
+	return n
+}
+
+// Server-Sent Eventsで受信したデータを送り続ける
+// ?sensors=gps,pitot で購読するセンサーを選ぶ(省略時はすべて)
+// ?rate=5 で1センサーあたり毎秒5件までに間引く
+func (h *Hub) GetStream(c echo.Context) error {
+	sensors, err := h.parseSensors(c.QueryParam("sensors"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	var interval time.Duration
+	if v := c.QueryParam("rate"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate <= 0 {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid rate: %q", v))
+		}
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	client, ok := h.subscribe(sensors, interval)
+	if !ok {
+		return c.String(http.StatusServiceUnavailable, "Server is shutting down")
+	}
+	defer h.unsubscribe(client)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			// コメント行で接続を保つ
+			if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case event, ok := <-client.events:
+			if !ok {
+				return nil
+			}
+			// 溜まりきって落としたイベントがあれば先に知らせる
+			if n := h.takeDropped(client); n > 0 {
+				if _, err := fmt.Fprintf(res, "event: dropped\ndata: {\"count\":%d}\n\n", n); err != nil {
+					return nil
+				}
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Sensor, payload); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+// カンマ区切りのセンサー名を検証する
+func (h *Hub) parseSensors(v string) (map[string]bool, error) {
+	sensors := map[string]bool{}
+	if v == "" {
+		for name := range h.sensors {
+			sensors[name] = true
+		}
+		return sensors, nil
+	}
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if !h.sensors[name] {
+			known := []string{}
+			for k := range h.sensors {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown sensor %q (one of %s)", name, strings.Join(known, ", "))
+		}
+		sensors[name] = true
+	}
+	return sensors, nil
+}
@@ -1,8 +1,7 @@
 package tacho
 
 import (
-	"net/http"
-	"time"
+	"github.com/TitechMeister/Neon/sensor"
 )
 
 type TachoData struct {
@@ -14,12 +13,16 @@ type TachoData struct {
 }
 
 type TachoMeter struct {
-	DataHistory  []TachoData  `json:"data_history"`
-	Client       *http.Client `json:"client"`        // HTTP client for requests
-	LogFrequency int          `json:"log_frequency"` // Frequency of logging data in a second
+	*sensor.Sensor[TachoData, TachoData] // UIにも生データをそのまま返す
 }
 
-type TachoDLlink struct {
-	DownloadLink string    `json:"download_link"`
-	Timestamp    time.Time `json:"timestamp"`
+type TachoDLlink = sensor.DLlink
+
+// シリアルで送られる回転計のパケット(ビッグエンディアン、16バイト)
+type tachoPacket struct {
+	ID        uint8
+	_         [3]byte
+	Timestamp uint32
+	RPS       float32
+	Strain    uint32
 }
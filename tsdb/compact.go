@@ -0,0 +1,171 @@
+package tsdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// 保持期間を過ぎたセグメントを削除し、書き込みが終わった小さなセグメントをまとめる
+func (s *Store) Maintain(now time.Time) error {
+	s.mu.Lock()
+	all := make([]*series, 0, len(s.series))
+	for _, sr := range s.series {
+		all = append(all, sr)
+	}
+	s.mu.Unlock()
+
+	cutoff := int64(math.MinInt64)
+	if s.options.Retention > 0 {
+		cutoff = now.Add(-s.options.Retention).UnixMilli()
+	}
+	var errs []error
+	for _, sr := range all {
+		errs = append(errs, s.maintainSeries(sr, cutoff))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) maintainSeries(sr *series, cutoff int64) error {
+	// 最後のセグメントは書き込み中なので触らない
+	sr.mu.RLock()
+	closed := []*segment{}
+	if len(sr.segments) > 1 {
+		closed = append(closed, sr.segments[:len(sr.segments)-1]...)
+	}
+	sr.mu.RUnlock()
+
+	expired := []*segment{}
+	kept := []*segment{}
+	for _, seg := range closed {
+		if seg.count == 0 || seg.maxTime < cutoff {
+			expired = append(expired, seg)
+		} else {
+			kept = append(kept, seg)
+		}
+	}
+	if err := sr.remove(expired, nil); err != nil {
+		return err
+	}
+	if s.options.CompactSize <= 0 {
+		return nil
+	}
+
+	// 隣り合うセグメントをCompactSizeを超えない範囲でまとめる
+	var errs []error
+	group := []*segment{}
+	var size int64
+	for _, seg := range kept {
+		if len(group) > 0 && size+seg.size > s.options.CompactSize {
+			errs = append(errs, sr.compact(group, cutoff))
+			group, size = nil, 0
+		}
+		group = append(group, seg)
+		size += seg.size
+	}
+	errs = append(errs, sr.compact(group, cutoff))
+	return errors.Join(errs...)
+}
+
+// groupのセグメントを1つのセグメントにまとめる
+// 一時ファイルに書いてから名前を変えるので、途中で止まっても元のセグメントは残る
+func (sr *series) compact(group []*segment, cutoff int64) error {
+	if len(group) < 2 {
+		return nil
+	}
+	first, last := group[0], group[len(group)-1]
+	merged := &segment{path: segmentName(sr.dir, first.start, max(last.start, last.end)), start: first.start, end: max(last.start, last.end)}
+	tmp := merged.path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	var writeErr error
+	for _, seg := range group {
+		_, err := scanSegment(seg.path, func(t int64, session string, payload []byte) bool {
+			if t < cutoff {
+				return true
+			}
+			rec, err := encodeRecord(Point{Time: time.UnixMilli(t), Session: session, Payload: payload})
+			if err == nil {
+				_, err = w.Write(rec)
+			}
+			if err != nil {
+				writeErr = err
+				return false
+			}
+			if merged.count == 0 || t < merged.minTime {
+				merged.minTime = t
+			}
+			if merged.count == 0 || t > merged.maxTime {
+				merged.maxTime = t
+			}
+			merged.count++
+			merged.size += int64(len(rec))
+			return true
+		})
+		if err != nil && !errors.Is(err, errCorrupt) {
+			writeErr = err
+		}
+		if writeErr != nil {
+			break
+		}
+	}
+	if writeErr == nil {
+		writeErr = w.Flush()
+	}
+	if writeErr == nil {
+		writeErr = file.Sync()
+	}
+	if err := file.Close(); writeErr == nil {
+		writeErr = err
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tmp, merged.path)
+	}
+	if writeErr != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact %s: %w", merged.path, writeErr)
+	}
+	return sr.remove(group, merged)
+}
+
+// segmentsを索引から外してファイルを削除する
+// replacementがあれば外したセグメントの位置に入れる
+func (sr *series) remove(segments []*segment, replacement *segment) error {
+	if len(segments) == 0 {
+		return nil
+	}
+	removed := map[*segment]bool{}
+	for _, seg := range segments {
+		removed[seg] = true
+	}
+
+	sr.files.Lock()
+	defer sr.files.Unlock()
+	sr.mu.Lock()
+	next := make([]*segment, 0, len(sr.segments))
+	for _, seg := range sr.segments {
+		if !removed[seg] {
+			next = append(next, seg)
+		} else if replacement != nil {
+			next = append(next, replacement)
+			replacement = nil
+		}
+	}
+	sr.segments = next
+	sr.mu.Unlock()
+
+	var errs []error
+	for _, seg := range segments {
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,74 @@
+package tsdb
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// ストアの動作設定
+type Options struct {
+	// 1つのセグメントに書く期間
+	SegmentDuration time.Duration
+	// これより古いセグメントは削除する(0なら削除しない)
+	Retention time.Duration
+	// 書き込みが終わったセグメントをこの大きさまでまとめる
+	CompactSize int64
+}
+
+// 1件のデータ
+type Point struct {
+	// Neonがデータを受け取った時刻
+	Time time.Time
+	// フライトセッションのID(セッション外なら空)
+	Session string
+	// センサーのデータ(JSON)
+	Payload []byte
+}
+
+// 問い合わせ条件
+type Query struct {
+	From time.Time
+	To   time.Time
+	// AllSessionsがfalseなら、このセッションのデータだけを返す
+	Session     string
+	AllSessions bool
+}
+
+// センサーごとのデータを時刻順のセグメントファイルに追記していく組み込みの時系列ストア
+//
+//	<dir>/<sensor>/<開始時刻>.seg           書き込み中または通常のセグメント
+//	<dir>/<sensor>/<開始時刻>_<終了時刻>.seg  まとめたセグメント
+//
+// 時刻はどれもUnixミリ秒
+type Store struct {
+	dir     string
+	options Options
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// 1センサー分のセグメントの集まり
+type series struct {
+	dir string
+
+	mu       sync.RWMutex
+	segments []*segment // 開始時刻順
+	active   *os.File   // 最後のセグメントに追記するファイル
+
+	// 読み出し中のセグメントをまとめたり削除したりしないためのロック
+	files sync.RWMutex
+}
+
+type segment struct {
+	path string
+	// ファイル名の開始時刻と(まとめたセグメントなら)終了時刻
+	start int64
+	end   int64
+	// 中のデータの最小・最大の時刻
+	minTime int64
+	maxTime int64
+	count   int
+	size    int64
+}
@@ -0,0 +1,143 @@
+package tsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// レコードの形式(ビッグエンディアン)
+//
+//	[0:4]   本体の長さ
+//	[4:8]   本体のCRC32
+//	本体    時刻(int64, Unixミリ秒) | セッションIDの長さ(uint8) | セッションID | データ
+const recordHeaderSize = 8
+
+// 本体の最大長(壊れた長さで巨大な確保をしないため)
+const maxRecordSize = 16 << 20
+
+var errCorrupt = errors.New("corrupt record")
+
+// 1件のレコードを作る
+func encodeRecord(p Point) ([]byte, error) {
+	if len(p.Session) > 255 {
+		return nil, fmt.Errorf("session id too long: %d bytes", len(p.Session))
+	}
+	bodyLen := 8 + 1 + len(p.Session) + len(p.Payload)
+	buf := make([]byte, recordHeaderSize+bodyLen)
+	body := buf[recordHeaderSize:]
+	binary.BigEndian.PutUint64(body[0:8], uint64(p.Time.UnixMilli()))
+	body[8] = uint8(len(p.Session))
+	copy(body[9:], p.Session)
+	copy(body[9+len(p.Session):], p.Payload)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(bodyLen))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	return buf, nil
+}
+
+// セグメントのレコードを先頭から順に読む
+// fnがfalseを返したら読むのをやめる
+// 途中で切れたレコードや壊れたレコードに当たったら、そこまでのバイト数とerrCorruptを返す
+func scanSegment(path string, fn func(t int64, session string, payload []byte) bool) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReaderSize(file, 64<<10)
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, errCorrupt
+		}
+		bodyLen := binary.BigEndian.Uint32(header[0:4])
+		if bodyLen < 9 || bodyLen > maxRecordSize {
+			return offset, errCorrupt
+		}
+		body := make([]byte, bodyLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return offset, errCorrupt
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, errCorrupt
+		}
+		sessLen := int(body[8])
+		if 9+sessLen > len(body) {
+			return offset, errCorrupt
+		}
+		offset += int64(recordHeaderSize + len(body))
+		t := int64(binary.BigEndian.Uint64(body[0:8]))
+		if !fn(t, string(body[9:9+sessLen]), body[9+sessLen:]) {
+			return offset, nil
+		}
+	}
+}
+
+// セグメントのファイル名を読む
+func parseSegmentName(path string) (start, end int64, ok bool) {
+	name := strings.TrimSuffix(filepath.Base(path), ".seg")
+	if name == filepath.Base(path) {
+		return 0, 0, false
+	}
+	first, last, compacted := strings.Cut(name, "_")
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !compacted {
+		return start, 0, true
+	}
+	end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+func segmentName(dir string, start, end int64) string {
+	if end == 0 {
+		return filepath.Join(dir, fmt.Sprintf("%d.seg", start))
+	}
+	return filepath.Join(dir, fmt.Sprintf("%d_%d.seg", start, end))
+}
+
+// セグメントを読み込んで索引を作る
+// 末尾が壊れていれば(書き込み中のクラッシュ)そこで切り詰める
+func loadSegment(path string) (*segment, error) {
+	start, end, ok := parseSegmentName(path)
+	if !ok {
+		return nil, fmt.Errorf("unexpected segment name %s", path)
+	}
+	seg := &segment{path: path, start: start, end: end}
+	valid, err := scanSegment(path, func(t int64, _ string, _ []byte) bool {
+		if seg.count == 0 || t < seg.minTime {
+			seg.minTime = t
+		}
+		if seg.count == 0 || t > seg.maxTime {
+			seg.maxTime = t
+		}
+		seg.count++
+		return true
+	})
+	if errors.Is(err, errCorrupt) {
+		if err := os.Truncate(path, valid); err != nil {
+			return nil, fmt.Errorf("failed to truncate %s: %w", path, err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	seg.size = valid
+	return seg, nil
+}
@@ -0,0 +1,288 @@
+package tsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/TitechMeister/Neon/logging"
+)
+
+var logger = logging.For("tsdb")
+
+// ストアを開き、既存のセグメントの索引を作る
+func Open(dir string, options Options) (*Store, error) {
+	if options.SegmentDuration <= 0 {
+		options.SegmentDuration = time.Hour
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	s := &Store{dir: dir, options: options, series: map[string]*series{}}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		sr, err := loadSeries(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s.series[entry.Name()] = sr
+	}
+	return s, nil
+}
+
+// データを追記する
+func (s *Store) Append(sensor string, p Point) error {
+	sr, err := s.seriesFor(sensor)
+	if err != nil {
+		return err
+	}
+	rec, err := encodeRecord(p)
+	if err != nil {
+		return err
+	}
+	t := p.Time.UnixMilli()
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	last := sr.last()
+	// 期間を過ぎたら新しいセグメントに切り替える
+	if last == nil || last.end != 0 || t >= last.start+s.options.SegmentDuration.Milliseconds() {
+		start := t
+		if last != nil && start <= max(last.start, last.end) {
+			start = max(last.start, last.end) + 1
+		}
+		if err := sr.closeActive(); err != nil {
+			return err
+		}
+		last = &segment{path: segmentName(sr.dir, start, 0), start: start}
+		sr.segments = append(sr.segments, last)
+	}
+	if sr.active == nil {
+		file, err := os.OpenFile(last.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", last.path, err)
+		}
+		sr.active = file
+	}
+	if _, err := sr.active.Write(rec); err != nil {
+		return fmt.Errorf("failed to write %s: %w", last.path, err)
+	}
+	if last.count == 0 || t < last.minTime {
+		last.minTime = t
+	}
+	if last.count == 0 || t > last.maxTime {
+		last.maxTime = t
+	}
+	last.count++
+	last.size += int64(len(rec))
+	return nil
+}
+
+// 条件に合うデータを時刻順に返す
+func (s *Store) Query(sensor string, q Query) ([]Point, error) {
+	points := []Point{}
+	err := s.Scan(sensor, q, func(p Point) bool {
+		points = append(points, p)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+	return points, nil
+}
+
+// 条件に合うデータを、セグメントの順に1件ずつfnに渡す
+// fnがfalseを返したらやめる
+func (s *Store) Scan(sensor string, q Query, fn func(Point) bool) error {
+	s.mu.Lock()
+	sr, ok := s.series[sensor]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	from, to := q.From.UnixMilli(), q.To.UnixMilli()
+
+	sr.files.RLock()
+	defer sr.files.RUnlock()
+	sr.mu.RLock()
+	segments := []*segment{}
+	for _, seg := range sr.segments {
+		if seg.count > 0 && seg.maxTime >= from && seg.minTime <= to {
+			segments = append(segments, seg)
+		}
+	}
+	sr.mu.RUnlock()
+
+	stopped := false
+	for _, seg := range segments {
+		_, err := scanSegment(seg.path, func(t int64, session string, payload []byte) bool {
+			if t < from || t > to || (!q.AllSessions && session != q.Session) {
+				return true
+			}
+			if !fn(Point{Time: time.UnixMilli(t), Session: session, Payload: payload}) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		// 書き込み中のセグメントの末尾は読み飛ばす
+		if err != nil && !errors.Is(err, errCorrupt) {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// データのあるセンサーの一覧を返す
+func (s *Store) Sensors() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := []string{}
+	for name := range s.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 書き込み中のセグメントをfsyncする
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, sr := range s.series {
+		sr.mu.Lock()
+		if sr.active != nil {
+			errs = append(errs, sr.active.Sync())
+		}
+		sr.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// 書き込み中のセグメントを閉じる
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, sr := range s.series {
+		sr.mu.Lock()
+		errs = append(errs, sr.closeActive())
+		sr.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// intervalごとに古いセグメントの削除とまとめを行う
+// ctxがキャンセルされるまで戻らない
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := s.Maintain(now); err != nil {
+				logger.Warn("failed to maintain time-series store", "err", err)
+			}
+		}
+	}
+}
+
+func (s *Store) seriesFor(sensor string) (*series, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sr, ok := s.series[sensor]; ok {
+		return sr, nil
+	}
+	dir := filepath.Join(s.dir, sensor)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	sr := &series{dir: dir}
+	s.series[sensor] = sr
+	return sr, nil
+}
+
+// センサーのディレクトリからセグメントを読み込む
+// まとめる途中で止まった一時ファイルや、まとめ済みで消し忘れたセグメントはここで削除する
+func loadSeries(dir string) (*series, error) {
+	tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+
+	type named struct {
+		path       string
+		start, end int64
+	}
+	files := []named{}
+	for _, p := range paths {
+		if start, end, ok := parseSegmentName(p); ok {
+			files = append(files, named{p, start, end})
+		}
+	}
+	sr := &series{dir: dir}
+	for _, f := range files {
+		covered := false
+		for _, c := range files {
+			if c.end != 0 && c.path != f.path && f.start >= c.start && f.start <= c.end && max(f.start, f.end) <= c.end {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			if err := os.Remove(f.path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		seg, err := loadSegment(f.path)
+		if err != nil {
+			return nil, err
+		}
+		sr.segments = append(sr.segments, seg)
+	}
+	sort.Slice(sr.segments, func(i, j int) bool {
+		return sr.segments[i].start < sr.segments[j].start
+	})
+	return sr, nil
+}
+
+func (sr *series) last() *segment {
+	if len(sr.segments) == 0 {
+		return nil
+	}
+	return sr.segments[len(sr.segments)-1]
+}
+
+// mu を取った状態で呼ぶ
+func (sr *series) closeActive() error {
+	if sr.active == nil {
+		return nil
+	}
+	err := sr.active.Close()
+	sr.active = nil
+	return err
+}
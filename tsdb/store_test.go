@@ -0,0 +1,162 @@
+package tsdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openStore(t *testing.T, dir string, options Options) *Store {
+	t.Helper()
+	s, err := Open(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func appendPoints(t *testing.T, s *Store, times ...time.Time) {
+	t.Helper()
+	for i, tm := range times {
+		if err := s.Append("test", Point{Time: tm, Payload: []byte{byte('0' + i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func queryAll(t *testing.T, s *Store) []Point {
+	t.Helper()
+	points, err := s.Query("test", Query{From: time.UnixMilli(0), To: time.UnixMilli(1 << 50), AllSessions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return points
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "test", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, p := range paths {
+		names = append(names, filepath.Base(p))
+	}
+	return names
+}
+
+// 書き込み中に落ちて最後のレコードが途中までしかなければ、開いたときにそこで切り詰める
+func TestOpenTruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	base := time.UnixMilli(1_700_000_000_000)
+	s := openStore(t, dir, Options{})
+	appendPoints(t, s, base, base.Add(time.Millisecond), base.Add(2*time.Millisecond))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "test", segmentFiles(t, dir)[0])
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := encodeRecord(Point{Time: base.Add(3 * time.Millisecond), Payload: []byte("torn")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(rec[:len(rec)-2])
+	f.Close()
+
+	s = openStore(t, dir, Options{})
+	if n := len(queryAll(t, s)); n != 3 {
+		t.Fatalf("read %d points after reopen, want 3", n)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Fatalf("segment is %d bytes, want it truncated to %d", after.Size(), info.Size())
+	}
+	// 切り詰めた後ろに続けて書ける
+	appendPoints(t, s, base.Add(4*time.Millisecond))
+	if n := len(queryAll(t, s)); n != 4 {
+		t.Fatalf("read %d points after append, want 4", n)
+	}
+}
+
+// まとめたセグメントの名前を変えた後、元のセグメントを消す前に止まっていたら、開いたときに元のセグメントを消す
+func TestOpenCleansUpInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	base := time.UnixMilli(1_700_000_000_000)
+	options := Options{SegmentDuration: time.Second, CompactSize: 1 << 20}
+	s := openStore(t, dir, options)
+	appendPoints(t, s, base, base.Add(time.Second), base.Add(2*time.Second))
+	before := segmentFiles(t, dir)
+	if len(before) != 3 {
+		t.Fatalf("segments = %v, want 3", before)
+	}
+	saved := map[string][]byte{}
+	for _, name := range before[:2] {
+		b, err := os.ReadFile(filepath.Join(dir, "test", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved[name] = b
+	}
+	if err := s.Maintain(base.Add(3 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files := segmentFiles(t, dir); len(files) != 2 {
+		t.Fatalf("segments after compaction = %v, want 2", files)
+	}
+
+	// 元のセグメントと、まとめる途中の一時ファイルが残っている状態にする
+	for name, b := range saved {
+		if err := os.WriteFile(filepath.Join(dir, "test", name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "test", "1_2.seg.tmp"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openStore(t, dir, options)
+	if n := len(queryAll(t, s)); n != 3 {
+		t.Fatalf("read %d points, want 3 without duplicates", n)
+	}
+	if files := segmentFiles(t, dir); len(files) != 2 {
+		t.Fatalf("segments after reopen = %v, want the compacted and the last segment", files)
+	}
+}
+
+// 保持期間を過ぎても、書き込み中の最後のセグメントは消さない
+func TestRetentionKeepsActiveSegment(t *testing.T) {
+	dir := t.TempDir()
+	base := time.UnixMilli(1_700_000_000_000)
+	s := openStore(t, dir, Options{SegmentDuration: time.Second, Retention: time.Minute})
+	appendPoints(t, s, base, base.Add(time.Second), base.Add(2*time.Second))
+
+	if err := s.Maintain(base.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	files := segmentFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("segments = %v, want only the active one", files)
+	}
+	points := queryAll(t, s)
+	if len(points) != 1 || !points[0].Time.Equal(base.Add(2*time.Second)) {
+		t.Fatalf("points = %v, want the last one", points)
+	}
+	// 書き込み中のセグメントにはそのまま追記できる
+	appendPoints(t, s, base.Add(2*time.Second+time.Millisecond))
+	if n := len(queryAll(t, s)); n != 2 {
+		t.Fatalf("read %d points after append, want 2", n)
+	}
+}
@@ -0,0 +1,15 @@
+package upstream
+
+import (
+	"github.com/TitechMeister/Neon/metrics"
+)
+
+// serialサーバとの接続の指標
+var (
+	retriesTotal = metrics.NewCounterVec("neon_upstream_retries_total",
+		"Requests to the serial server that were retried.")
+	circuitOpens = metrics.NewCounterVec("neon_upstream_circuit_opens_total",
+		"Times the serial server circuit was opened.")
+	circuitOpen = metrics.NewGaugeVec("neon_upstream_circuit_open",
+		"1 while requests to the serial server are held back, otherwise 0.")
+)
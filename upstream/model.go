@@ -0,0 +1,111 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 失敗の種類
+const (
+	// 時間内に応答がなかった
+	KindTimeout = "timeout"
+	// 接続できなかった
+	KindUnreachable = "unreachable"
+	// 200以外のステータスが返った
+	KindStatus = "status"
+	// 遮断中なのでリクエストを送らなかった
+	KindCircuitOpen = "circuit_open"
+)
+
+// 遮断器の状態
+const (
+	// リクエストを送る
+	StateClosed = "closed"
+	// serialサーバが落ちているとみなし、リクエストを送らない
+	StateOpen = "open"
+	// 様子見のリクエストを1つだけ送る
+	StateHalfOpen = "half_open"
+)
+
+// リクエストを送る前に呼ばれ、故障を起こす
+// ctxには時間制限が付いている。エラーを返すとリクエストを送らずにその失敗として扱う
+type Fault func(ctx context.Context) error
+
+// ctxに故障を持たせるための鍵
+type faultKey struct{}
+
+// 遮断中にリクエストを送らなかったことを表すエラー
+var ErrCircuitOpen = errors.New("serial server circuit is open")
+
+// serialサーバへのリクエストの失敗
+// errors.Asで取り出してKindで種類を見分ける
+type Error struct {
+	// 失敗の種類 "timeout", "unreachable", "status", "circuit_open"
+	Kind   string
+	Method string
+	Path   string
+	// 諦めるまでに送ったリクエストの数
+	Attempts int
+	Err      error
+}
+
+// serialサーバが200以外を返した
+type StatusError struct {
+	Code int
+	// レスポンスボディ(長ければ切り詰める)
+	Body string
+}
+
+// serialサーバへのリクエストの方針
+type Options struct {
+	// 1回の呼び出しの時間制限(0ならセンサーの取得間隔から決める)
+	Timeout time.Duration
+	// 接続の失敗や5xxのときにGETをやり直す回数
+	Retries int
+	// やり直すまでの待ち時間
+	RetryBackoff time.Duration
+	// 続けてこの回数失敗したら遮断する
+	BreakerThreshold int
+	// 遮断してから様子見するまでの時間(様子見に失敗するたびに倍にする)
+	BreakerCooldown time.Duration
+	// 様子見するまでの時間の上限
+	BreakerMaxCooldown time.Duration
+}
+
+// 全センサーで共有するserialサーバのクライアント
+// 接続を使い回し、serialサーバが落ちている間はリクエストを控える
+type Client struct {
+	// ベースURL e.g. "http://localhost:7878"
+	base    string
+	options Options
+	http    *http.Client
+
+	mu sync.Mutex
+	// 遮断器の状態
+	state string
+	// 続けて失敗した回数
+	failures int
+	// 今の遮断の長さと、様子見を始める時刻
+	cooldown time.Duration
+	retryAt  time.Time
+	// 様子見のリクエストを送っているか
+	probing bool
+	// これまでに遮断した回数
+	opens     int
+	lastError string
+}
+
+// GET /upstream のレスポンス
+type Status struct {
+	URL   string `json:"url"`
+	State string `json:"state"`
+	// 続けて失敗した回数と、これまでに遮断した回数
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	Opens               int `json:"opens"`
+	// 遮断中なら様子見を始める時刻(Unixミリ秒)
+	RetryAt   *int64 `json:"retry_at,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
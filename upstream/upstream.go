@@ -0,0 +1,341 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TitechMeister/Neon/logging"
+	"github.com/labstack/echo"
+)
+
+var logger = logging.For("upstream")
+
+const (
+	// 取得間隔から決める時間制限の下限
+	minTimeout = 100 * time.Millisecond
+	// 読み込むレスポンスボディの上限
+	maxBody = 1 << 20
+	// エラーに含めるレスポンスボディの長さ
+	maxErrorBody = 200
+	// センサーの数より多く接続を使い回せるようにする
+	maxIdleConns = 16
+)
+
+// 省略された遮断器の設定に使う値
+const (
+	defaultBreakerThreshold   = 5
+	defaultBreakerCooldown    = time.Second
+	defaultBreakerMaxCooldown = 30 * time.Second
+)
+
+func (e *Error) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("%s %s: %v (after %d attempts)", e.Method, e.Path, e.Err, e.Attempts)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Method, e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("server returned status %d", e.Code)
+	}
+	return fmt.Sprintf("server returned status %d: %s", e.Code, e.Body)
+}
+
+// errがserialサーバへのリクエストの失敗ならその種類を返す
+func KindOf(err error) (string, bool) {
+	var e *Error
+	if !errors.As(err, &e) {
+		return "", false
+	}
+	return e.Kind, true
+}
+
+// baseURLはserialサーバのベースURL e.g. "http://localhost:7878"
+func New(baseURL string, options Options) *Client {
+	if options.BreakerThreshold <= 0 {
+		options.BreakerThreshold = defaultBreakerThreshold
+	}
+	if options.BreakerCooldown <= 0 {
+		options.BreakerCooldown = defaultBreakerCooldown
+	}
+	if options.BreakerMaxCooldown < options.BreakerCooldown {
+		options.BreakerMaxCooldown = max(defaultBreakerMaxCooldown, options.BreakerCooldown)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	return &Client{
+		base:    strings.TrimSuffix(baseURL, "/"),
+		options: options,
+		http:    &http.Client{Transport: transport},
+		state:   StateClosed,
+	}
+}
+
+// serialサーバ上のパスから完全なURLを返す
+func (c *Client) URL(path string) string {
+	return c.base + path
+}
+
+// intervalごとに取得するときの1回の呼び出しの時間制限を返す
+// 次の取得までに終わらないリクエストは待たない
+func (c *Client) Timeout(interval time.Duration) time.Duration {
+	if c.options.Timeout > 0 {
+		return c.options.Timeout
+	}
+	return max(interval, minTimeout)
+}
+
+// pathをGETしてレスポンスボディを返す
+// timeoutはやり直しを含めた時間制限(0なら制限しない)
+func (c *Client) Get(ctx context.Context, path string, timeout time.Duration) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, path, "", nil, timeout)
+}
+
+// pathにbodyをPOSTしてレスポンスボディを返す
+// 失敗しても書き込みが届いているかもしれないので、やり直さない
+func (c *Client) Post(ctx context.Context, path, contentType string, body []byte, timeout time.Duration) ([]byte, error) {
+	return c.do(ctx, http.MethodPost, path, contentType, body, timeout)
+}
+
+func (c *Client) do(ctx context.Context, method, path, contentType string, body []byte, timeout time.Duration) ([]byte, error) {
+	if err := c.allow(time.Now()); err != nil {
+		return nil, &Error{Kind: KindCircuitOpen, Method: method, Path: path, Err: err}
+	}
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// GET以外は二重に送らないようにやり直さない
+	retries := 0
+	if method == http.MethodGet {
+		retries = c.options.Retries
+	}
+	attempts := 0
+	for {
+		attempts++
+		data, err := c.once(ctx, method, path, contentType, body)
+		if err == nil {
+			c.record(time.Now(), nil)
+			return data, nil
+		}
+		kind := classify(err)
+		if attempts <= retries && retryable(kind, err) && sleep(ctx, c.options.RetryBackoff) {
+			retriesTotal.With().Inc()
+			continue
+		}
+		err = &Error{Kind: kind, Method: method, Path: path, Attempts: attempts, Err: err}
+		switch {
+		case parent.Err() != nil:
+			// 呼び出し側が止めたのはserialサーバの失敗として数えない
+			c.release()
+		case kind == KindStatus && !retryable(kind, err):
+			// 4xxを返せるならserialサーバは動いている
+			c.record(time.Now(), nil)
+		default:
+			c.record(time.Now(), err)
+		}
+		return nil, err
+	}
+}
+
+// ctxで送るリクエストに故障を起こすようにする
+// 故障はやり直しのたびに時間制限の中で起こり、本物の失敗と同じように遮断器に記録される
+func WithFault(ctx context.Context, fault Fault) context.Context {
+	return context.WithValue(ctx, faultKey{}, fault)
+}
+
+// 1回だけリクエストを送る
+func (c *Client) once(ctx context.Context, method, path, contentType string, body []byte) ([]byte, error) {
+	if fault, ok := ctx.Value(faultKey{}).(Fault); ok {
+		if err := fault(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.URL(path), reader)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxBody))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		text := strings.TrimSpace(string(data))
+		if len(text) > maxErrorBody {
+			text = text[:maxErrorBody] + "..."
+		}
+		return nil, &StatusError{Code: res.StatusCode, Body: text}
+	}
+	return data, nil
+}
+
+// 失敗の種類を見分ける
+func classify(err error) string {
+	var status *StatusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &status):
+		return KindStatus
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return KindTimeout
+	default:
+		return KindUnreachable
+	}
+}
+
+// やり直せば成功しそうな失敗か
+// 時間切れは時間制限を使い切っているのでやり直さない
+func retryable(kind string, err error) bool {
+	var status *StatusError
+	switch kind {
+	case KindUnreachable:
+		return true
+	case KindStatus:
+		return errors.As(err, &status) && status.Code >= 500
+	default:
+		return false
+	}
+}
+
+// dだけ待つ
+// 待っている間にctxが終わればfalse
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// リクエストを送ってよいか
+// 遮断してから時間が経っていれば、様子見のリクエストを1つだけ通す
+func (c *Client) allow(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case StateOpen:
+		if now.Before(c.retryAt) {
+			return ErrCircuitOpen
+		}
+		c.setState(StateHalfOpen)
+		c.probing = true
+		logger.Info("probing serial server", "url", c.base)
+	case StateHalfOpen:
+		if c.probing {
+			return ErrCircuitOpen
+		}
+		c.probing = true
+	}
+	return nil
+}
+
+// リクエストの結果を遮断器に記録する
+// errがnilならserialサーバは動いている
+func (c *Client) record(now time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+	if err == nil {
+		if c.state != StateClosed {
+			logger.Info("serial server is back", "url", c.base)
+		}
+		c.setState(StateClosed)
+		c.failures = 0
+		c.cooldown = 0
+		return
+	}
+	c.failures++
+	c.lastError = err.Error()
+	switch {
+	case c.state == StateHalfOpen:
+		// 様子見に失敗したので次の様子見までの時間を延ばす
+		c.open(now, min(c.cooldown*2, c.options.BreakerMaxCooldown))
+	case c.state == StateClosed && c.failures >= c.options.BreakerThreshold:
+		c.open(now, c.options.BreakerCooldown)
+	}
+}
+
+// 様子見のリクエストを結果を記録せずに終える
+func (c *Client) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+}
+
+// cooldownの間リクエストを送らないようにする
+func (c *Client) open(now time.Time, cooldown time.Duration) {
+	c.setState(StateOpen)
+	c.cooldown = cooldown
+	c.retryAt = now.Add(cooldown)
+	c.opens++
+	circuitOpens.With().Inc()
+	logger.Warn("serial server circuit opened", "url", c.base, "failures", c.failures, "retry_in", cooldown, "err", c.lastError)
+}
+
+func (c *Client) setState(state string) {
+	c.state = state
+	open := 0.0
+	if state != StateClosed {
+		open = 1
+	}
+	circuitOpen.With().Set(open)
+}
+
+// 遮断器の状態を返す
+func (c *Client) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := Status{
+		URL:                 c.base,
+		State:               c.state,
+		ConsecutiveFailures: c.failures,
+		Opens:               c.opens,
+		LastError:           c.lastError,
+	}
+	if c.state == StateOpen {
+		at := c.retryAt.UnixMilli()
+		st.RetryAt = &at
+	}
+	return st
+}
+
+func (c *Client) RegisterRoutes(e *echo.Echo) {
+	e.GET("/upstream", c.GetStatus)
+}
+
+// 遮断器の状態を返す
+func (c *Client) GetStatus(ctx echo.Context) error {
+	return ctx.JSON(http.StatusOK, c.Status())
+}